@@ -1,10 +1,16 @@
 package sfs_client
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const HOST = "http://2b502.yeg.rac.sh:8080"
@@ -22,6 +28,7 @@ type Client struct {
 	Username  string
 	SessionId string
 	SignedIn  bool
+	uploads   map[string]pendingUpload
 }
 
 func NewClient() *Client {
@@ -29,6 +36,7 @@ func NewClient() *Client {
 	return &Client{
 		Client:   &client,
 		SignedIn: false,
+		uploads:  make(map[string]pendingUpload),
 	}
 }
 
@@ -42,6 +50,7 @@ func (client *Client) Signup(username string, password string) (string, error) {
 		return "", err
 	}
 	client.SignedIn = true
+	client.Username = username
 	return output, nil
 }
 
@@ -55,6 +64,7 @@ func (client *Client) Login(username string, password string) (string, error) {
 		return "", err
 	}
 	client.SignedIn = true
+	client.Username = username
 	return output, nil
 }
 
@@ -87,6 +97,81 @@ func (client *Client) Cat(filename string) (string, error) {
 	}
 }
 
+// CatRange returns length bytes of the file at path starting at offset, or
+// everything from offset on when length is negative. Downloads that were
+// cut off can be resumed with it.
+func (client *Client) CatRange(filename string, offset int64, length int64) (string, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	res, err := client.getRange("/cat", map[string]string{"filepath": filename}, byteRange)
+	if err != nil {
+		return "", errors.New("Failed to run command cat")
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return "", nil
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		return "", errors.New("Failed to run command cat")
+	}
+	return buf.String(), nil
+}
+
+// Head returns the first lines of the file at path. Only as much of the file
+// as is needed is downloaded.
+func (client *Client) Head(filename string, lines int) (string, error) {
+	res, err := client.get("/cat", map[string]string{"filepath": filename}, nil)
+	if err != nil {
+		return "", errors.New("Failed to run command head")
+	}
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+	buf := new(bytes.Buffer)
+	for i := 0; i < lines; i++ {
+		line, err := reader.ReadString('\n')
+		buf.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.New("Failed to run command head")
+		}
+	}
+	return buf.String(), nil
+}
+
+// Tail returns the last lines of the file at path. It asks for growing
+// ranges from the end of the file until they hold enough lines.
+func (client *Client) Tail(filename string, lines int) (string, error) {
+	for suffix := int64(4096); ; suffix *= 4 {
+		res, err := client.getRange("/cat", map[string]string{"filepath": filename}, fmt.Sprintf("bytes=-%d", suffix))
+		if err != nil {
+			return "", errors.New("Failed to run command tail")
+		}
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			res.Body.Close()
+			return "", nil
+		}
+		buf := new(bytes.Buffer)
+		_, err = buf.ReadFrom(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return "", errors.New("Failed to run command tail")
+		}
+		text := strings.TrimSuffix(buf.String(), "\n")
+		complete := res.StatusCode != http.StatusPartialContent || int64(buf.Len()) < suffix
+		if tokens := strings.Split(text, "\n"); len(tokens) > lines || complete {
+			if len(tokens) > lines {
+				tokens = tokens[len(tokens)-lines:]
+			}
+			return strings.Join(tokens, "\n"), nil
+		}
+	}
+}
+
 func (client *Client) Touch(filename string) (string, error) {
 	if output, err := client.runGetCommand("/touch", map[string]string{"filepath": filename}); err != nil {
 		return "", err
@@ -95,6 +180,16 @@ func (client *Client) Touch(filename string) (string, error) {
 	}
 }
 
+// Ln creates a link at linkName to target, which is resolved from the
+// link's directory when it is followed.
+func (client *Client) Ln(target string, linkName string) (string, error) {
+	if output, err := client.runGetCommand("/ln", map[string]string{"filepath": linkName, "target": target}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
 func (client *Client) Mkdir(dirname string) (string, error) {
 	if output, err := client.runGetCommand("/mkdir", map[string]string{"filepath": dirname}); err != nil {
 		return "", err
@@ -119,8 +214,233 @@ func (client *Client) Mv(filename string, newFileName string) (string, error) {
 	}
 }
 
-func (client *Client) Rm(path string) (string, error) {
-	if output, err := client.runGetCommand("/rm", map[string]string{"filepath": path}); err != nil {
+func (client *Client) Cp(filename string, newFileName string, recursive bool) (string, error) {
+	args := map[string]string{"filepath": filename, "newpath": newFileName, "recursive": strconv.FormatBool(recursive)}
+	if output, err := client.runGetCommand("/cp", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Rm(path string, recursive bool) (string, error) {
+	args := map[string]string{"filepath": path, "recursive": strconv.FormatBool(recursive)}
+	if output, err := client.runGetCommand("/rm", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// Lock locks the remote path for this session, exclusively unless shared
+// is set and only against other locks unless mandatory is set. A ttl of
+// zero leaves the lock time to the server, and force, for admins, breaks
+// locks in the way.
+func (client *Client) Lock(path string, shared bool, mandatory bool, ttl time.Duration, force bool) (string, error) {
+	mode := "exclusive"
+	if shared {
+		mode = "shared"
+	}
+	args := map[string]string{
+		"filepath":  path,
+		"mode":      mode,
+		"mandatory": strconv.FormatBool(mandatory),
+		"force":     strconv.FormatBool(force),
+	}
+	if ttl != 0 {
+		args["ttl"] = ttl.String()
+	}
+	if output, err := client.runGetCommand("/lock", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Unlock(path string, force bool) (string, error) {
+	args := map[string]string{"filepath": path, "force": strconv.FormatBool(force)}
+	if output, err := client.runGetCommand("/unlock", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Rmdir(path string) (string, error) {
+	if output, err := client.runGetCommand("/rmdir", map[string]string{"filepath": path}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Search(terms string) (string, error) {
+	if output, err := client.runGetCommand("/search", map[string]string{"terms": terms}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Quota() (string, error) {
+	if output, err := client.runGetCommand("/quota", map[string]string{}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// SetQuota changes the soft and hard limits, in bytes, of the user called
+// name, or with isGroup the group. Only admins may do this.
+func (client *Client) SetQuota(name string, isGroup bool, soft int64, hard int64) (string, error) {
+	args := map[string]string{"soft": strconv.FormatInt(soft, 10), "hard": strconv.FormatInt(hard, 10)}
+	if isGroup {
+		args["groupname"] = name
+	} else {
+		args["username"] = name
+	}
+	if output, err := client.runGetCommand("/quota/set", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// Compression shows whether new contents written in the current directory
+// are compressed when setting is empty. Otherwise it sets compression "on",
+// "off" or back to "default" for the user's files, or with path for the
+// files in and below that directory.
+func (client *Client) Compression(setting string, path string) (string, error) {
+	args := map[string]string{"setting": setting, "filepath": path}
+	if output, err := client.runGetCommand("/compress", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) TrashLs() (string, error) {
+	if output, err := client.runGetCommand("/trash/ls", map[string]string{}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) TrashRestore(path string) (string, error) {
+	if output, err := client.runGetCommand("/trash/restore", map[string]string{"filepath": path}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// SetTag sets the tag key of the remote path to value.
+func (client *Client) SetTag(path string, key string, value string) (string, error) {
+	args := map[string]string{"filepath": path, "key": key, "value": value}
+	if output, err := client.runGetCommand("/tag/set", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) GetTag(path string, key string) (string, error) {
+	if output, err := client.runGetCommand("/tag/get", map[string]string{"filepath": path, "key": key}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) RemoveTag(path string, key string) (string, error) {
+	if output, err := client.runGetCommand("/tag/rm", map[string]string{"filepath": path, "key": key}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) ListTags(path string) (string, error) {
+	if output, err := client.runGetCommand("/tag/list", map[string]string{"filepath": path}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) CreateSnapshot(name string) (string, error) {
+	if output, err := client.runGetCommand("/snapshot/create", map[string]string{"name": name}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) ListSnapshots() (string, error) {
+	if output, err := client.runGetCommand("/snapshot/ls", map[string]string{}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) RemoveSnapshot(name string) (string, error) {
+	if output, err := client.runGetCommand("/snapshot/rm", map[string]string{"name": name}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// RestoreSnapshot restores path, relative to the home directory, from the
+// snapshot called name, or the whole home directory if path is empty.
+func (client *Client) RestoreSnapshot(name string, path string) (string, error) {
+	args := map[string]string{"name": name, "filepath": path}
+	if output, err := client.runGetCommand("/snapshot/restore", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) TrashEmpty() (string, error) {
+	if output, err := client.runGetCommand("/trash/empty", map[string]string{}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Versions(path string) (string, error) {
+	if output, err := client.runGetCommand("/versions", map[string]string{"filepath": path}); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) CatVersion(path string, version int) (string, error) {
+	args := map[string]string{"filepath": path, "version": strconv.Itoa(version)}
+	if output, err := client.runGetCommand("/versions/cat", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Diff(path string, version int, otherVersion int) (string, error) {
+	args := map[string]string{"filepath": path, "version": strconv.Itoa(version), "otherversion": strconv.Itoa(otherVersion)}
+	if output, err := client.runGetCommand("/versions/diff", args); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+func (client *Client) Revert(path string, version int) (string, error) {
+	args := map[string]string{"filepath": path, "version": strconv.Itoa(version)}
+	if output, err := client.runGetCommand("/versions/revert", args); err != nil {
 		return "", err
 	} else {
 		return output, nil
@@ -143,8 +463,52 @@ func (client *Client) AddUserToGroup(username string, groupname string) (string,
 	}
 }
 
+// DeleteUser deletes the user called username and shreds everything they
+// own. Users may delete themselves, which ends their session, and admins
+// anyone.
+func (client *Client) DeleteUser(username string) (string, error) {
+	output, err := client.runGetCommand("/deluser", map[string]string{"username": username})
+	if err != nil {
+		return "", err
+	}
+	if username == client.Username {
+		client.SignedIn = false
+	}
+	return output, nil
+}
+
+// Write appends data to the file at path.
 func (client *Client) Write(path string, data string) (string, error) {
-	if output, err := client.runPostCommand("/write", map[string]string{"filepath": path}, []byte(data)); err != nil {
+	if output, err := client.runPostCommand("/write", map[string]string{"filepath": path, "mode": "append"}, []byte(data)); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// Overwrite atomically replaces the contents of the file at path with data.
+func (client *Client) Overwrite(path string, data string) (string, error) {
+	if output, err := client.runPostCommand("/write", map[string]string{"filepath": path, "mode": "overwrite"}, []byte(data)); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// Truncate cuts the file at path down to length bytes.
+func (client *Client) Truncate(path string, length int64) (string, error) {
+	args := map[string]string{"filepath": path, "mode": "truncate", "length": strconv.FormatInt(length, 10)}
+	if output, err := client.runPostCommand("/write", args, nil); err != nil {
+		return "", err
+	} else {
+		return output, nil
+	}
+}
+
+// Pwrite writes data into the file at path starting at offset.
+func (client *Client) Pwrite(path string, data string, offset int64) (string, error) {
+	args := map[string]string{"filepath": path, "mode": "pwrite", "offset": strconv.FormatInt(offset, 10)}
+	if output, err := client.runPostCommand("/write", args, []byte(data)); err != nil {
 		return "", err
 	} else {
 		return output, nil
@@ -192,6 +556,22 @@ func (client *Client) get(path string, args map[string]string, body []byte) (*ht
 	return res, err
 }
 
+func (client *Client) getRange(path string, args map[string]string, byteRange string) (*http.Response, error) {
+	req := client.prepareRequest("GET", path, nil)
+	query := req.URL.Query()
+	for name, value := range args {
+		query.Add(name, value)
+	}
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Range", byteRange)
+	res, err := client.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	client.updateSessionId(res)
+	return res, err
+}
+
 func (client *Client) post(path string, args map[string]string, body []byte) (*http.Response, error) {
 	req := client.prepareRequest("POST", path, body)
 	query := req.URL.Query()
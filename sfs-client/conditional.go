@@ -0,0 +1,99 @@
+package sfs_client
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// ErrPreconditionFailed is returned by conditional operations when the
+// remote file doesn't have the ETag they depend on any more.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Condition makes an operation depend on the ETag of a remote file, as
+// returned by CatETag and Stat. IfMatch holds ETags one of which the file
+// must have, IfNoneMatch ones it must not have, separated by commas; "*"
+// stands for any.
+type Condition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// IfMatch is the condition that the file still has the given ETag, so it
+// wasn't changed since it was read.
+func IfMatch(etag string) Condition {
+	return Condition{IfMatch: etag}
+}
+
+// CatETag returns the contents of the remote file at path along with their
+// ETag. If the file can't be read the server's message is returned instead,
+// without an ETag.
+func (client *Client) CatETag(path string) (string, string, error) {
+	res, err := client.get("/cat", map[string]string{"filepath": path}, nil)
+	if err != nil {
+		return "", "", errors.New("Failed to run command cat")
+	}
+	output, err := readBody(res)
+	if err != nil || res.Header.Get("Content-Type") != "application/octet-stream" {
+		return output, "", err
+	}
+	return output, res.Header.Get("ETag"), nil
+}
+
+// WriteIf appends data to the file at path if the condition holds.
+func (client *Client) WriteIf(path string, data string, cond Condition) (string, error) {
+	args := map[string]string{"filepath": path, "mode": "append"}
+	return client.runConditional("POST", "/write", args, []byte(data), cond)
+}
+
+// OverwriteIf replaces the contents of the file at path with data if the
+// condition holds.
+func (client *Client) OverwriteIf(path string, data string, cond Condition) (string, error) {
+	args := map[string]string{"filepath": path, "mode": "overwrite"}
+	return client.runConditional("POST", "/write", args, []byte(data), cond)
+}
+
+// MvIf moves the file or directory at path to newPath if the condition
+// holds for path.
+func (client *Client) MvIf(path string, newPath string, cond Condition) (string, error) {
+	args := map[string]string{"filepath": path, "newpath": newPath}
+	return client.runConditional("GET", "/mv", args, nil, cond)
+}
+
+// RmIf moves path to the trash if the condition holds.
+func (client *Client) RmIf(path string, recursive bool, cond Condition) (string, error) {
+	args := map[string]string{"filepath": path, "recursive": strconv.FormatBool(recursive)}
+	return client.runConditional("GET", "/rm", args, nil, cond)
+}
+
+// runConditional runs a command with the condition in its If-Match and
+// If-None-Match headers, and returns ErrPreconditionFailed if it didn't hold.
+func (client *Client) runConditional(method string, path string, args map[string]string, body []byte, cond Condition) (string, error) {
+	req := client.prepareRequest(method, path, body)
+	query := req.URL.Query()
+	for name, value := range args {
+		query.Add(name, value)
+	}
+	req.URL.RawQuery = query.Encode()
+	if cond.IfMatch != "" {
+		req.Header.Set("If-Match", cond.IfMatch)
+	}
+	if cond.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", cond.IfNoneMatch)
+	}
+	res, err := client.Client.Do(req)
+	if err != nil {
+		return "", errors.New("Failed to run command")
+	}
+	client.updateSessionId(res)
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return "", ErrPreconditionFailed
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		return "", errors.New("Failed to run command")
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,66 @@
+package sfs_client
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FindQuery selects remote entries by name, path, type, size, modification
+// time and tags. Name is a glob matched against entry names, Regex is
+// matched against paths relative to where the search starts and Type is "f"
+// or "d". Sizes are left out of the search when negative and times, in
+// seconds since the epoch, when zero. Tags are given as a key or as
+// key=value, and entries must have all of them.
+type FindQuery struct {
+	Name           string
+	Regex          string
+	Type           string
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  int64
+	ModifiedBefore int64
+	Tags           []string
+	Offset         int
+	Limit          int
+}
+
+// FindResult is one page of matches. Next is the offset of the following
+// page, or zero when this is the last one.
+type FindResult struct {
+	Entries []FileInfo `json:"entries"`
+	Next    int        `json:"next"`
+}
+
+// Find searches below the remote directory at path, or the current one if
+// path is empty, and returns the page of matches starting at query.Offset.
+// If the search can't be run the result is nil and the server's message is
+// returned instead.
+func (client *Client) Find(path string, query FindQuery) (*FindResult, string, error) {
+	args := map[string]string{
+		"filepath": path,
+		"name":     query.Name,
+		"regex":    query.Regex,
+		"type":     query.Type,
+		"offset":   strconv.Itoa(query.Offset),
+		"limit":    strconv.Itoa(query.Limit),
+		"tags":     strings.Join(query.Tags, ","),
+	}
+	if query.MinSize >= 0 {
+		args["minsize"] = strconv.FormatInt(query.MinSize, 10)
+	}
+	if query.MaxSize >= 0 {
+		args["maxsize"] = strconv.FormatInt(query.MaxSize, 10)
+	}
+	if query.ModifiedAfter > 0 {
+		args["newer"] = strconv.FormatInt(query.ModifiedAfter, 10)
+	}
+	if query.ModifiedBefore > 0 {
+		args["older"] = strconv.FormatInt(query.ModifiedBefore, 10)
+	}
+	result := &FindResult{}
+	output, err := client.getJSON("/find", args, result)
+	if err != nil || output != "" {
+		return nil, output, err
+	}
+	return result, "", nil
+}
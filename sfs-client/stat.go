@@ -0,0 +1,98 @@
+package sfs_client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// FileInfo describes a remote file or directory. Entries the user has no
+// access to keep their encrypted name and only show what the server sees on
+// disk. Times are in seconds since the epoch.
+type FileInfo struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	IsDir       bool     `json:"dir"`
+	Size        int64    `json:"size"`
+	Owner       string   `json:"owner"`
+	Group       string   `json:"group"`
+	Acl         []string `json:"acl"`
+	Created     int64    `json:"created"`
+	Modified    int64    `json:"modified"`
+	Checksum    string   `json:"checksum"`
+	Compression string   `json:"compression"`
+	ETag        string   `json:"etag"`
+	Encrypted   bool     `json:"encrypted"`
+	// Link is the target of links, empty for other entries.
+	Link string `json:"link"`
+}
+
+// ListOptions select and order the entries of a listing. Sort is "name",
+// "size" or "modified", and a Limit of zero lists everything from Offset on.
+// Tags leaves out the entries that don't have every tag, each given as a
+// key or as key=value.
+type ListOptions struct {
+	All       bool
+	Recursive bool
+	Sort      string
+	Reverse   bool
+	Offset    int
+	Limit     int
+	Tags      []string
+}
+
+// Listing is one page of a directory listing, with the number of entries on
+// all pages.
+type Listing struct {
+	Entries []FileInfo `json:"entries"`
+	Total   int        `json:"total"`
+}
+
+// List lists the remote directory at path, or the current one if path is
+// empty. If it can't be listed the listing is nil and the server's message
+// is returned instead.
+func (client *Client) List(path string, options ListOptions) (*Listing, string, error) {
+	args := map[string]string{
+		"filepath":  path,
+		"all":       strconv.FormatBool(options.All),
+		"recursive": strconv.FormatBool(options.Recursive),
+		"sort":      options.Sort,
+		"reverse":   strconv.FormatBool(options.Reverse),
+		"offset":    strconv.Itoa(options.Offset),
+		"limit":     strconv.Itoa(options.Limit),
+		"tags":      strings.Join(options.Tags, ","),
+	}
+	listing := &Listing{}
+	output, err := client.getJSON("/list", args, listing)
+	if err != nil || output != "" {
+		return nil, output, err
+	}
+	return listing, "", nil
+}
+
+// Stat describes the remote file or directory at path, including whether
+// its contents still match their checksum. If it can't be described the
+// info is nil and the server's message is returned instead.
+func (client *Client) Stat(path string) (*FileInfo, string, error) {
+	info := &FileInfo{}
+	output, err := client.getJSON("/stat", map[string]string{"filepath": path}, info)
+	if err != nil || output != "" {
+		return nil, output, err
+	}
+	return info, "", nil
+}
+
+// getJSON decodes the JSON the server answers with into value. Any other
+// answer is a message, which is returned.
+func (client *Client) getJSON(path string, args map[string]string, value interface{}) (string, error) {
+	res, err := client.get(path, args, nil)
+	if err != nil {
+		return "", errors.New("Failed to run command " + strings.TrimPrefix(path, "/"))
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return readBody(res)
+	}
+	defer res.Body.Close()
+	return "", json.NewDecoder(res.Body).Decode(value)
+}
@@ -0,0 +1,391 @@
+package sfs_client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyncStateFile is kept in the local directory of a sync. It holds the
+// checksum each file had the last time both sides agreed on it, which tells
+// a change made on one side apart from changes made on both.
+const SyncStateFile = ".sfs-sync"
+
+type syncState struct {
+	Remote string            `json:"remote"`
+	Files  map[string]string `json:"files"`
+}
+
+// Sync brings the local directory at localDir and the remote directory at
+// remoteDir up to date with each other. Files changed on one side since the
+// last sync are copied to the other, removals are passed on and files
+// changed on both sides keep the remote contents, while the local ones are
+// saved under a conflict name on both sides. Remote files that can no longer
+// be read aren't taken for removed. Only files are synced, directories are
+// created as needed. With dryRun nothing is changed and the steps that would
+// be taken are listed.
+func (client *Client) Sync(localDir string, remoteDir string, dryRun bool) (string, error) {
+	steps, output, err := client.sync(localDir, remoteDir, dryRun)
+	if err != nil || output != "" {
+		return output, err
+	}
+	if len(steps) == 0 {
+		return "Already in sync.", nil
+	}
+	if dryRun {
+		return "Dry run, nothing was changed. Sync would:\n" + strings.Join(steps, "\n"), nil
+	}
+	return strings.Join(steps, "\n"), nil
+}
+
+// sync runs a sync and returns the steps it took, or the server's message if
+// the remote directory can't be synced.
+func (client *Client) sync(localDir string, remoteDir string, dryRun bool) ([]string, string, error) {
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		return nil, localDir + " is not a directory.", nil
+	}
+	local, err := localChecksums(localDir)
+	if err != nil {
+		return nil, "", err
+	}
+	remote, output, err := client.remoteChecksums(remoteDir, dryRun)
+	if err != nil || remote == nil {
+		return nil, output, err
+	}
+	state, err := loadSyncState(localDir)
+	if err != nil {
+		return nil, "", err
+	}
+	if state.Remote != remoteDir {
+		state = syncState{Remote: remoteDir, Files: make(map[string]string)}
+	}
+	syncer := &syncer{client: client, localDir: localDir, remoteDir: remoteDir, dryRun: dryRun, state: state}
+	for _, relPath := range unionPaths(local, remote, state.Files) {
+		l, inLocal := local[relPath]
+		r, inRemote := remote[relPath]
+		base, inBase := state.Files[relPath]
+		switch {
+		case inLocal == inRemote && l == r:
+			syncer.agree(relPath, l, inLocal)
+		case inLocal == inBase && l == base:
+			// Only the remote side changed.
+			if inRemote {
+				syncer.download(relPath, r)
+			} else {
+				syncer.removeLocal(relPath)
+			}
+		case inRemote == inBase && r == base:
+			// Only the local side changed.
+			if inLocal {
+				syncer.upload(relPath, l)
+			} else {
+				syncer.removeRemote(relPath)
+			}
+		case !inLocal:
+			// Changed remotely and removed locally, the changes win.
+			syncer.download(relPath, r)
+		case !inRemote:
+			syncer.upload(relPath, l)
+		default:
+			syncer.conflict(relPath, l, r)
+		}
+		if syncer.err != nil {
+			break
+		}
+	}
+	if !dryRun {
+		if err := saveSyncState(localDir, syncer.state); err != nil && syncer.err == nil {
+			syncer.err = err
+		}
+	}
+	return syncer.steps, "", syncer.err
+}
+
+// syncer carries out the steps of a sync and keeps track of the state both
+// sides agree on after each of them.
+type syncer struct {
+	client     *Client
+	localDir   string
+	remoteDir  string
+	dryRun     bool
+	state      syncState
+	steps      []string
+	remoteDirs map[string]bool
+	err        error
+}
+
+func (s *syncer) agree(relPath string, checksum string, exists bool) {
+	if exists {
+		s.state.Files[relPath] = checksum
+	} else {
+		delete(s.state.Files, relPath)
+	}
+}
+
+func (s *syncer) upload(relPath string, checksum string) {
+	if s.step("upload "+relPath) && s.put(relPath, relPath) {
+		s.agree(relPath, checksum, true)
+	}
+}
+
+func (s *syncer) download(relPath string, checksum string) {
+	if s.step("download "+relPath) && s.fetch(relPath, relPath) {
+		s.agree(relPath, checksum, true)
+	}
+}
+
+func (s *syncer) removeLocal(relPath string) {
+	// Files the user may no longer read are left out of the remote tree as
+	// well, so only removals the server confirms are passed on.
+	removed, err := s.removedRemotely(relPath)
+	if err != nil {
+		s.err = err
+		return
+	}
+	if !removed {
+		s.steps = append(s.steps, "keep local "+relPath+", it can no longer be read remotely")
+		return
+	}
+	if !s.step("remove local " + relPath) {
+		return
+	}
+	if err := os.Remove(s.localPath(relPath)); err != nil && !os.IsNotExist(err) {
+		s.err = err
+		return
+	}
+	s.agree(relPath, "", false)
+}
+
+// removedRemotely tells whether the remote file at relPath is gone, rather
+// than hidden from the user.
+func (s *syncer) removedRemotely(relPath string) (bool, error) {
+	info, output, err := s.client.Stat(s.remotePath(relPath))
+	if err != nil {
+		return false, err
+	}
+	return info == nil && output == "No such file or directory.", nil
+}
+
+func (s *syncer) removeRemote(relPath string) {
+	if !s.step("remove remote " + relPath) {
+		return
+	}
+	output, err := s.client.Rm(s.remotePath(relPath), false)
+	if err != nil {
+		s.err = err
+		return
+	}
+	if output != "Moved to trash." {
+		s.fail(output)
+		return
+	}
+	s.agree(relPath, "", false)
+}
+
+// conflict keeps the remote contents under relPath and moves the local ones
+// to a conflict copy next to it, which is uploaded as well.
+func (s *syncer) conflict(relPath string, localChecksum string, remoteChecksum string) {
+	ext := path.Ext(relPath)
+	copyPath := strings.TrimSuffix(relPath, ext) + ".conflict-" + time.Now().Format("20060102-150405") + ext
+	if !s.step("conflict " + relPath + ", local copy kept as " + copyPath) {
+		return
+	}
+	if err := os.Rename(s.localPath(relPath), s.localPath(copyPath)); err != nil {
+		s.err = err
+		return
+	}
+	if s.fetch(relPath, relPath) {
+		s.agree(relPath, remoteChecksum, true)
+	}
+	if s.put(copyPath, copyPath) {
+		s.agree(copyPath, localChecksum, true)
+	}
+}
+
+// step records a step and tells whether it should be carried out.
+func (s *syncer) step(description string) bool {
+	s.steps = append(s.steps, description)
+	return !s.dryRun
+}
+
+func (s *syncer) fail(output string) {
+	s.steps = append(s.steps, "  failed: "+strings.TrimSpace(output))
+}
+
+func (s *syncer) put(localRelPath string, remoteRelPath string) bool {
+	s.makeRemoteDirs(path.Dir(remoteRelPath))
+	output, err := s.client.upload(s.localPath(localRelPath), s.remotePath(remoteRelPath), nil)
+	if err != nil {
+		s.err = err
+		return false
+	}
+	// Quota warnings follow after Done.
+	if !strings.HasPrefix(output, "Done.") {
+		s.fail(output)
+		return false
+	}
+	return true
+}
+
+func (s *syncer) fetch(remoteRelPath string, localRelPath string) bool {
+	localPath := s.localPath(localRelPath)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		s.err = err
+		return false
+	}
+	output, err := s.client.download(s.remotePath(remoteRelPath), localPath, nil)
+	if err != nil {
+		s.err = err
+		return false
+	}
+	if output != "Done." {
+		s.fail(output)
+		return false
+	}
+	return true
+}
+
+// makeRemoteDirs creates the remote directory at relDir and its parents,
+// once per sync. Directories that exist already are left as they are.
+func (s *syncer) makeRemoteDirs(relDir string) {
+	if relDir == "." || s.remoteDirs[relDir] {
+		return
+	}
+	s.makeRemoteDirs(path.Dir(relDir))
+	if s.remoteDirs == nil {
+		s.remoteDirs = make(map[string]bool)
+	}
+	s.remoteDirs[relDir] = true
+	s.client.Mkdir(s.remotePath(relDir))
+}
+
+func (s *syncer) localPath(relPath string) string {
+	return filepath.Join(s.localDir, filepath.FromSlash(relPath))
+}
+
+func (s *syncer) remotePath(relPath string) string {
+	return path.Join(s.remoteDir, relPath)
+}
+
+// remoteChecksums maps the paths of the files below remoteDir to the
+// checksums of their contents. A remote directory that doesn't exist yet is
+// created, unless it's a dry run.
+func (client *Client) remoteChecksums(remoteDir string, dryRun bool) (map[string]string, string, error) {
+	entries, output, err := client.Tree(remoteDir, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if entries == nil && !dryRun {
+		client.Mkdir(remoteDir)
+		entries, output, err = client.Tree(remoteDir, true)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if entries == nil {
+		return nil, output, nil
+	}
+	checksums := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.IsDir {
+			checksums[entry.Path] = entry.Checksum
+		}
+	}
+	return checksums, "", nil
+}
+
+// localChecksums maps the slash separated paths of the regular files below
+// localDir to the checksums of their contents, leaving out the sync state
+// and unfinished downloads.
+func localChecksums(localDir string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	err := filepath.Walk(localDir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || isSyncIgnored(info.Name()) {
+			return err
+		}
+		relPath, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		checksum, err := fileChecksum(localPath)
+		if err != nil {
+			return err
+		}
+		checksums[filepath.ToSlash(relPath)] = checksum
+		return nil
+	})
+	return checksums, err
+}
+
+// isSyncIgnored tells whether a local file with the given name belongs to
+// the sync itself rather than to the synced contents.
+func isSyncIgnored(name string) bool {
+	return name == SyncStateFile || strings.HasPrefix(name, ".") && strings.Contains(name, ".part-")
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func loadSyncState(localDir string) (syncState, error) {
+	state := syncState{Files: make(map[string]string)}
+	data, err := ioutil.ReadFile(filepath.Join(localDir, SyncStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]string)
+	}
+	return state, nil
+}
+
+func saveSyncState(localDir string, state syncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(localDir, SyncStateFile), data, 0644)
+}
+
+// unionPaths returns the paths found in any of the maps, sorted.
+func unionPaths(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	paths := make([]string, 0)
+	for _, m := range maps {
+		for p := range m {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
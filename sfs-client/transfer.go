@@ -0,0 +1,340 @@
+package sfs_client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is told how many of the total bytes of the file at path have
+// been transferred so far. total is negative while it isn't known.
+type Progress func(path string, done int64, total int64)
+
+func (progress Progress) report(path string, done int64, total int64) {
+	if progress != nil {
+		progress(path, done, total)
+	}
+}
+
+// TreeEntry is a remote file or directory, relative to the directory that
+// was listed.
+type TreeEntry struct {
+	Path     string `json:"path"`
+	IsDir    bool   `json:"dir"`
+	Checksum string `json:"sha256"`
+}
+
+// Put uploads the local file at localPath to remotePath, or with recursive a
+// whole directory. Files are sent as they are, so any data can be put.
+func (client *Client) Put(localPath string, remotePath string, recursive bool, progress Progress) (string, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return client.upload(localPath, remotePath, progress)
+	}
+	if !recursive {
+		return "Omitting directory, use put -r to upload directories.", nil
+	}
+	failed := make([]string, 0)
+	err = filepath.Walk(localPath, func(localFile string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(localPath, localFile)
+		if err != nil {
+			return err
+		}
+		remoteFile := path.Join(remotePath, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			// Directories that exist already are fine, anything else shows
+			// up when their files are uploaded.
+			_, err := client.Mkdir(remoteFile)
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			failed = append(failed, relPath+": not a regular file")
+			return nil
+		}
+		output, err := client.upload(localFile, remoteFile, progress)
+		if err != nil {
+			return err
+		}
+		// Quota warnings follow after Done.
+		if !strings.HasPrefix(output, "Done.") {
+			failed = append(failed, relPath+": "+output)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(failed) != 0 {
+		return "Uploaded, but some entries failed:\n" + strings.Join(failed, "\n"), nil
+	}
+	return "Done.", nil
+}
+
+// Get downloads the file at remotePath to localPath, or with recursive every
+// file below the directory at remotePath that the user may access. Cut off
+// downloads are picked up again where they stopped.
+func (client *Client) Get(remotePath string, localPath string, recursive bool, progress Progress) (string, error) {
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+	if !recursive {
+		return client.download(remotePath, localPath, progress)
+	}
+	entries, output, err := client.Tree(remotePath, false)
+	if err != nil {
+		return "", err
+	}
+	if entries == nil {
+		// Not a directory, so maybe a file.
+		return client.download(remotePath, localPath, progress)
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return "", err
+	}
+	failed := make([]string, 0)
+	for _, entry := range entries {
+		localFile := filepath.Join(localPath, filepath.FromSlash(entry.Path))
+		if entry.IsDir {
+			if err := os.MkdirAll(localFile, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		output, err = client.download(path.Join(remotePath, entry.Path), localFile, progress)
+		if err != nil {
+			return "", err
+		}
+		if output != "Done." {
+			failed = append(failed, entry.Path+": "+output)
+		}
+	}
+	if len(failed) != 0 {
+		return "Downloaded, but some entries failed:\n" + strings.Join(failed, "\n"), nil
+	}
+	return "Done.", nil
+}
+
+// Tree lists the files and directories below the remote directory at path,
+// with the SHA-256 of each file's contents if checksums is set. If path
+// can't be listed the entries are nil and the server's message is returned
+// instead.
+func (client *Client) Tree(path string, checksums bool) ([]TreeEntry, string, error) {
+	args := map[string]string{"filepath": path, "checksums": strconv.FormatBool(checksums)}
+	entries := make([]TreeEntry, 0)
+	output, err := client.getJSON("/tree", args, &entries)
+	if err != nil || output != "" {
+		return nil, output, err
+	}
+	return entries, "", nil
+}
+
+// Export downloads an archive of everything the user may read below the
+// remote directory at remotePath to localPath, as a tar archive or with zip
+// set a zip archive. With checksums the archive holds a SHA256SUMS manifest
+// of the checksums stored for the files in it. If localPath is a directory the archive is named
+// after the remote directory.
+func (client *Client) Export(remotePath string, localPath string, zip bool, checksums bool, progress Progress) (string, error) {
+	format := "tar"
+	if zip {
+		format = "zip"
+	}
+	args := map[string]string{"filepath": remotePath, "format": format, "checksums": strconv.FormatBool(checksums)}
+	res, err := client.get("/export", args, nil)
+	if err != nil {
+		return "", errors.New("Failed to run command export")
+	}
+	contentType := res.Header.Get("Content-Type")
+	if contentType != "application/x-tar" && contentType != "application/zip" {
+		return readBody(res)
+	}
+	defer res.Body.Close()
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+		if err != nil || params["filename"] == "" {
+			return "", errors.New("Export has no name")
+		}
+		localPath = filepath.Join(localPath, filepath.Base(params["filename"]))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+".part-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// The size of the archive isn't known until it is complete, and one cut
+	// off can't be resumed as it is made anew for every request.
+	progress.report(remotePath, 0, -1)
+	written, err := io.Copy(tmp, &progressReader{res.Body, remotePath, 0, -1, progress})
+	if err != nil {
+		return "", errors.New("Export was interrupted, please try again")
+	}
+	progress.report(remotePath, written, written)
+	if err := tmp.Chmod(0644); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), localPath); err != nil {
+		return "", err
+	}
+	return "Exported to " + localPath + ".", nil
+}
+
+// Import unpacks the local tar archive at localPath into the remote
+// directory at remotePath. mapping gives archive uids and gids to users and
+// groups, like uid:1000=alice,gid:100=staff. The server reports the entries
+// it couldn't import.
+func (client *Client) Import(localPath string, remotePath string, mapping string, progress Progress) (string, error) {
+	archive, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		return "", err
+	}
+	req := client.prepareRequest("POST", "/import", nil)
+	query := req.URL.Query()
+	query.Add("filepath", remotePath)
+	query.Add("map", mapping)
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Body = ioutil.NopCloser(&progressReader{archive, localPath, 0, info.Size(), progress})
+	req.ContentLength = info.Size()
+	req.GetBody = nil
+	res, err := client.Client.Do(req)
+	if err != nil {
+		return "", errors.New("Failed to run command import")
+	}
+	client.updateSessionId(res)
+	return readBody(res)
+}
+
+// download streams the remote file at remotePath into a temporary file next
+// to localPath, which replaces localPath once it is complete. A dropped
+// connection is retried with a range request for the rest of the file.
+func (client *Client) download(remotePath string, localPath string, progress Progress) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+".part-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	written, total := int64(0), int64(-1)
+	// validator tells the server which version of the file the part
+	// downloaded so far belongs to: its ETag, or its modification time
+	// from servers that don't send one.
+	validator := ""
+	for retries := 0; ; retries++ {
+		if retries > UploadRetries {
+			return "", errors.New("Download was interrupted, please try again")
+		}
+		if retries > 0 {
+			time.Sleep(UploadRetryDelay << uint(retries-1))
+		}
+		req := client.prepareRequest("GET", "/cat", nil)
+		query := req.URL.Query()
+		query.Add("filepath", remotePath)
+		req.URL.RawQuery = query.Encode()
+		if written > 0 {
+			// If the file changed in the meantime the whole file is sent.
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			req.Header.Set("If-Range", validator)
+		}
+		res, err := client.Client.Do(req)
+		if err != nil {
+			continue
+		}
+		client.updateSessionId(res)
+		switch res.StatusCode {
+		case http.StatusOK:
+			if res.Header.Get("Content-Type") != "application/octet-stream" {
+				return readBody(res)
+			}
+			if err := restart(tmp); err != nil {
+				res.Body.Close()
+				return "", err
+			}
+			written, total = 0, res.ContentLength
+			validator = res.Header.Get("ETag")
+			if validator == "" {
+				validator = res.Header.Get("Last-Modified")
+			}
+		case http.StatusPartialContent:
+			total = written + res.ContentLength
+		case http.StatusRequestedRangeNotSatisfiable:
+			total = written
+		default:
+			output, err := readBody(res)
+			if err != nil {
+				continue
+			}
+			return output, nil
+		}
+		if written < total || total < 0 {
+			progress.report(remotePath, written, total)
+			copied, err := io.Copy(tmp, &progressReader{res.Body, remotePath, written, total, progress})
+			res.Body.Close()
+			written += copied
+			if err != nil || (total >= 0 && written < total) {
+				continue
+			}
+		} else {
+			res.Body.Close()
+		}
+		progress.report(remotePath, written, written)
+		break
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), localPath); err != nil {
+		return "", err
+	}
+	return "Done.", nil
+}
+
+// restart empties file so a download can start over.
+func restart(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// progressReader reports the progress of a transfer as it is read.
+type progressReader struct {
+	reader   io.Reader
+	path     string
+	done     int64
+	total    int64
+	progress Progress
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.done += int64(n)
+	reader.progress.report(reader.path, reader.done, reader.total)
+	return n, err
+}
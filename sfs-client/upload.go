@@ -0,0 +1,153 @@
+package sfs_client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// UploadChunkSize is how much of a file is sent per request.
+	UploadChunkSize = 4 << 20
+	// UploadRetries is how often a chunk is retried before giving up.
+	UploadRetries = 5
+	// UploadRetryDelay is how long to wait before the first retry, it
+	// doubles with every further one.
+	UploadRetryDelay = time.Second
+)
+
+const (
+	UploadIdHeader     = "Upload-Id"
+	UploadOffsetHeader = "Upload-Offset"
+)
+
+// pendingUpload is an upload that was cut off, kept so that uploading the
+// same, unchanged file again picks up where it stopped.
+type pendingUpload struct {
+	id      string
+	size    int64
+	modTime time.Time
+}
+
+// Upload sends the local file at localPath to remotePath in chunks. A
+// dropped connection is retried from the offset the server reports, and an
+// upload that still failed is resumed by the next Upload of the same file.
+// The remote file only changes once every chunk has arrived.
+func (client *Client) Upload(localPath string, remotePath string) (string, error) {
+	return client.upload(localPath, remotePath, nil)
+}
+
+func (client *Client) upload(localPath string, remotePath string, progress Progress) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errors.New(localPath + " is a directory")
+	}
+	key := localPath + "\x00" + remotePath
+	pending, ok := client.uploads[key]
+	offset := int64(-1)
+	if ok && pending.size == info.Size() && pending.modTime.Equal(info.ModTime()) {
+		offset, _ = client.uploadOffset(pending.id)
+	}
+	if offset < 0 {
+		res, err := client.post("/upload/start", map[string]string{"filepath": remotePath, "length": strconv.FormatInt(info.Size(), 10)}, nil)
+		if err != nil {
+			return "", errors.New("Failed to run command upload")
+		}
+		output, err := readBody(res)
+		if err != nil {
+			return "", errors.New("Failed to run command upload")
+		}
+		if res.Header.Get(UploadIdHeader) == "" {
+			return output, nil
+		}
+		pending = pendingUpload{id: res.Header.Get(UploadIdHeader), size: info.Size(), modTime: info.ModTime()}
+		offset = 0
+	}
+	client.uploads[key] = pending
+	chunk := make([]byte, UploadChunkSize)
+	for retries := 0; ; {
+		progress.report(remotePath, offset, info.Size())
+		n, err := file.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		next, output, err := client.uploadChunk(pending.id, offset, chunk[:n])
+		switch {
+		case err == nil && (next < 0 || next >= info.Size()):
+			// Either every byte is in or the server turned the upload down.
+			delete(client.uploads, key)
+			if next >= 0 {
+				progress.report(remotePath, next, info.Size())
+			}
+			return output, nil
+		case err == nil && next != offset:
+			offset, retries = next, 0
+		case retries == UploadRetries:
+			return "", errors.New("Upload was interrupted, run it again to resume")
+		default:
+			time.Sleep(UploadRetryDelay << uint(retries))
+			retries++
+			if current, err := client.uploadOffset(pending.id); err == nil && current >= 0 {
+				offset = current
+			}
+		}
+	}
+}
+
+// uploadChunk sends data to the upload at offset and returns the offset the
+// server has reached afterwards, or holds if the chunk didn't start there. A
+// negative offset means the server sent a message instead, which is returned.
+func (client *Client) uploadChunk(id string, offset int64, data []byte) (int64, string, error) {
+	res, err := client.post("/upload/chunk", map[string]string{"uploadid": id, "offset": strconv.FormatInt(offset, 10)}, data)
+	if err != nil {
+		return 0, "", err
+	}
+	output, err := readBody(res)
+	if err != nil {
+		return 0, "", err
+	}
+	next, err := strconv.ParseInt(res.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil {
+		return -1, output, nil
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusConflict {
+		return -1, output, nil
+	}
+	return next, output, nil
+}
+
+// uploadOffset asks the server how much of an upload it holds, or returns a
+// negative offset when it doesn't know the upload.
+func (client *Client) uploadOffset(id string) (int64, error) {
+	res, err := client.get("/upload/status", map[string]string{"uploadid": id}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := readBody(res); err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseInt(res.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil {
+		return -1, nil
+	}
+	return offset, nil
+}
+
+func readBody(res *http.Response) (string, error) {
+	defer res.Body.Close()
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(res.Body)
+	return buf.String(), err
+}
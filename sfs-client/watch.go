@@ -0,0 +1,99 @@
+package sfs_client
+
+import (
+	"time"
+)
+
+const (
+	// SyncInterval is how often a watched sync checks for remote changes,
+	// which can't be watched for.
+	SyncInterval = 30 * time.Second
+	// syncDelay is how long a watched sync waits for local changes to settle
+	// before it runs.
+	syncDelay = time.Second
+)
+
+// Watcher keeps a local and a remote directory in sync until it is stopped.
+type Watcher struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Watch syncs localDir and remoteDir, and then again shortly after anything
+// changes in localDir and every SyncInterval to pick up remote changes.
+// report is called with the steps of every sync that changed something and
+// with any error.
+func (client *Client) Watch(localDir string, remoteDir string, report func(output string, err error)) (*Watcher, error) {
+	changes, err := watchLocal(localDir)
+	if err != nil {
+		return nil, err
+	}
+	watcher := &Watcher{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(watcher.done)
+		defer changes.Close()
+		ticker := time.NewTicker(SyncInterval)
+		defer ticker.Stop()
+		for {
+			output, err := client.Sync(localDir, remoteDir, false)
+			if err != nil || output != "Already in sync." {
+				report(output, err)
+			}
+			select {
+			case <-watcher.stop:
+				return
+			case <-ticker.C:
+			case <-changes.C:
+				if !settle(changes.C, watcher.stop) {
+					return
+				}
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// Stop ends the watch, waiting for a sync that is running to finish.
+func (watcher *Watcher) Stop() {
+	close(watcher.stop)
+	<-watcher.done
+}
+
+// settle waits until no change has come in for syncDelay. It returns false
+// if the watch was stopped meanwhile.
+func settle(changes <-chan struct{}, stop <-chan struct{}) bool {
+	timer := time.NewTimer(syncDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(syncDelay)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// localChanges signals changes below a local directory on C until closed.
+// Bursts of changes may be signalled only once.
+type localChanges struct {
+	C     chan struct{}
+	close func()
+}
+
+func (changes *localChanges) Close() {
+	changes.close()
+}
+
+// notify signals a change without blocking when one is pending already.
+func (changes *localChanges) notify() {
+	select {
+	case changes.C <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,72 @@
+package sfs_client
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// watchLocal watches localDir and every directory below it with inotify.
+// Directories created later are watched as they show up.
+func watchLocal(localDir string) (*localChanges, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	// A non-blocking file goes through the runtime poller, so closing it
+	// ends a pending read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	dirs := make(map[int32]string)
+	addWatches := func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return err
+			}
+			wd, err := syscall.InotifyAddWatch(fd, path, inotifyMask)
+			if err != nil {
+				return err
+			}
+			dirs[int32(wd)] = path
+			return nil
+		})
+	}
+	if err := addWatches(localDir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	changes := &localChanges{C: make(chan struct{}, 1), close: func() { file.Close() }}
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+			changed := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+				name := string(nameBytes)
+				for len(name) > 0 && name[len(name)-1] == 0 {
+					name = name[:len(name)-1]
+				}
+				if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					// Failing to watch a directory that is gone again is fine.
+					addWatches(filepath.Join(dirs[event.Wd], name))
+				}
+				if !isSyncIgnored(name) {
+					changed = true
+				}
+			}
+			if changed {
+				changes.notify()
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,66 @@
+//go:build !linux
+// +build !linux
+
+package sfs_client
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pollInterval is how often local directories are scanned for changes
+// where inotify isn't available.
+const pollInterval = 2 * time.Second
+
+// watchLocal scans localDir for changed sizes and modification times every
+// pollInterval.
+func watchLocal(localDir string) (*localChanges, error) {
+	last, err := scanLocal(localDir)
+	if err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	changes := &localChanges{C: make(chan struct{}, 1), close: func() { close(stop) }}
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			current, err := scanLocal(localDir)
+			if err != nil || len(current) != len(last) {
+				changes.notify()
+			} else {
+				for path, stamp := range current {
+					if last[path] != stamp {
+						changes.notify()
+						break
+					}
+				}
+			}
+			last = current
+		}
+	}()
+	return changes, nil
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func scanLocal(localDir string) (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || isSyncIgnored(info.Name()) {
+			return err
+		}
+		stamps[path] = fileStamp{info.Size(), info.ModTime()}
+		return nil
+	})
+	return stamps, err
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings are read from the environment once on start up, like PORT in the
+// server, and fall back to the defaults below when unset or malformed.
+var (
+	// How long removed entries stay in the trash before they are purged.
+	TrashRetention = Duration("SFS_TRASH_RETENTION", 30*24*time.Hour)
+	// How often the trash is checked for expired entries.
+	TrashPurgeInterval = Duration("SFS_TRASH_PURGE_INTERVAL", time.Hour)
+	// How many versions of a file are kept, the latest one included.
+	VersionRetentionCount = Int("SFS_VERSION_RETENTION_COUNT", 20)
+	// How long older versions of a file are kept, zero keeps them forever.
+	VersionRetention = Duration("SFS_VERSION_RETENTION", 0)
+	// How many bytes a single write request may upload.
+	MaxWriteBytes = Int64("SFS_MAX_WRITE_BYTES", 64<<20)
+	// How many bytes one user may be uploading at once, over all requests.
+	MaxUserUploadBytes = Int64("SFS_MAX_USER_UPLOAD_BYTES", 256<<20)
+	// How long an unfinished chunked upload is kept after its last chunk.
+	UploadExpiry = Duration("SFS_UPLOAD_EXPIRY", 24*time.Hour)
+	// How many bytes of files a user may own before writes warn, and before
+	// they are rejected, unless an admin set other limits. Zero is no limit.
+	UserQuotaSoft = Int64("SFS_USER_QUOTA_SOFT", 768<<20)
+	UserQuotaHard = Int64("SFS_USER_QUOTA_HARD", 1<<30)
+	// The users allowed to change quotas and delete other users, separated
+	// by commas.
+	Admins = List("SFS_ADMINS")
+	// Whether file contents are compressed before they are encrypted, unless
+	// users or directories choose otherwise.
+	Compression = Bool("SFS_COMPRESSION", true)
+	// How often every home directory is snapshotted, zero never does.
+	SnapshotInterval = Duration("SFS_SNAPSHOT_INTERVAL", 0)
+	// How many scheduled snapshots are kept per user.
+	SnapshotRetentionCount = Int("SFS_SNAPSHOT_RETENTION_COUNT", 7)
+	// How many snapshots a user may take themselves, on top of those.
+	SnapshotMaxCount = Int("SFS_SNAPSHOT_MAX_COUNT", 10)
+	// How long a lock is held unless the locking user asks otherwise, and
+	// the longest they may ask for.
+	LockTTL    = Duration("SFS_LOCK_TTL", 10*time.Minute)
+	LockMaxTTL = Duration("SFS_LOCK_MAX_TTL", 24*time.Hour)
+	// How many links are followed in a row before giving up, so links
+	// leading to each other aren't followed forever.
+	LinkMaxDepth = Int("SFS_LINK_MAX_DEPTH", 8)
+	// Whether stored files are overwritten with random data before they are
+	// removed for good. Only disks and file systems that write in place,
+	// unlike copy-on-write ones or SSDs, overwrite the old blocks.
+	ShredOverwrite = Bool("SFS_SHRED_OVERWRITE", false)
+)
+
+func Duration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, defaulting to %s", value, name, fallback)
+		return fallback
+	}
+	return duration
+}
+
+func Bool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean %q for %s, defaulting to %t", value, name, fallback)
+		return fallback
+	}
+	return enabled
+}
+
+func Int(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid number %q for %s, defaulting to %d", value, name, fallback)
+		return fallback
+	}
+	return number
+}
+
+func Int64(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid number %q for %s, defaulting to %d", value, name, fallback)
+		return fallback
+	}
+	return number
+}
+
+func List(name string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
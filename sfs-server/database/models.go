@@ -1,16 +1,34 @@
 package database
 
+import "database/sql"
+
+// Schema recreates the database, except for the data keys and chunks: the
+// files sealed with them stay on disk across restarts, and would be
+// unreadable without their keys, or lose chunks still listed in them.
 const Schema = `
 DROP TABLE IF EXISTS users;
 DROP TABLE IF EXISTS groups;
 DROP TABLE IF EXISTS group_memberships;
 DROP TABLE IF EXISTS file_permissions;
 DROP TABLE IF EXISTS check_sums;
+DROP TABLE IF EXISTS trash_items;
+DROP TABLE IF EXISTS file_versions;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS file_metadata;
+DROP TABLE IF EXISTS search_index;
+DROP TABLE IF EXISTS user_quotas;
+DROP TABLE IF EXISTS group_quotas;
+DROP TABLE IF EXISTS user_compression;
+DROP TABLE IF EXISTS dir_compression;
+DROP TABLE IF EXISTS snapshots;
+DROP TABLE IF EXISTS symlinks;
+DROP TABLE IF EXISTS file_tags;
 CREATE TABLE users
 (
     id       INTEGER PRIMARY KEY AUTOINCREMENT,
     password VARCHAR NOT NULL,
-    username VARCHAR NOT NULL
+    username VARCHAR NOT NULL,
+    used     INT     NOT NULL DEFAULT 0
 );
 
 CREATE TABLE groups
@@ -44,4 +62,238 @@ CREATE TABLE check_sums
     file_path VARCHAR PRIMARY KEY NOT NULL,
     check_sum VARCHAR
 );
+CREATE TABLE trash_items
+(
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id       INT     NOT NULL,
+    original_path VARCHAR NOT NULL,
+    trash_path    VARCHAR NOT NULL,
+    deleted_at    INT     NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE TABLE file_versions
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    file_path  VARCHAR NOT NULL,
+    version    INT     NOT NULL,
+    blob_hash  VARCHAR NOT NULL,
+    key_id     VARCHAR NOT NULL,
+    author_id  INT     NOT NULL,
+    owner_id   INT     NOT NULL,
+    created_at INT     NOT NULL,
+    size       INT     NOT NULL,
+    counted    INT     NOT NULL DEFAULT 0,
+    UNIQUE (file_path, version),
+    FOREIGN KEY (author_id) REFERENCES users (id),
+    FOREIGN KEY (owner_id) REFERENCES users (id)
+);
+-- The newest version holds what the file does, so only older versions count
+-- against the quota of the file's owner, with the size kept in counted.
+CREATE TRIGGER file_versions_superseded
+    AFTER INSERT
+    ON file_versions
+BEGIN
+    UPDATE file_versions
+    SET counted = size
+    WHERE file_path = NEW.file_path
+      AND version < NEW.version
+      AND counted != size;
+END;
+CREATE TRIGGER file_versions_counted
+    AFTER UPDATE OF counted
+    ON file_versions
+BEGIN
+    UPDATE users SET used = used - OLD.counted + NEW.counted WHERE id = NEW.owner_id;
+END;
+CREATE TRIGGER file_versions_removed
+    AFTER DELETE
+    ON file_versions
+BEGIN
+    UPDATE users SET used = used - OLD.counted WHERE id = OLD.owner_id;
+END;
+CREATE TABLE audit_log
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    INT     NOT NULL,
+    action     VARCHAR NOT NULL,
+    file_path  VARCHAR NOT NULL,
+    created_at INT     NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE TABLE file_metadata
+(
+    file_path  VARCHAR PRIMARY KEY NOT NULL,
+    owner_id   INT     NOT NULL,
+    created_at INT     NOT NULL,
+    size       INT     NOT NULL DEFAULT 0,
+    FOREIGN KEY (owner_id) REFERENCES users (id)
+);
+CREATE INDEX file_metadata_owner ON file_metadata (owner_id);
+-- Every change to the size or owner of a file is added to the usage of the
+-- users it concerns, rather than summing the sizes when quotas are checked.
+CREATE TRIGGER file_metadata_added
+    AFTER INSERT
+    ON file_metadata
+BEGIN
+    UPDATE users SET used = used + NEW.size WHERE id = NEW.owner_id;
+END;
+CREATE TRIGGER file_metadata_changed
+    AFTER UPDATE OF size, owner_id
+    ON file_metadata
+BEGIN
+    UPDATE users SET used = used - OLD.size WHERE id = OLD.owner_id;
+    UPDATE users SET used = used + NEW.size WHERE id = NEW.owner_id;
+END;
+CREATE TRIGGER file_metadata_removed
+    AFTER DELETE
+    ON file_metadata
+BEGIN
+    UPDATE users SET used = used - OLD.size WHERE id = OLD.owner_id;
+END;
+CREATE TABLE search_index
+(
+    file_path VARCHAR NOT NULL,
+    owner_id  INT     NOT NULL,
+    token     VARCHAR NOT NULL,
+    PRIMARY KEY (file_path, token),
+    FOREIGN KEY (owner_id) REFERENCES users (id)
+);
+CREATE INDEX search_index_token ON search_index (owner_id, token);
+CREATE TABLE user_quotas
+(
+    user_id INTEGER PRIMARY KEY NOT NULL,
+    soft    INT     NOT NULL,
+    hard    INT     NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE TABLE group_quotas
+(
+    group_id INTEGER PRIMARY KEY NOT NULL,
+    soft     INT     NOT NULL,
+    hard     INT     NOT NULL,
+    FOREIGN KEY (group_id) REFERENCES groups (id)
+);
+CREATE TABLE IF NOT EXISTS chunks
+(
+    id    VARCHAR PRIMARY KEY NOT NULL,
+    scope VARCHAR NOT NULL,
+    size  INT     NOT NULL,
+    refs  INT     NOT NULL
+);
+CREATE TABLE user_compression
+(
+    user_id INTEGER PRIMARY KEY NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE TABLE dir_compression
+(
+    file_path VARCHAR PRIMARY KEY NOT NULL,
+    enabled   BOOLEAN NOT NULL
+);
+CREATE TABLE snapshots
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    INT     NOT NULL,
+    name       VARCHAR NOT NULL,
+    path       VARCHAR NOT NULL,
+    created_at INT     NOT NULL,
+    UNIQUE (user_id, name),
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE TABLE symlinks
+(
+    file_path VARCHAR PRIMARY KEY NOT NULL,
+    target    VARCHAR NOT NULL
+);
+CREATE TABLE file_tags
+(
+    file_path VARCHAR NOT NULL,
+    tag_key   VARCHAR NOT NULL,
+    tag_value VARCHAR NOT NULL,
+    PRIMARY KEY (file_path, tag_key)
+);
+CREATE TABLE IF NOT EXISTS data_keys
+(
+    id       VARCHAR PRIMARY KEY NOT NULL,
+    data_key VARCHAR NOT NULL
+);
+CREATE TABLE IF NOT EXISTS file_keys
+(
+    file_path VARCHAR PRIMARY KEY NOT NULL,
+    key_id    VARCHAR NOT NULL,
+    FOREIGN KEY (key_id) REFERENCES data_keys (id)
+);
 `
+
+type TrashItem struct {
+	Id           int    `db:"id"`
+	OriginalPath string `db:"original_path"`
+	TrashPath    string `db:"trash_path"`
+	DeletedAt    int64  `db:"deleted_at"`
+}
+
+type FileVersion struct {
+	Id        int    `db:"id"`
+	FilePath  string `db:"file_path"`
+	Version   int    `db:"version"`
+	BlobHash  string `db:"blob_hash"`
+	Author    string `db:"author"`
+	CreatedAt int64  `db:"created_at"`
+	Size      int64  `db:"size"`
+}
+
+type FileMetadata struct {
+	Owner     string `db:"owner"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// Quota is the disk usage of a user or group, in bytes, with its limits.
+// Limits of zero don't apply.
+type Quota struct {
+	Name  string `db:"name"`
+	Group bool   `db:"is_group"`
+	Soft  int64  `db:"soft"`
+	Hard  int64  `db:"hard"`
+	Used  int64  `db:"used"`
+}
+
+// Chunk is a piece of deduplicated file contents, stored once per scope
+// however many files and versions refer to it. Size is the size it is stored
+// with, after compression.
+type Chunk struct {
+	Id    string `db:"id"`
+	Scope string `db:"scope"`
+	Size  int64  `db:"size"`
+}
+
+// Snapshot is a copy of a user's home directory, taken at CreatedAt and
+// kept at Path.
+type Snapshot struct {
+	Id        int    `db:"id"`
+	Name      string `db:"name"`
+	Path      string `db:"path"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// AclEntry is one row of a file's permissions, given either to a user or to
+// a group.
+type AclEntry struct {
+	User  sql.NullString `db:"username"`
+	Group sql.NullString `db:"group_name"`
+	Read  bool           `db:"read"`
+	Write bool           `db:"write"`
+}
+
+// Tag is a key and value attached to a path, both encrypted.
+type Tag struct {
+	Key   string `db:"tag_key"`
+	Value string `db:"tag_value"`
+}
+
+// DataKey is a key the contents of a file are sealed with, wrapped with the
+// server's key.
+type DataKey struct {
+	Id      string `db:"id"`
+	Wrapped string `db:"data_key"`
+}
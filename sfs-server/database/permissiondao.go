@@ -1,11 +1,13 @@
 package database
 
 import (
+	"database/sql"
 	"errors"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -21,7 +23,10 @@ type PermissionDao struct {
 }
 
 func NewPermissionDao() (*PermissionDao, error) {
-	db, err := sqlx.Connect(DriverName, DbName)
+	// Deleted rows are overwritten in the database file, so destroyed data
+	// keys don't linger in free pages. Rows replaced by INSERT OR REPLACE
+	// fire the delete triggers keeping usage up to date.
+	db, err := sqlx.Connect(DriverName, DbName+"?_secure_delete=on&_recursive_triggers=on")
 	if err != nil {
 		return nil, err
 	}
@@ -128,6 +133,11 @@ func (dao *PermissionDao) AddUserPermission(username string, path string) error
 	if err != nil {
 		return err
 	}
+	_, err = tx.Exec(AddFileMetadataQuery, absPath, time.Now().Unix(), username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	err = tx.Commit()
 	if err != nil {
 		return err
@@ -199,6 +209,47 @@ func (dao *PermissionDao) UpdateCheckSum(path string, checkSum string) error {
 	return nil
 }
 
+// ReplaceCheckSum stores the checksum of the contents replace puts in place
+// at path, committing only if replace succeeds.
+func (dao *PermissionDao) ReplaceCheckSum(path string, checkSum string, replace func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	_, err := tx.Exec(ReplaceCheckSum, path, checkSum)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := replace(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SwapCheckSum stores the checksum of the contents replace puts in place at
+// path, but only if the stored checksum is still oldCheckSum, and tells
+// whether it was. It commits only if replace succeeds.
+func (dao *PermissionDao) SwapCheckSum(path string, oldCheckSum string, checkSum string, replace func() error) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	result, err := tx.Exec(SwapCheckSum, checkSum, path, oldCheckSum)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if swapped, err := result.RowsAffected(); err != nil || swapped == 0 {
+		tx.Rollback()
+		return false, err
+	}
+	if err := replace(); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
 func (dao *PermissionDao) CheckUserPermission(username string, path string) (bool, error) {
 	dao.lock.Lock()
 	defer dao.lock.Unlock()
@@ -220,6 +271,59 @@ func (dao *PermissionDao) CheckUserPermission(username string, path string) (boo
 	return permission, nil
 }
 
+func (dao *PermissionDao) CheckUserReadPermission(username string, path string) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	permission := new(bool)
+	err := dao.db.Get(permission, CheckUserReadPermissionQuery, username, path)
+	if err != nil {
+		return false, err
+	}
+	return *permission, nil
+}
+
+func (dao *PermissionDao) CheckUserWritePermission(username string, path string) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	permission := new(bool)
+	err := dao.db.Get(permission, CheckUserWritePermissionQuery, username, path)
+	if err != nil {
+		return false, err
+	}
+	return *permission, nil
+}
+
+// AddCopiedEntry records a newly copied file or directory: the copying user
+// and their groups get access to it, and files get their checksum stored.
+func (dao *PermissionDao) AddCopiedEntry(username string, path string, checkSum string, isDir bool) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if err := addEntry(tx, username, path, checkSum, isDir); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddFile adds the permission and checksum rows of a new file owned by
+// username, committing only if create, which puts the file in place,
+// succeeds.
+func (dao *PermissionDao) AddFile(username string, path string, checkSum string, create func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if err := addEntry(tx, username, path, checkSum, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := create(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func (dao *PermissionDao) CheckUsersGroupPermission(username string, path string) (bool, error) {
 	dao.lock.Lock()
 	defer dao.lock.Unlock()
@@ -262,20 +366,822 @@ func (dao *PermissionDao) GetCheckSum(path string) (string, error) {
 	return result, nil
 }
 
-func (dao *PermissionDao) ChangeFilePath(oldPath string, newPath string) error {
+// ChangeFilePath moves the permission, checksum and version rows of oldPath
+// and everything below it to newPath. The rows are rewritten in one
+// transaction which is only committed if move, the matching change on disk,
+// succeeds.
+func (dao *PermissionDao) ChangeFilePath(oldPath string, newPath string, move func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if err := changeFilePath(tx, oldPath, newPath); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := move(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// TrashPath records path as removed by username and moves its rows, and
+// those of everything below it, to trashPath. Trashed files drop out of the
+// search index. As with ChangeFilePath the transaction is only committed if
+// move succeeds.
+func (dao *PermissionDao) TrashPath(username string, path string, trashPath string, deletedAt int64, move func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	_, err := tx.Exec(AddTrashItemQuery, path, trashPath, deletedAt, username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(RemoveFilePathSearchIndex, path); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := changeFilePath(tx, path, trashPath); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := move(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RestoreTrashItem moves the rows of a trashed entry back to its original
+// path and forgets the trash item, committing only if move succeeds.
+func (dao *PermissionDao) RestoreTrashItem(item TrashItem, move func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if err := changeFilePath(tx, item.TrashPath, item.OriginalPath); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err := tx.Exec(RemoveTrashItemQuery, item.Id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := move(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveTrashItem permanently deletes a trashed entry along with the rows of
+// everything below it, committing only if remove succeeds. Version blobs are
+// left for the caller to clean up.
+func (dao *PermissionDao) RemoveTrashItem(item TrashItem, remove func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	for _, query := range removeFilePathQueries {
+		if _, err := tx.Exec(query, item.TrashPath); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err := tx.Exec(RemoveTrashItemQuery, item.Id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := remove(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (dao *PermissionDao) GetTrashItems(username string) ([]TrashItem, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	items := make([]TrashItem, 0)
+	err := dao.db.Select(&items, GetTrashItemsQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (dao *PermissionDao) GetExpiredTrashItems(deletedBefore int64) ([]TrashItem, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	items := make([]TrashItem, 0)
+	err := dao.db.Select(&items, GetExpiredTrashItemsQuery, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (dao *PermissionDao) AddFileVersion(username string, path string, blobHash string, keyId string, createdAt int64, size int64) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	_, err := tx.Exec(AddFileVersionQuery, path, blobHash, keyId, createdAt, size, username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (dao *PermissionDao) GetFileVersions(path string) ([]FileVersion, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	versions := make([]FileVersion, 0)
+	err := dao.db.Select(&versions, GetFileVersionsQuery, path)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (dao *PermissionDao) GetFileVersion(path string, version int) (FileVersion, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	fileVersion := FileVersion{}
+	err := dao.db.Get(&fileVersion, GetFileVersionQuery, path, version)
+	return fileVersion, err
+}
+
+func (dao *PermissionDao) GetVersionedPaths() ([]string, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	paths := make([]string, 0)
+	err := dao.db.Select(&paths, GetVersionedPathsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func (dao *PermissionDao) GetBlobHashesUnderPath(path string) ([]string, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	hashes := make([]string, 0)
+	err := dao.db.Select(&hashes, GetBlobHashesUnderPathQuery, path)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func (dao *PermissionDao) RemoveFileVersion(id int) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	_, err := tx.Exec(RemoveFileVersionQuery, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (dao *PermissionDao) CountBlobReferences(blobHash string) (int, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	count := new(int)
+	err := dao.db.Get(count, CountBlobReferencesQuery, blobHash)
+	if err != nil {
+		return 0, err
+	}
+	return *count, nil
+}
+
+// GetFileMetadata returns the owner and creation time of path. Paths made
+// before they were recorded have none, and the returned error is
+// sql.ErrNoRows.
+func (dao *PermissionDao) GetFileMetadata(path string) (FileMetadata, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var metadata FileMetadata
+	err := dao.db.Get(&metadata, GetFileMetadataQuery, path)
+	return metadata, err
+}
+
+// GetFileAcl returns the permission rows of path, those of users first.
+func (dao *PermissionDao) GetFileAcl(path string) ([]AclEntry, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	acl := make([]AclEntry, 0)
+	err := dao.db.Select(&acl, GetFileAclQuery, path)
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (dao *PermissionDao) AddAuditEntry(username string, action string, path string, createdAt int64) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	_, err := tx.Exec(AddAuditEntryQuery, action, path, createdAt, username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IndexFile replaces the search tokens of path with tokens, which are kept
+// in the index of owner.
+func (dao *PermissionDao) IndexFile(path string, owner string, tokens []string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if _, err := tx.Exec(RemoveSearchTokensQuery, path); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, token := range tokens {
+		if _, err := tx.Exec(AddSearchTokenQuery, path, token, owner); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSearchOwners returns the users with a search index.
+func (dao *PermissionDao) GetSearchOwners() ([]string, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	owners := make([]string, 0)
+	err := dao.db.Select(&owners, GetSearchOwnersQuery)
+	if err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+// SearchIndex returns the paths in the index of owner that have every one
+// of tokens.
+func (dao *PermissionDao) SearchIndex(owner string, tokens []string) ([]string, error) {
+	paths := make([]string, 0)
+	if len(tokens) == 0 {
+		return paths, nil
+	}
+	query, args, err := sqlx.In(SearchIndexQuery, owner, tokens, len(tokens))
+	if err != nil {
+		return nil, err
+	}
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	if err := dao.db.Select(&paths, dao.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// SetFileSize records the size path takes up on disk, which counts against
+// the quotas of its owner.
+func (dao *PermissionDao) SetFileSize(path string, size int64) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	_, err := tx.Exec(SetFileSizeQuery, size, path)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddUsage adds size, which may be negative, to the usage of username for
+// what they store outside of files, like uploads in progress.
+func (dao *PermissionDao) AddUsage(username string, size int64) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	_, err := dao.db.Exec(AddUsageQuery, size, username)
+	return err
+}
+
+// GetQuotas returns the usage and limits of username, using defaultSoft and
+// defaultHard unless they have limits of their own, followed by those of
+// their groups that have limits.
+func (dao *PermissionDao) GetQuotas(username string, defaultSoft int64, defaultHard int64) ([]Quota, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	quotas := make([]Quota, 0)
+	err := dao.db.Select(&quotas, GetQuotasQuery, defaultSoft, defaultHard, username)
+	if err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+// SetQuota sets the limits of the user, or with isGroup the group, called
+// name. It returns false if there is no such user or group.
+func (dao *PermissionDao) SetQuota(name string, isGroup bool, soft int64, hard int64) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	query := SetUserQuotaQuery
+	if isGroup {
+		query = SetGroupQuotaQuery
+	}
+	tx := dao.db.MustBegin()
+	result, err := tx.Exec(query, soft, hard, name)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// RetainChunks adds a reference to each of chunks, which are recorded if
+// they are new.
+func (dao *PermissionDao) RetainChunks(chunks []Chunk) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	for _, chunk := range chunks {
+		if _, err := tx.Exec(RetainChunkQuery, chunk.Id, chunk.Scope, chunk.Size); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReleaseChunks drops a reference to each of the chunks with ids, and
+// forgets and returns the chunks nothing refers to any more. Their data is
+// left for the caller to remove.
+func (dao *PermissionDao) ReleaseChunks(ids []string) ([]Chunk, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	for _, id := range ids {
+		if _, err := tx.Exec(ReleaseChunkQuery, id); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	unreferenced := make([]Chunk, 0)
+	if err := tx.Select(&unreferenced, GetUnreferencedChunksQuery); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec(RemoveUnreferencedChunksQuery); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return unreferenced, tx.Commit()
+}
+
+// GetFirstGroup returns the first group username is in, or an empty string
+// if they are in none.
+func (dao *PermissionDao) GetFirstGroup(username string) (string, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	groups := make([]string, 0)
+	if err := dao.db.Select(&groups, GetFirstGroupQuery, username); err != nil {
+		return "", err
+	}
+	if len(groups) == 0 {
+		return "", nil
+	}
+	return groups[0], nil
+}
+
+// CheckGroup tells whether the group exists and whether username is in it.
+func (dao *PermissionDao) CheckGroup(username string, groupName string) (bool, bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var groups, memberships int
+	if err := dao.db.Get(&groups, CountGroupsQuery, groupName); err != nil {
+		return false, false, err
+	}
+	if err := dao.db.Get(&memberships, CountGroupMembershipsQuery, username, groupName); err != nil {
+		return false, false, err
+	}
+	return groups > 0, memberships > 0, nil
+}
+
+// SetGroupAccess gives the group read and write access to path as given,
+// taking away the access any group had to it before.
+func (dao *PermissionDao) SetGroupAccess(groupName string, path string, read bool, write bool) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if _, err := tx.Exec(RemoveGroupAccessQuery, path); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if read || write {
+		if _, err := tx.Exec(SetGroupAccessQuery, path, read, write, groupName); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCompression tells whether new contents of path, owned by owner, are to
+// be compressed, following the settings of path's directories, then those of
+// owner, then fallback.
+func (dao *PermissionDao) GetCompression(owner string, path string, fallback bool) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var enabled bool
+	err := dao.db.Get(&enabled, GetCompressionQuery, path, owner, fallback)
+	return enabled, err
+}
+
+// SetUserCompression sets whether the files of username are compressed, or
+// with a nil enabled removes their setting.
+func (dao *PermissionDao) SetUserCompression(username string, enabled *bool) error {
 	dao.lock.Lock()
 	defer dao.lock.Unlock()
-	_, err := dao.db.Exec(ChangeFilePathPermission, newPath, oldPath)
+	tx := dao.db.MustBegin()
+	var err error
+	if enabled == nil {
+		_, err = tx.Exec(RemoveUserCompressionQuery, username)
+	} else {
+		_, err = tx.Exec(SetUserCompressionQuery, *enabled, username)
+	}
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	_, err = dao.db.Exec(ChangeFilePathCheckSums, newPath, oldPath)
+	return tx.Commit()
+}
+
+// SetDirCompression sets whether files at or below the directory at path
+// are compressed, or with a nil enabled removes its setting.
+func (dao *PermissionDao) SetDirCompression(path string, enabled *bool) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	var err error
+	if enabled == nil {
+		_, err = tx.Exec(RemoveDirCompressionQuery, path)
+	} else {
+		_, err = tx.Exec(SetDirCompressionQuery, path, *enabled)
+	}
 	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddSnapshot records the snapshot called name of the home directory of
+// username, copying the rows of homePath to path, where the tree has been
+// copied to.
+func (dao *PermissionDao) AddSnapshot(username string, name string, homePath string, path string, createdAt int64) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if _, err := tx.Exec(AddSnapshotQuery, name, path, createdAt, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := copyFilePath(tx, homePath, path); err != nil {
+		tx.Rollback()
 		return err
 	}
+	return tx.Commit()
+}
+
+// GetSnapshots returns the snapshots of username, oldest first.
+func (dao *PermissionDao) GetSnapshots(username string) ([]Snapshot, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	snapshots := make([]Snapshot, 0)
+	err := dao.db.Select(&snapshots, GetSnapshotsQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// RemoveSnapshot forgets a snapshot along with the rows of everything in
+// it, committing only if remove succeeds.
+func (dao *PermissionDao) RemoveSnapshot(snapshot Snapshot, remove func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	for _, query := range removeFilePathQueries {
+		if _, err := tx.Exec(query, snapshot.Path); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(RemoveSnapshotQuery, snapshot.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := remove(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CopyFilePath copies the rows of srcPath, and of the paths below it, to
+// dstPath.
+func (dao *PermissionDao) CopyFilePath(srcPath string, dstPath string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if err := copyFilePath(tx, srcPath, dstPath); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUsernames returns the names of every user.
+func (dao *PermissionDao) GetUsernames() ([]string, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	usernames := make([]string, 0)
+	if err := dao.db.Select(&usernames, GetUsernamesQuery); err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+// AddLink records a new link at path to target, owned by username like any
+// other file, with the checksum of the empty file standing in for it.
+func (dao *PermissionDao) AddLink(username string, path string, checkSum string, target string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	if err := addEntry(tx, username, path, checkSum, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(SetSymlinkQuery, path, target); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetLink makes the file at path a link to target.
+func (dao *PermissionDao) SetLink(path string, target string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	_, err := dao.db.Exec(SetSymlinkQuery, path, target)
+	return err
+}
+
+// GetLink returns the target of the link at path, and whether path is a
+// link at all.
+func (dao *PermissionDao) GetLink(path string) (string, bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var target string
+	err := dao.db.Get(&target, GetSymlinkQuery, path)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
+// SetTag sets the tag key of path to value, replacing any value it had.
+func (dao *PermissionDao) SetTag(path string, key string, value string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	_, err := dao.db.Exec(SetTagQuery, path, key, value)
+	return err
+}
+
+// GetTags returns the tags of path.
+func (dao *PermissionDao) GetTags(path string) ([]Tag, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tags := make([]Tag, 0)
+	if err := dao.db.Select(&tags, GetTagsQuery, path); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// RemoveTag removes the tag key of path, and returns whether it had one.
+func (dao *PermissionDao) RemoveTag(path string, key string) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	result, err := dao.db.Exec(RemoveTagQuery, path, key)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// CopyTags gives dstPath the tags of srcPath.
+func (dao *PermissionDao) CopyTags(srcPath string, dstPath string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	_, err := dao.db.Exec(CopyTagsQuery, dstPath, srcPath)
+	return err
+}
+
+// FindFileKey returns the data key of path, and whether it has one.
+func (dao *PermissionDao) FindFileKey(path string) (DataKey, bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var stored DataKey
+	err := dao.db.Get(&stored, GetFileKeyQuery, path)
+	if err == sql.ErrNoRows {
+		return stored, false, nil
+	}
+	if err != nil {
+		return stored, false, err
+	}
+	return stored, true, nil
+}
+
+// GetFileKey returns the data key of path, first giving it key if it has
+// none yet.
+func (dao *PermissionDao) GetFileKey(path string, key DataKey) (DataKey, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var stored DataKey
+	err := dao.db.Get(&stored, GetFileKeyQuery, path)
+	if err != sql.ErrNoRows {
+		return stored, err
+	}
+	tx := dao.db.MustBegin()
+	if _, err := tx.Exec(AddDataKeyQuery, key.Id, key.Wrapped); err != nil {
+		tx.Rollback()
+		return key, err
+	}
+	if _, err := tx.Exec(AddFileKeyQuery, path, key.Id); err != nil {
+		tx.Rollback()
+		return key, err
+	}
+	return key, tx.Commit()
+}
+
+// GetDataKey returns the wrapped data key named id, and whether it still
+// exists.
+func (dao *PermissionDao) GetDataKey(id string) (string, bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var wrapped string
+	err := dao.db.Get(&wrapped, GetDataKeyQuery, id)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return wrapped, true, nil
+}
+
+// RemoveFileKeys forgets which keys path, and the paths below it, are sealed
+// with, for files that were removed without their other rows.
+func (dao *PermissionDao) RemoveFileKeys(path string) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	_, err := dao.db.Exec(RemoveFilePathKeys, path)
+	return err
+}
+
+// RemoveUnusedDataKeys destroys the data keys nothing is sealed with any
+// more.
+func (dao *PermissionDao) RemoveUnusedDataKeys() error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	_, err := dao.db.Exec(RemoveUnusedDataKeysQuery)
+	return err
+}
+
+// GetOwnedPaths returns the paths of every file and directory username
+// owns, wherever they are.
+func (dao *PermissionDao) GetOwnedPaths(username string) ([]string, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	paths := make([]string, 0)
+	if err := dao.db.Select(&paths, GetOwnedPathsQuery, username); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// CheckOthersOwnBelow tells whether users other than username own path or
+// anything below it.
+func (dao *PermissionDao) CheckOthersOwnBelow(username string, path string) (bool, error) {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	var count int
+	err := dao.db.Get(&count, CountOtherOwnersBelowQuery, path, username)
+	return count > 0, err
+}
+
+// DeleteUser removes username along with the rows of every path in paths,
+// and of the paths below them, committing only if remove succeeds. Version
+// blobs and data keys are left for the caller to clean up.
+func (dao *PermissionDao) DeleteUser(username string, paths []string, remove func() error) error {
+	dao.lock.Lock()
+	defer dao.lock.Unlock()
+	tx := dao.db.MustBegin()
+	for _, path := range paths {
+		for _, query := range removeFilePathQueries {
+			if _, err := tx.Exec(query, path); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	userQueries := []string{RemoveUserPermissionsQuery, RemoveUserMembershipsQuery, RemoveUserTrashItemsQuery,
+		RemoveUserSnapshotsQuery, RemoveUserQuotaQuery, RemoveUserCompressionQuery, RemoveUserSearchTokensQuery,
+		RemoveUserQuery}
+	for _, query := range userQueries {
+		if _, err := tx.Exec(query, username); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := remove(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Every table keyed by file path has its rows moved along with the path, and
+// removed with it, by these queries. Copies of a path only take the rows
+// describing its entries along, they are sealed with keys of their own.
+var (
+	copyFilePathQueries   = []string{CopyFilePathPermissions, CopyFilePathCheckSums, CopyFilePathMetadata, CopyFilePathSymlinks, CopyFilePathTags}
+	changeFilePathQueries = []string{ChangeFilePathPermission, ChangeFilePathCheckSums, ChangeFilePathVersions, ChangeFilePathMetadata, ChangeFilePathSearchIndex, ChangeFilePathCompression, ChangeFilePathSymlinks, ChangeFilePathTags, ChangeFilePathKeys}
+	removeFilePathQueries = []string{RemoveFilePathPermissions, RemoveFilePathCheckSums, RemoveFilePathVersions, RemoveFilePathMetadata, RemoveFilePathSearchIndex, RemoveFilePathCompression, RemoveFilePathSymlinks, RemoveFilePathTags, RemoveFilePathKeys}
+)
+
+// ErrPathTaken is returned when rows would be moved onto a path that still
+// has rows of its own, which would otherwise be lost.
+var ErrPathTaken = errors.New("Destination path is already in use.")
+
+// changeFilePath rewrites every row keyed by oldPath, or a path below it,
+// to newPath within tx. Rows already keyed by newPath, or a path below it,
+// are never replaced, ErrPathTaken is returned instead.
+func changeFilePath(tx *sqlx.Tx, oldPath string, newPath string) error {
+	var count int
+	if err := tx.Get(&count, CountFilePathRowsQuery, newPath); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrPathTaken
+	}
+	for _, query := range changeFilePathQueries {
+		if _, err := tx.Exec(query, newPath, oldPath); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// copyFilePath copies the rows describing srcPath, or a path below it, to
+// dstPath within tx.
+func copyFilePath(tx *sqlx.Tx, srcPath string, dstPath string) error {
+	for _, query := range copyFilePathQueries {
+		if _, err := tx.Exec(query, dstPath, srcPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addEntry gives username and their groups access to path and stores its
+// checksum unless it is a directory.
+func addEntry(tx *sqlx.Tx, username string, path string, checkSum string, isDir bool) error {
+	if _, err := tx.Exec(AddUserPermissionsQuery, path, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(AddPermissionForAllUsersGroups, path, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(AddFileMetadataQuery, path, time.Now().Unix(), username); err != nil {
+		return err
+	}
+	if isDir {
+		return nil
+	}
+	_, err := tx.Exec(ReplaceCheckSum, path, checkSum)
+	return err
+}
+
 func init() {
 	var err error
 	Dao, err = NewPermissionDao()
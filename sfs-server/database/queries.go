@@ -76,6 +76,17 @@ const GetCheckSum = `
 	where file_path = ?
 `
 
+const ReplaceCheckSum = `
+	INSERT OR REPLACE INTO check_sums (file_path, check_sum) VALUES (?, ?)
+`
+
+const SwapCheckSum = `
+	UPDATE check_sums
+	SET check_sum = $1
+	WHERE file_path = $2
+	  AND check_sum = $3
+`
+
 const UpdateCheckSum = `
 	UPDATE check_sums
 	SET check_sum = ?
@@ -97,6 +108,58 @@ SELECT CASE
            END;
 `
 
+const CheckUserReadPermissionQuery = `
+SELECT CASE
+           WHEN
+                   EXISTS(
+                           select u.id
+                           from users u
+                                    join file_permissions fp on u.id = fp.user_id
+                           where u.username = $1
+                             and fp.file_path = $2
+                             and fp.read
+                       )
+                   OR
+                   EXISTS(
+                           select u.id
+                           from users u
+                                    join group_memberships gm on u.id = gm.user_id
+                                    join file_permissions fp on gm.group_id = fp.group_id
+                           where u.username = $1
+                             and fp.file_path = $2
+                             and fp.read
+                       )
+               THEN 'TRUE'
+           ELSE 'FALSE'
+           END;
+`
+
+const CheckUserWritePermissionQuery = `
+SELECT CASE
+           WHEN
+                   EXISTS(
+                           select u.id
+                           from users u
+                                    join file_permissions fp on u.id = fp.user_id
+                           where u.username = $1
+                             and fp.file_path = $2
+                             and fp.write
+                       )
+                   OR
+                   EXISTS(
+                           select u.id
+                           from users u
+                                    join group_memberships gm on u.id = gm.user_id
+                                    join file_permissions fp on gm.group_id = fp.group_id
+                           where u.username = $1
+                             and fp.file_path = $2
+                             and fp.write
+                       )
+               THEN 'TRUE'
+           ELSE 'FALSE'
+           END;
+`
+
 const CheckUserGroupsPermissionQuery = `
 SELECT CASE
            WHEN
@@ -127,14 +190,690 @@ SELECT CASE
            END;
 `
 
+const CountFilePathRowsQuery = `
+SELECT COUNT(*)
+FROM (SELECT file_path
+      FROM file_permissions
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM check_sums
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM file_versions
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM file_metadata
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM search_index
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM dir_compression
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM symlinks
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM file_tags
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/'
+      UNION ALL
+      SELECT file_path
+      FROM file_keys
+      WHERE file_path = $1
+         OR substr(file_path, 1, length($1) + 1) = $1 || '/');
+`
+
 const ChangeFilePathPermission = `
 UPDATE file_permissions
-SET file_path = ?
-WHERE file_path = ?;
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
 `
 
 const ChangeFilePathCheckSums = `
 UPDATE check_sums
-SET file_path = ?
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const ChangeFilePathVersions = `
+UPDATE file_versions
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const ChangeFilePathMetadata = `
+UPDATE file_metadata
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const ChangeFilePathSearchIndex = `
+UPDATE search_index
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const RemoveFilePathPermissions = `
+DELETE
+FROM file_permissions
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const RemoveFilePathCheckSums = `
+DELETE
+FROM check_sums
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const RemoveFilePathVersions = `
+DELETE
+FROM file_versions
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const RemoveFilePathMetadata = `
+DELETE
+FROM file_metadata
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const ChangeFilePathCompression = `
+UPDATE dir_compression
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const RemoveFilePathCompression = `
+DELETE
+FROM dir_compression
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+// Copies of a path keep its permissions, checksums and metadata. Copied
+// files keep their size too, so they count against quotas right away.
+const CopyFilePathPermissions = `
+INSERT OR REPLACE
+INTO file_permissions (file_path, user_id, group_id, read, write)
+SELECT $1 || substr(file_path, length($2) + 1), user_id, group_id, read, write
+FROM file_permissions
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const CopyFilePathCheckSums = `
+INSERT OR REPLACE
+INTO check_sums (file_path, check_sum)
+SELECT $1 || substr(file_path, length($2) + 1), check_sum
+FROM check_sums
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const CopyFilePathMetadata = `
+INSERT OR REPLACE
+INTO file_metadata (file_path, owner_id, created_at, size)
+SELECT $1 || substr(file_path, length($2) + 1), owner_id, created_at, size
+FROM file_metadata
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const RemoveFilePathSearchIndex = `
+DELETE
+FROM search_index
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const AddFileMetadataQuery = `
+INSERT OR REPLACE
+INTO file_metadata (file_path, owner_id, created_at)
+select ?, id, ?
+from users
+where username = ?;
+`
+
+const GetFileMetadataQuery = `
+SELECT u.username AS owner, fm.created_at
+FROM file_metadata fm
+         JOIN users u on fm.owner_id = u.id
+WHERE fm.file_path = ?;
+`
+
+// Rows with a group grant that group access, even where they also name the
+// user the grant was copied from.
+const GetFileAclQuery = `
+SELECT DISTINCT CASE WHEN fp.group_id IS NULL THEN u.username END AS username, g.group_name, fp.read, fp.write
+FROM file_permissions fp
+         LEFT JOIN users u on fp.user_id = u.id
+         LEFT JOIN groups g on fp.group_id = g.id
+WHERE fp.file_path = ?
+ORDER BY fp.group_id IS NOT NULL, username, g.group_name;
+`
+
+const AddTrashItemQuery = `
+INSERT INTO trash_items (user_id, original_path, trash_path, deleted_at)
+SELECT id, ?, ?, ?
+FROM users
+WHERE username = ?;
+`
+
+const GetTrashItemsQuery = `
+SELECT t.id, t.original_path, t.trash_path, t.deleted_at
+FROM trash_items t
+         JOIN users u on t.user_id = u.id
+WHERE u.username = ?
+ORDER BY t.deleted_at DESC, t.id DESC;
+`
+
+const GetExpiredTrashItemsQuery = `
+SELECT id, original_path, trash_path, deleted_at
+FROM trash_items
+WHERE deleted_at < ?;
+`
+
+const RemoveTrashItemQuery = `
+DELETE
+FROM trash_items
+WHERE id = ?;
+`
+
+const AddFileVersionQuery = `
+INSERT INTO file_versions (file_path, version, blob_hash, key_id, author_id, owner_id, created_at, size)
+SELECT $1,
+       COALESCE((SELECT MAX(version) FROM file_versions WHERE file_path = $1), 0) + 1,
+       $2,
+       $3,
+       u.id,
+       COALESCE((SELECT owner_id FROM file_metadata WHERE file_path = $1), u.id),
+       $4,
+       $5
+FROM users u
+WHERE u.username = $6;
+`
+
+const GetFileVersionsQuery = `
+SELECT fv.id, fv.file_path, fv.version, fv.blob_hash, COALESCE(u.username, '') AS author, fv.created_at, fv.size
+FROM file_versions fv
+         LEFT JOIN users u on fv.author_id = u.id
+WHERE fv.file_path = ?
+ORDER BY fv.version DESC;
+`
+
+const GetFileVersionQuery = `
+SELECT fv.id, fv.file_path, fv.version, fv.blob_hash, COALESCE(u.username, '') AS author, fv.created_at, fv.size
+FROM file_versions fv
+         LEFT JOIN users u on fv.author_id = u.id
+WHERE fv.file_path = ?
+  AND fv.version = ?;
+`
+
+const GetVersionedPathsQuery = `
+SELECT DISTINCT file_path
+FROM file_versions;
+`
+
+const GetBlobHashesUnderPathQuery = `
+SELECT DISTINCT blob_hash
+FROM file_versions
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const RemoveFileVersionQuery = `
+DELETE
+FROM file_versions
+WHERE id = ?;
+`
+
+const CountBlobReferencesQuery = `
+SELECT COUNT(*)
+FROM file_versions
+WHERE blob_hash = ?;
+`
+
+const AddAuditEntryQuery = `
+INSERT INTO audit_log (user_id, action, file_path, created_at)
+SELECT id, ?, ?, ?
+FROM users
+WHERE username = ?;
+`
+
+const RemoveSearchTokensQuery = `
+DELETE
+FROM search_index
+WHERE file_path = ?;
+`
+
+const AddSearchTokenQuery = `
+INSERT OR IGNORE
+INTO search_index (file_path, owner_id, token)
+SELECT ?, id, ?
+FROM users
+WHERE username = ?;
+`
+
+const GetSearchOwnersQuery = `
+SELECT DISTINCT u.username
+FROM search_index si
+         JOIN users u on si.owner_id = u.id;
+`
+
+// Expanded with sqlx.In, the tokens fill the IN list and the last argument
+// is how many of them a path needs to match.
+const SearchIndexQuery = `
+SELECT si.file_path
+FROM search_index si
+         JOIN users u on si.owner_id = u.id
+WHERE u.username = ?
+  AND si.token IN (?)
+GROUP BY si.file_path
+HAVING COUNT(*) = ?
+ORDER BY si.file_path;
+`
+
+const SetFileSizeQuery = `
+UPDATE file_metadata
+SET size = ?
+WHERE file_path = ?;
+`
+
+// A user's own limits come first, falling back to the defaults given as the
+// first two arguments, followed by the limits of the groups they are in.
+// Files count against the user owning them and every group of that user.
+// Usage is kept up to date in users.used by the triggers of the schema.
+const GetQuotasQuery = `
+SELECT u.username                                                               AS name,
+       FALSE                                                                    AS is_group,
+       COALESCE(q.soft, $1)                                                     AS soft,
+       COALESCE(q.hard, $2)                                                     AS hard,
+       u.used                                                                   AS used
+FROM users u
+         LEFT JOIN user_quotas q on q.user_id = u.id
+WHERE u.username = $3
+UNION ALL
+SELECT g.group_name,
+       TRUE,
+       q.soft,
+       q.hard,
+       (SELECT COALESCE(SUM(mu.used), 0)
+        FROM group_memberships m
+                 JOIN users mu on mu.id = m.user_id
+        WHERE m.group_id = g.id)
+FROM users u
+         JOIN group_memberships gm on gm.user_id = u.id
+         JOIN groups g on g.id = gm.group_id
+         JOIN group_quotas q on q.group_id = g.id
+WHERE u.username = $3;
+`
+
+const AddUsageQuery = `
+UPDATE users
+SET used = used + ?
+WHERE username = ?;
+`
+
+const SetUserQuotaQuery = `
+INSERT OR REPLACE
+INTO user_quotas (user_id, soft, hard)
+SELECT id, ?, ?
+FROM users
+WHERE username = ?;
+`
+
+const SetGroupQuotaQuery = `
+INSERT OR REPLACE
+INTO group_quotas (group_id, soft, hard)
+SELECT id, ?, ?
+FROM groups
+WHERE group_name = ?;
+`
+
+const RetainChunkQuery = `
+INSERT INTO chunks (id, scope, size, refs)
+VALUES (?, ?, ?, 1)
+ON CONFLICT (id) DO UPDATE SET refs = refs + 1;
+`
+
+const ReleaseChunkQuery = `
+UPDATE chunks
+SET refs = refs - 1
+WHERE id = ?;
+`
+
+const GetUnreferencedChunksQuery = `
+SELECT id, scope, size
+FROM chunks
+WHERE refs <= 0;
+`
+
+const RemoveUnreferencedChunksQuery = `
+DELETE
+FROM chunks
+WHERE refs <= 0;
+`
+
+const GetFirstGroupQuery = `
+SELECT g.group_name
+FROM groups g
+         JOIN group_memberships gm on g.id = gm.group_id
+         JOIN users u on gm.user_id = u.id
+WHERE u.username = ?
+ORDER BY g.id
+LIMIT 1;
+`
+
+// The setting of the closest directory at or above the path wins over the
+// owner's own, which wins over the default given as the last argument.
+const GetCompressionQuery = `
+SELECT COALESCE(
+               (SELECT enabled
+                FROM dir_compression
+                WHERE $1 = file_path
+                   OR substr($1, 1, length(file_path) + 1) = file_path || '/'
+                ORDER BY length(file_path) DESC
+                LIMIT 1),
+               (SELECT uc.enabled
+                FROM user_compression uc
+                         JOIN users u on uc.user_id = u.id
+                WHERE u.username = $2),
+               $3);
+`
+
+const SetUserCompressionQuery = `
+INSERT OR REPLACE
+INTO user_compression (user_id, enabled)
+SELECT id, ?
+FROM users
+WHERE username = ?;
+`
+
+const RemoveUserCompressionQuery = `
+DELETE
+FROM user_compression
+WHERE user_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const SetDirCompressionQuery = `
+INSERT OR REPLACE
+INTO dir_compression (file_path, enabled)
+VALUES (?, ?);
+`
+
+const RemoveDirCompressionQuery = `
+DELETE
+FROM dir_compression
 WHERE file_path = ?;
 `
+
+const AddSnapshotQuery = `
+INSERT INTO snapshots (user_id, name, path, created_at)
+SELECT id, ?, ?, ?
+FROM users
+WHERE username = ?;
+`
+
+const GetSnapshotsQuery = `
+SELECT s.id, s.name, s.path, s.created_at
+FROM snapshots s
+         JOIN users u on s.user_id = u.id
+WHERE u.username = ?
+ORDER BY s.created_at, s.id;
+`
+
+const RemoveSnapshotQuery = `
+DELETE
+FROM snapshots
+WHERE id = ?;
+`
+
+const GetUsernamesQuery = `
+SELECT username
+FROM users
+ORDER BY id;
+`
+
+const CountGroupsQuery = `
+SELECT COUNT(*)
+FROM groups
+WHERE group_name = ?;
+`
+
+const CountGroupMembershipsQuery = `
+SELECT COUNT(*)
+FROM group_memberships gm
+         JOIN groups g on gm.group_id = g.id
+         JOIN users u on gm.user_id = u.id
+WHERE u.username = $1
+  AND g.group_name = $2;
+`
+
+const RemoveGroupAccessQuery = `
+DELETE
+FROM file_permissions
+WHERE file_path = ?
+  AND group_id IS NOT NULL;
+`
+
+const SetGroupAccessQuery = `
+INSERT
+INTO file_permissions (file_path, group_id, read, write)
+select $1, g.id, $2, $3
+from groups g
+where g.group_name = $4;
+`
+
+const SetSymlinkQuery = `
+INSERT OR REPLACE INTO symlinks (file_path, target) VALUES (?, ?);
+`
+
+const GetSymlinkQuery = `
+SELECT target
+FROM symlinks
+WHERE file_path = ?;
+`
+
+const ChangeFilePathSymlinks = `
+UPDATE symlinks
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const RemoveFilePathSymlinks = `
+DELETE
+FROM symlinks
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const CopyFilePathSymlinks = `
+INSERT OR REPLACE
+INTO symlinks (file_path, target)
+SELECT $1 || substr(file_path, length($2) + 1), target
+FROM symlinks
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const SetTagQuery = `
+INSERT OR REPLACE INTO file_tags (file_path, tag_key, tag_value) VALUES (?, ?, ?);
+`
+
+const GetTagsQuery = `
+SELECT tag_key, tag_value
+FROM file_tags
+WHERE file_path = ?;
+`
+
+const RemoveTagQuery = `
+DELETE
+FROM file_tags
+WHERE file_path = $1
+  AND tag_key = $2;
+`
+
+// Unlike the queries for whole paths, copying the tags of an entry leaves
+// those of the entries below it, which are copied one by one.
+const CopyTagsQuery = `
+INSERT OR REPLACE
+INTO file_tags (file_path, tag_key, tag_value)
+SELECT $1, tag_key, tag_value
+FROM file_tags
+WHERE file_path = $2;
+`
+
+const ChangeFilePathTags = `
+UPDATE file_tags
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const RemoveFilePathTags = `
+DELETE
+FROM file_tags
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const CopyFilePathTags = `
+INSERT OR REPLACE
+INTO file_tags (file_path, tag_key, tag_value)
+SELECT $1 || substr(file_path, length($2) + 1), tag_key, tag_value
+FROM file_tags
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const GetFileKeyQuery = `
+SELECT dk.id, dk.data_key
+FROM file_keys fk
+         JOIN data_keys dk on fk.key_id = dk.id
+WHERE fk.file_path = ?;
+`
+
+const GetDataKeyQuery = `
+SELECT data_key
+FROM data_keys
+WHERE id = ?;
+`
+
+const AddDataKeyQuery = `
+INSERT INTO data_keys (id, data_key) VALUES (?, ?);
+`
+
+const AddFileKeyQuery = `
+INSERT OR REPLACE INTO file_keys (file_path, key_id) VALUES (?, ?);
+`
+
+// Data keys are destroyed once neither a file nor a version of one is
+// sealed with them.
+const RemoveUnusedDataKeysQuery = `
+DELETE
+FROM data_keys
+WHERE id NOT IN (SELECT key_id FROM file_keys)
+  AND id NOT IN (SELECT key_id FROM file_versions);
+`
+
+const ChangeFilePathKeys = `
+UPDATE file_keys
+SET file_path = $1 || substr(file_path, length($2) + 1)
+WHERE file_path = $2
+   OR substr(file_path, 1, length($2) + 1) = $2 || '/';
+`
+
+const RemoveFilePathKeys = `
+DELETE
+FROM file_keys
+WHERE file_path = $1
+   OR substr(file_path, 1, length($1) + 1) = $1 || '/';
+`
+
+const GetOwnedPathsQuery = `
+SELECT fm.file_path
+FROM file_metadata fm
+         JOIN users u on fm.owner_id = u.id
+WHERE u.username = ?
+ORDER BY fm.file_path;
+`
+
+const CountOtherOwnersBelowQuery = `
+SELECT COUNT(*)
+FROM file_metadata fm
+         JOIN users u on fm.owner_id = u.id
+WHERE (fm.file_path = $1
+    OR substr(fm.file_path, 1, length($1) + 1) = $1 || '/')
+  AND u.username != $2;
+`
+
+// The rows of a user that aren't keyed by the paths of their files are
+// removed along with the user by these queries, all taking the username.
+// The audit log keeps what they did.
+const RemoveUserPermissionsQuery = `
+DELETE
+FROM file_permissions
+WHERE user_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const RemoveUserMembershipsQuery = `
+DELETE
+FROM group_memberships
+WHERE user_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const RemoveUserTrashItemsQuery = `
+DELETE
+FROM trash_items
+WHERE user_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const RemoveUserSnapshotsQuery = `
+DELETE
+FROM snapshots
+WHERE user_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const RemoveUserQuotaQuery = `
+DELETE
+FROM user_quotas
+WHERE user_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const RemoveUserSearchTokensQuery = `
+DELETE
+FROM search_index
+WHERE owner_id = (SELECT id FROM users WHERE username = ?);
+`
+
+const RemoveUserQuery = `
+DELETE
+FROM users
+WHERE username = ?;
+`
@@ -0,0 +1,105 @@
+package encryption
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"math"
+)
+
+// Data is compressed before it is encrypted, as ciphertext doesn't compress.
+// The algorithms are values of the FlagCompression bits of a header.
+const (
+	CompressionNone byte = 0
+	CompressionGzip byte = 2
+)
+
+const (
+	// minCompressedSize leaves out data too small to gain from compression.
+	minCompressedSize = 1024
+	// maxCompressedEntropy leaves out data that already looks compressed or
+	// encrypted, in bits per byte.
+	maxCompressedEntropy = 7.5
+)
+
+// ChooseCompression picks the algorithm for contents starting with sample.
+// If complete the sample is all of the contents, so its size is theirs.
+func ChooseCompression(sample []byte, complete bool) byte {
+	if complete && len(sample) < minCompressedSize {
+		return CompressionNone
+	}
+	if entropy(sample) > maxCompressedEntropy {
+		return CompressionNone
+	}
+	return CompressionGzip
+}
+
+// CompressionName is how algorithm is shown to users.
+func CompressionName(algorithm byte) string {
+	switch algorithm {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	}
+	return "unknown"
+}
+
+// Compress compresses data with algorithm. The output only depends on the
+// data, so equal data compresses to equal bytes and still deduplicates.
+func Compress(algorithm byte, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		compressed := new(bytes.Buffer)
+		writer, err := gzip.NewWriterLevel(compressed, gzip.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	}
+	return nil, errors.New("Unknown compression")
+}
+
+func Decompress(algorithm byte, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	return nil, errors.New("Unknown compression")
+}
+
+// entropy is the Shannon entropy of the bytes of data, in bits per byte.
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	counts := make([]int, 256)
+	for _, b := range data {
+		counts[b]++
+	}
+	result := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(data))
+		result -= p * math.Log2(p)
+	}
+	return result
+}
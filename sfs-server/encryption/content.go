@@ -0,0 +1,346 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+// File contents are stored as a header followed by a sequence of chunks,
+// each sealed on its own with AES-GCM. Chunks can be decrypted
+// independently, so contents can be streamed and read from any offset
+// without decrypting the whole file.
+//
+// The header holds a magic number, a flags byte and a random nonce prefix.
+// The flags tell how the contents are to be read, e.g. FlagManifest marks
+// contents that list the chunks a file's data is stored in, and the bits of
+// FlagCompression the algorithm that data is compressed with. Contents with
+// FlagDataKey set are sealed with a data key rather than with Key, and the
+// id of that key follows the header.
+// A chunk's nonce is that prefix followed by the chunk's index, and the last
+// chunk is sealed with different additional data than the others so a file
+// cut short at a chunk boundary doesn't decrypt.
+const (
+	ChunkSize  = 64 * 1024
+	HeaderSize = len(magic) + 1 + noncePrefixSize
+	KeyIdSize  = 16
+
+	magic           = "SFS1"
+	noncePrefixSize = 8
+	tagSize         = 16
+)
+
+const (
+	FlagManifest    byte = 1
+	FlagCompression byte = 6
+	FlagDataKey     byte = 8
+)
+
+var (
+	lastChunk  = []byte{1}
+	innerChunk = []byte{0}
+)
+
+// ErrNoHeader is returned for contents that don't start with a header, like
+// files stored in plaintext before contents were encrypted.
+var ErrNoHeader = errors.New("Invalid content header")
+
+// ContentWriter encrypts everything written to it into dst. Close must be
+// called to seal the last chunk; it does not close dst.
+type ContentWriter struct {
+	dst         io.Writer
+	gcm         cipher.AEAD
+	noncePrefix []byte
+	buf         []byte
+	index       uint32
+}
+
+func NewContentWriter(dst io.Writer) (*ContentWriter, error) {
+	return NewContentWriterFlags(dst, 0)
+}
+
+// NewContentWriterFlags is NewContentWriter with the given flags set in the
+// header.
+func NewContentWriterFlags(dst io.Writer, flags byte) (*ContentWriter, error) {
+	return NewContentWriterKey(dst, flags, nil)
+}
+
+// NewContentWriterKey is NewContentWriterFlags sealing the contents with
+// key, unless it is nil.
+func NewContentWriterKey(dst io.Writer, flags byte, key *DataKey) (*ContentWriter, error) {
+	sealingKey := []byte(Key)
+	var keyId []byte
+	if key != nil {
+		id, err := hex.DecodeString(key.Id)
+		if err != nil || len(id) != KeyIdSize {
+			return nil, errors.New("Invalid data key id")
+		}
+		sealingKey, keyId = key.Key, id
+		flags |= FlagDataKey
+	}
+	gcm, err := newGCM(sealingKey)
+	if err != nil {
+		return nil, err
+	}
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+		return nil, err
+	}
+	header := append([]byte(magic), flags)
+	header = append(header, noncePrefix...)
+	if _, err := dst.Write(append(header, keyId...)); err != nil {
+		return nil, err
+	}
+	return &ContentWriter{
+		dst:         dst,
+		gcm:         gcm,
+		noncePrefix: noncePrefix,
+		buf:         make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (cw *ContentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, as until then
+		// it may turn out to be the last one.
+		if len(cw.buf) == ChunkSize {
+			if err := cw.seal(innerChunk); err != nil {
+				return written, err
+			}
+		}
+		n := copy(cw.buf[len(cw.buf):ChunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (cw *ContentWriter) Close() error {
+	return cw.seal(lastChunk)
+}
+
+func (cw *ContentWriter) seal(additionalData []byte) error {
+	sealed := cw.gcm.Seal(nil, chunkNonce(cw.noncePrefix, cw.index), cw.buf, additionalData)
+	if _, err := cw.dst.Write(sealed); err != nil {
+		return err
+	}
+	cw.index++
+	cw.buf = cw.buf[:0]
+	return nil
+}
+
+// ContentReader decrypts contents written by a ContentWriter. It reads
+// chunks from src as they are needed and can seek to any plaintext offset.
+type ContentReader struct {
+	src         io.ReaderAt
+	flags       byte
+	gcm         cipher.AEAD
+	noncePrefix []byte
+	headerSize  int64
+	size        int64
+	chunks      int64
+	lastSize    int64
+	offset      int64
+	chunk       []byte
+	chunkIndex  int64
+}
+
+// NewContentReader reads the contents stored in the first size bytes of src.
+// Empty sources are read as empty contents.
+func NewContentReader(src io.ReaderAt, size int64) (*ContentReader, error) {
+	return NewContentReaderKeys(src, size, nil)
+}
+
+// NewContentReaderKeys is NewContentReader looking up the data key of
+// contents sealed with one with lookup.
+func NewContentReaderKeys(src io.ReaderAt, size int64, lookup KeyLookup) (*ContentReader, error) {
+	cr := &ContentReader{src: src, headerSize: int64(HeaderSize), chunkIndex: -1}
+	if size == 0 {
+		return cr, nil
+	}
+	header := make([]byte, HeaderSize)
+	n, err := src.ReadAt(header, 0)
+	if n < HeaderSize && err != io.EOF {
+		return nil, err
+	}
+	if n < HeaderSize || string(header[:len(magic)]) != magic {
+		return nil, ErrNoHeader
+	}
+	cr.flags = header[len(magic)]
+	cr.noncePrefix = header[len(magic)+1:]
+	sealingKey := []byte(Key)
+	if cr.flags&FlagDataKey != 0 {
+		if lookup == nil {
+			return nil, errors.New("Contents are sealed with a data key")
+		}
+		keyId := make([]byte, KeyIdSize)
+		if _, err := src.ReadAt(keyId, int64(HeaderSize)); err != nil {
+			return nil, err
+		}
+		key, err := lookup(hex.EncodeToString(keyId))
+		if err != nil {
+			return nil, err
+		}
+		sealingKey = key
+		cr.headerSize += KeyIdSize
+	}
+	gcm, err := newGCM(sealingKey)
+	if err != nil {
+		return nil, err
+	}
+	cr.gcm = gcm
+	body := size - cr.headerSize
+	if body < tagSize {
+		return nil, errors.New("Invalid content length")
+	}
+	cr.chunks = (body + ChunkSize + tagSize - 1) / (ChunkSize + tagSize)
+	cr.lastSize = body - (cr.chunks-1)*(ChunkSize+tagSize)
+	if cr.lastSize < tagSize {
+		return nil, errors.New("Invalid content length")
+	}
+	cr.size = (cr.chunks-1)*ChunkSize + cr.lastSize - tagSize
+	return cr, nil
+}
+
+// Flags are those the contents were written with.
+func (cr *ContentReader) Flags() byte {
+	return cr.flags
+}
+
+// Size is the length of the decrypted contents.
+func (cr *ContentReader) Size() int64 {
+	return cr.size
+}
+
+func (cr *ContentReader) Read(p []byte) (int, error) {
+	if cr.offset >= cr.size {
+		return 0, io.EOF
+	}
+	index := cr.offset / ChunkSize
+	if index != cr.chunkIndex {
+		if err := cr.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.chunk[cr.offset-index*ChunkSize:])
+	cr.offset += int64(n)
+	return n, nil
+}
+
+func (cr *ContentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	cr.offset = offset
+	return offset, nil
+}
+
+func (cr *ContentReader) load(index int64) error {
+	length := int64(ChunkSize + tagSize)
+	additionalData := innerChunk
+	if index == cr.chunks-1 {
+		length = cr.lastSize
+		additionalData = lastChunk
+	}
+	sealed := make([]byte, length)
+	n, err := cr.src.ReadAt(sealed, cr.headerSize+index*(ChunkSize+tagSize))
+	if n < len(sealed) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	chunk, err := cr.gcm.Open(nil, chunkNonce(cr.noncePrefix, uint32(index)), sealed, additionalData)
+	if err != nil {
+		return err
+	}
+	cr.chunk = chunk
+	cr.chunkIndex = index
+	return nil
+}
+
+// EncryptContent seals small contents held in memory in the same format a
+// ContentWriter produces.
+func EncryptContent(data []byte) ([]byte, error) {
+	encrypted := new(bytes.Buffer)
+	cw, err := NewContentWriter(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return encrypted.Bytes(), nil
+}
+
+func DecryptContent(data []byte) ([]byte, error) {
+	cr, err := NewContentReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	decrypted := new(bytes.Buffer)
+	if _, err := io.Copy(decrypted, cr); err != nil {
+		return nil, err
+	}
+	return decrypted.Bytes(), nil
+}
+
+// NewContentHasher hashes contents without revealing them: the hash is
+// keyed, so equal contents can be found without it being guessable.
+func NewContentHasher() hash.Hash {
+	return hmac.New(sha256.New, []byte(Key))
+}
+
+func ContentHash(data []byte) string {
+	hasher := NewContentHasher()
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// TokenHash hashes a search token for the index of owner. Each owner's
+// tokens are hashed with a key of their own, so the index shows neither the
+// words nor which users' files share them.
+func TokenHash(owner string, token string) string {
+	ownerKey := hmac.New(sha256.New, []byte(Key))
+	ownerKey.Write([]byte("search:" + owner))
+	hasher := hmac.New(sha256.New, ownerKey.Sum(nil))
+	hasher.Write([]byte(token))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func chunkNonce(noncePrefix []byte, index uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	cipherBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(cipherBlock)
+}
@@ -0,0 +1,54 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Chunks of deduplicated contents are encrypted convergently: a chunk's key
+// is derived from its plaintext and the key of the scope storing it, so
+// equal chunks within a scope encrypt to the same ciphertext and are kept
+// once, while other scopes can't tell what a scope stores. Each key
+// encrypts a single plaintext, which is why a fixed nonce is safe.
+
+// ConvergentKey derives the key of a chunk of plaintext stored in scope.
+func ConvergentKey(scope string, plaintext []byte) []byte {
+	scopeKey := hmac.New(sha256.New, []byte(Key))
+	scopeKey.Write([]byte("chunk:" + scope))
+	hasher := hmac.New(sha256.New, scopeKey.Sum(nil))
+	hasher.Write(plaintext)
+	return hasher.Sum(nil)
+}
+
+// ChunkId names the chunk encrypted with key without revealing the key.
+func ChunkId(key []byte) string {
+	id := sha256.Sum256(key)
+	return hex.EncodeToString(id[:])
+}
+
+func SealChunk(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := chunkGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, make([]byte, gcm.NonceSize()), plaintext, nil), nil
+}
+
+func OpenChunk(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := chunkGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, make([]byte, gcm.NonceSize()), sealed, nil)
+}
+
+func chunkGCM(key []byte) (cipher.AEAD, error) {
+	cipherBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(cipherBlock)
+}
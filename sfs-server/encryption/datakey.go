@@ -0,0 +1,51 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+)
+
+// Contents can be sealed with a data key of their own instead of Key, so
+// they are made unreadable for good by destroying that key, wherever copies
+// of the ciphertext are left. Data keys are stored wrapped with Key, and
+// looked up by the id stored along with the contents.
+
+// DataKey is a key contents are sealed with, named by Id.
+type DataKey struct {
+	Id  string
+	Key []byte
+}
+
+// KeyLookup returns the data key named id, or an error if there is none,
+// e.g. because it was destroyed.
+type KeyLookup func(id string) ([]byte, error)
+
+func NewDataKey() (*DataKey, error) {
+	id := make([]byte, KeyIdSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	key := make([]byte, len(Key))
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return &DataKey{Id: hex.EncodeToString(id), Key: key}, nil
+}
+
+// WrapKey seals a data key with Key for storing it.
+func WrapKey(key []byte) (string, error) {
+	wrapped, err := EncryptContent(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(wrapped), nil
+}
+
+func UnwrapKey(wrapped string) ([]byte, error) {
+	sealed, err := hex.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptContent(sealed)
+}
@@ -6,7 +6,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -19,12 +19,12 @@ func CheckSum(filepath string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	content, err := ioutil.ReadAll(f)
-	if err != nil {
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
 		return nil, err
 	}
-	sum := sha256.Sum256(content)
-	return sum[:], nil
+	return hash.Sum(nil), nil
 }
 
 func EncryptMany(values ...*string) error {
@@ -53,9 +53,10 @@ func DecryptMany(values ...*string) error {
 			if err != nil {
 				return err
 			}
-		}
-		if err := decrypt(val); err != nil {
-			return err
+		} else {
+			if err := decrypt(val); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -63,11 +64,11 @@ func DecryptMany(values ...*string) error {
 
 func DecryptPath(value *string) error {
 	tokens := strings.Split(*value, "/")
-	for _, token := range tokens {
-		if token == "." || token == ".." || token == "~" {
+	for i, token := range tokens {
+		if token == "" || token == "." || token == ".." || token == "~" {
 			continue
 		}
-		err := decrypt(&token)
+		err := decrypt(&tokens[i])
 		if err != nil {
 			return err
 		}
@@ -79,7 +80,7 @@ func DecryptPath(value *string) error {
 func EncryptPath(value *string) error {
 	tokens := strings.Split(*value, "/")
 	for i, token := range tokens {
-		if token == "." || token == ".." || token == "~" {
+		if token == "" || token == "." || token == ".." || token == "~" {
 			continue
 		}
 		err := encrypt(&tokens[i])
@@ -109,6 +110,9 @@ func encrypt(value *string) error {
 
 func decrypt(value *string) error {
 	unescaped, err := url.PathUnescape(*value)
+	if err != nil {
+		return err
+	}
 	cipherText := []byte(unescaped)
 	key := []byte(Key)
 	cipherBlock, err := aes.NewCipher(key)
@@ -125,6 +129,9 @@ func decrypt(value *string) error {
 	}
 	nonce, cipherText := cipherText[:nonceSize], cipherText[nonceSize:]
 	plainText, err := gcm.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return err
+	}
 	*value = string(plainText)
 	return nil
 }
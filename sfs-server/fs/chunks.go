@@ -0,0 +1,405 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ChunkDir holds the data of every file and version, split into chunks that
+// are stored once per scope however many files contain them. Files and
+// version blobs only hold an encrypted manifest listing their chunks.
+const ChunkDir = "/home/ubuntu/ECE_422_Project_1/chunks/"
+
+// dataChunkSize is how much data goes into a chunk. Contents are
+// deduplicated in whole chunks, so equal files share all of theirs.
+const dataChunkSize = 1 << 20
+
+// chunkLock keeps a chunk from being removed while it gains a reference.
+var chunkLock sync.Mutex
+
+// manifest lists the chunks holding a file's contents, in order, with the
+// keys they are encrypted with. The chunks are compressed with compression,
+// which is kept in the header of the manifest rather than in it.
+type manifest struct {
+	Scope       string     `json:"scope"`
+	Size        int64      `json:"size"`
+	Chunks      []chunkRef `json:"chunks"`
+	compression byte
+}
+
+type chunkRef struct {
+	Id   string `json:"id"`
+	Key  []byte `json:"key"`
+	Size int64  `json:"size"`
+}
+
+func (m *manifest) ids() []string {
+	ids := make([]string, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		ids[i] = chunk.Id
+	}
+	return ids
+}
+
+// chunkScope returns the scope in which the contents of files owned by the
+// already encrypted owner are deduplicated: their first group, so a team
+// shares chunks, or the owner alone.
+func chunkScope(owner string) (string, error) {
+	group, err := database.Dao.GetFirstGroup(owner)
+	if err != nil {
+		return "", err
+	}
+	if group != "" {
+		return "group:" + group, nil
+	}
+	return "user:" + owner, nil
+}
+
+// chunkWriter stores everything written to it as chunks of its scope. Close
+// stores the last chunk and returns the manifest, abort gives up the chunks
+// stored so far. With compress the first chunk decides whether the contents
+// are compressed.
+type chunkWriter struct {
+	manifest manifest
+	compress bool
+	buf      []byte
+}
+
+func newChunkWriter(scope string, compress bool) *chunkWriter {
+	return &chunkWriter{
+		manifest: manifest{Scope: scope, Chunks: make([]chunkRef, 0)},
+		compress: compress,
+		buf:      make([]byte, 0, dataChunkSize),
+	}
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(cw.buf) == dataChunkSize {
+			if err := cw.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(cw.buf[len(cw.buf):dataChunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (cw *chunkWriter) Close() (*manifest, error) {
+	if len(cw.buf) > 0 {
+		if err := cw.flush(true); err != nil {
+			return nil, err
+		}
+	}
+	return &cw.manifest, nil
+}
+
+func (cw *chunkWriter) abort() error {
+	return releaseChunks(cw.manifest.ids())
+}
+
+// flush stores the buffered data as a chunk, which is the last one if final.
+func (cw *chunkWriter) flush(final bool) error {
+	if cw.compress && len(cw.manifest.Chunks) == 0 {
+		cw.manifest.compression = encryption.ChooseCompression(cw.buf, final)
+	}
+	chunk, err := storeChunk(cw.manifest.Scope, cw.manifest.compression, cw.buf)
+	if err != nil {
+		return err
+	}
+	cw.manifest.Chunks = append(cw.manifest.Chunks, chunk)
+	cw.manifest.Size += chunk.Size
+	cw.buf = cw.buf[:0]
+	return nil
+}
+
+// storeChunk adds a reference to the chunk holding data in scope, storing
+// the chunk first unless it exists already. The key is derived from the
+// compressed data, so chunks compressed differently are stored apart.
+func storeChunk(scope string, compression byte, data []byte) (chunkRef, error) {
+	compressed, err := encryption.Compress(compression, data)
+	if err != nil {
+		return chunkRef{}, err
+	}
+	key := encryption.ConvergentKey(scope, compressed)
+	chunk := chunkRef{Id: encryption.ChunkId(key), Key: key, Size: int64(len(data))}
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+	path := chunkPath(chunk.Id)
+	if !pathExists(path) {
+		sealed, err := encryption.SealChunk(key, compressed)
+		if err != nil {
+			return chunk, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return chunk, err
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(path), tempFilePrefix)
+		if err != nil {
+			return chunk, err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(sealed); err != nil {
+			tmp.Close()
+			return chunk, err
+		}
+		if err := tmp.Close(); err != nil {
+			return chunk, err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return chunk, err
+		}
+	}
+	err = database.Dao.RetainChunks([]database.Chunk{{Id: chunk.Id, Scope: scope, Size: int64(len(compressed))}})
+	return chunk, err
+}
+
+// retainManifest adds a reference to every chunk of m, for a copy of it.
+func retainManifest(m *manifest) error {
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+	chunks := make([]database.Chunk, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		if !pathExists(chunkPath(chunk.Id)) {
+			return errors.New("missing chunk " + chunk.Id)
+		}
+		chunks[i] = database.Chunk{Id: chunk.Id, Scope: m.Scope, Size: chunk.Size}
+	}
+	return database.Dao.RetainChunks(chunks)
+}
+
+// releaseChunks drops a reference to each chunk with ids and shreds the
+// chunks nothing refers to any more, which destroying data keys doesn't
+// make unreadable.
+func releaseChunks(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	chunkLock.Lock()
+	defer chunkLock.Unlock()
+	unreferenced, err := database.Dao.ReleaseChunks(ids)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range unreferenced {
+		if err := shred(chunkPath(chunk.Id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func chunkPath(id string) string {
+	return ChunkDir + id[:2] + "/" + id
+}
+
+// putManifest writes m, sealed with the key of path, to a temporary file
+// next to path and hands its checksum to store along with the rename that
+// puts it in place. If that fails the chunks of m are given up.
+func putManifest(path string, m *manifest, store func(checksum string, rename func() error) error) error {
+	err := func() error {
+		key, err := fileKey(path)
+		if err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(path), tempFilePrefix)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		checksum := sha256.New()
+		if err := writeManifest(io.MultiWriter(tmp, checksum), m, key); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return store(string(checksum.Sum(nil)), func() error {
+			return os.Rename(tmp.Name(), path)
+		})
+	}()
+	if err != nil {
+		releaseChunks(m.ids())
+	}
+	return err
+}
+
+func writeManifest(dst io.Writer, m *manifest, key *encryption.DataKey) error {
+	cw, err := encryption.NewContentWriterKey(dst, encryption.FlagManifest|m.compression, key)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(cw).Encode(m); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// readManifest returns the manifest in the file at path, or nil if the file
+// holds its contents itself.
+func readManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := encryption.NewContentReaderKeys(f, info.Size(), lookupKey)
+	if err == encryption.ErrNoHeader {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reader.Flags()&encryption.FlagManifest == 0 {
+		return nil, nil
+	}
+	return decodeManifest(reader)
+}
+
+func decodeManifest(reader *encryption.ContentReader) (*manifest, error) {
+	m := &manifest{compression: reader.Flags() & encryption.FlagCompression}
+	if err := json.NewDecoder(reader).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// manifestChunksBelow returns the chunks of every file at or below path.
+func manifestChunksBelow(path string) ([]string, error) {
+	ids := make([]string, 0)
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		m, err := readManifest(path)
+		if err != nil || m == nil {
+			return err
+		}
+		ids = append(ids, m.ids()...)
+		return nil
+	})
+	return ids, err
+}
+
+// copyStored copies the file at srcPath to dstPath, which shares its chunks
+// and is sealed with key.
+func copyStored(srcPath string, dstPath string, key *encryption.DataKey) error {
+	m, err := readManifest(srcPath)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return copyFile(srcPath, dstPath)
+	}
+	if err := retainManifest(m); err != nil {
+		return err
+	}
+	if err := createManifest(dstPath, m, key); err != nil {
+		releaseChunks(m.ids())
+		return err
+	}
+	return nil
+}
+
+// createManifest writes m, sealed with key, to a new file at path.
+func createManifest(path string, m *manifest, key *encryption.DataKey) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(f, m, key); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// chunkReader reads the contents listed in a manifest, loading and
+// decrypting chunks as they are needed.
+type chunkReader struct {
+	manifest *manifest
+	starts   []int64
+	offset   int64
+	index    int
+	data     []byte
+}
+
+func newChunkReader(m *manifest) *chunkReader {
+	starts := make([]int64, len(m.Chunks))
+	offset := int64(0)
+	for i, chunk := range m.Chunks {
+		starts[i] = offset
+		offset += chunk.Size
+	}
+	return &chunkReader{manifest: m, starts: starts, index: -1}
+}
+
+// Size is the length of the contents.
+func (cr *chunkReader) Size() int64 {
+	return cr.manifest.Size
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.offset >= cr.manifest.Size {
+		return 0, io.EOF
+	}
+	index := sort.Search(len(cr.starts), func(i int) bool { return cr.starts[i] > cr.offset }) - 1
+	if index != cr.index {
+		chunk := cr.manifest.Chunks[index]
+		sealed, err := ioutil.ReadFile(chunkPath(chunk.Id))
+		if err != nil {
+			return 0, err
+		}
+		compressed, err := encryption.OpenChunk(chunk.Key, sealed)
+		if err != nil {
+			return 0, err
+		}
+		data, err := encryption.Decompress(cr.manifest.compression, compressed)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) != chunk.Size {
+			return 0, errors.New("chunk " + chunk.Id + " has the wrong size")
+		}
+		cr.index, cr.data = index, data
+	}
+	n := copy(p, cr.data[cr.offset-cr.starts[index]:])
+	cr.offset += int64(n)
+	return n, nil
+}
+
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.manifest.Size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	cr.offset = offset
+	return offset, nil
+}
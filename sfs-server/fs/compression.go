@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"os"
+	"path/filepath"
+)
+
+// compress [on|off|default] [dir] - Show whether new contents written in the
+// current directory are compressed, or change that for all of the user's
+// files, or with dir for those in and below a directory. Contents that
+// don't gain from compression are stored as they are either way, and
+// existing files keep theirs until they are written to again.
+func Compression(workingDir string, username string, setting string, path string) (string, error) {
+	var enabled *bool
+	switch setting {
+	case "", "default":
+	case "on", "off":
+		on := setting == "on"
+		enabled = &on
+	default:
+		return "Compression can be on, off or default.", nil
+	}
+	forUser := path == ""
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	if setting == "" {
+		on, err := compressionEnabled(username, workingDir)
+		if err != nil {
+			return "", err
+		}
+		if on {
+			return "Compression is on for new contents here.", nil
+		}
+		return "Compression is off for new contents here.", nil
+	}
+	if forUser {
+		if err := database.Dao.SetUserCompression(username, enabled); err != nil {
+			return "", err
+		}
+		if enabled == nil {
+			return "Your files follow the default compression again.", nil
+		}
+		return "Compression turned " + setting + " for your files.", nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || !info.IsDir() {
+		return "No such directory.", nil
+	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	permission, err := database.Dao.CheckUserWritePermission(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You are not authorized to change this directory.", nil
+	}
+	if err := database.Dao.SetDirCompression(absPath, enabled); err != nil {
+		return "", err
+	}
+	if enabled == nil {
+		return "The directory follows the compression of its owners again.", nil
+	}
+	return "Compression turned " + setting + " for the directory.", nil
+}
+
+// compressionEnabled tells whether new contents of path, owned by the
+// already encrypted owner, are to be compressed.
+func compressionEnabled(owner string, path string) (bool, error) {
+	return database.Dao.GetCompression(owner, path, config.Compression)
+}
+
+// fileCompression returns the name of the algorithm the contents of the
+// file at path are compressed with.
+func fileCompression(path string) (string, error) {
+	m, err := readManifest(path)
+	if err != nil {
+		return "", err
+	}
+	if m == nil {
+		return encryption.CompressionName(encryption.CompressionNone), nil
+	}
+	return encryption.CompressionName(m.compression), nil
+}
@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"../database"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrPreconditionFailed is returned when a change is conditional on ETags
+// that don't match those of the path it changes.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition holds the ETags a change depends on, as sent in the If-Match
+// and If-None-Match headers: lists separated by commas, or "*" for any.
+// Empty conditions always hold.
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// etag derives the ETag of the file at path from its stored checksum, which
+// every write changes. Directories and files without a checksum have none.
+func etag(path string) string {
+	checksum, err := database.Dao.GetCheckSum(path)
+	if err != nil {
+		return ""
+	}
+	return checksumETag(checksum)
+}
+
+func checksumETag(checksum string) string {
+	if checksum == "" {
+		return ""
+	}
+	return `"` + hex.EncodeToString([]byte(checksum)) + `"`
+}
+
+// check returns ErrPreconditionFailed unless the conditions hold for path.
+// The checksum they were checked against is returned too, so a write can
+// make sure it didn't change before its contents are swapped in.
+func (cond Precondition) check(path string) (string, error) {
+	if cond.IfMatch == "" && cond.IfNoneMatch == "" {
+		return "", nil
+	}
+	exists := pathExists(path)
+	checksum, err := database.Dao.GetCheckSum(path)
+	if err != nil {
+		checksum = ""
+	}
+	current := checksumETag(checksum)
+	if cond.IfMatch != "" && !(exists && matchesETag(cond.IfMatch, current)) {
+		return "", ErrPreconditionFailed
+	}
+	if cond.IfNoneMatch != "" && exists && matchesETag(cond.IfNoneMatch, current) {
+		return "", ErrPreconditionFailed
+	}
+	return checksum, nil
+}
+
+// matchesETag tells whether etag is in the list, or the list is "*". Weak
+// ETags compare like strong ones, as SFS only hands out strong ones.
+func matchesETag(list string, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ExportFormat string
+
+const (
+	ExportTar ExportFormat = "tar"
+	ExportZip ExportFormat = "zip"
+)
+
+// The tags of exported entries are listed in exportTags, one per line as
+// the entry's name, a tab and key=value. Tar archives also hold them as user
+// extended attributes, which tar --xattrs restores.
+const exportTags = "TAGS"
+
+// The manifest of an export lists the stored checksum, the SHA-256 of the
+// encrypted file on the server, of every exported file whose stored contents
+// matched it both before and after they were exported. Files that didn't are
+// exported all the same and listed in the unverified file with the reason,
+// which is changed for files written to while they were exported.
+const (
+	exportManifest   = "SHA256SUMS"
+	exportUnverified = "UNVERIFIED"
+	exportChanged    = "changed"
+)
+
+func ParseExportFormat(format string) (ExportFormat, error) {
+	switch ExportFormat(format) {
+	case "", ExportTar:
+		return ExportTar, nil
+	case ExportZip:
+		return ExportZip, nil
+	}
+	return "", errors.New("unknown export format " + format)
+}
+
+// Export is a directory ready to be streamed as an archive. Its entries are
+// found while the archive is written, so nothing is held in memory.
+type Export struct {
+	// Name is the decrypted name of the directory, which everything in the
+	// archive is put under.
+	Name      string
+	root      string
+	username  string
+	format    ExportFormat
+	checksums bool
+}
+
+// export - Prepare an archive of everything the user may read below the
+// directory at path, with decrypted names and contents and, with checksums,
+// a manifest to check them against
+func ExportDir(workingDir string, username string, path string, format ExportFormat, checksums bool) (*Export, string, error) {
+	if path == "" {
+		path = "."
+	}
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return nil, "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return nil, "", err
+	}
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return nil, "Directory does not exist.", nil
+	}
+	permission, err := database.Dao.CheckUserReadPermission(username, root)
+	if err != nil {
+		return nil, "", err
+	}
+	if !permission {
+		return nil, "You are not authorized to access this directory.", nil
+	}
+	name := filepath.Base(root)
+	if encryption.DecryptMany(&name) != nil {
+		name = "export"
+	}
+	return &Export{Name: name, root: root, username: username, format: format, checksums: checksums}, "", nil
+}
+
+// exportEntry is a file, directory or link being added to an archive.
+type exportEntry struct {
+	name     string
+	isDir    bool
+	size     int64
+	modified time.Time
+	owner    string
+	group    string
+	// link is the target of links, which are added as symlinks.
+	link string
+	tags []database.Tag
+}
+
+// archiveWriter adds entries to an archive of one of the export formats.
+type archiveWriter interface {
+	create(entry exportEntry) (io.Writer, error)
+	Close() error
+}
+
+// Stream writes the archive into w. Entries the user may not read are
+// left out, as is everything below directories they may not read.
+func (export *Export) Stream(w io.Writer) error {
+	var archive archiveWriter
+	switch export.format {
+	case ExportZip:
+		archive = &zipArchive{zip.NewWriter(w)}
+	default:
+		archive = &tarArchive{tar.NewWriter(w)}
+	}
+	sums := make([]string, 0)
+	unverified := make([]string, 0)
+	tagged := make([]string, 0)
+	err := filepath.Walk(export.root, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+		permission, err := database.Dao.CheckUserReadPermission(export.username, absPath)
+		if err != nil {
+			return err
+		}
+		relPath := ""
+		if absPath != export.root {
+			relPath = strings.TrimPrefix(absPath, export.root+"/")
+		}
+		if !permission || relPath != "" && encryption.DecryptPath(&relPath) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry, err := describe(absPath, info.Name(), info, true)
+		if err != nil {
+			return err
+		}
+		name := path.Join(export.Name, relPath)
+		header := exportEntry{
+			name:     name,
+			isDir:    info.IsDir(),
+			modified: info.ModTime(),
+			owner:    entry.Owner,
+			group:    entry.Group,
+		}
+		if header.tags, err = readTags(absPath); err != nil {
+			return err
+		}
+		for _, tag := range header.tags {
+			tagged = append(tagged, name+"\t"+tag.Key+"="+tag.Value)
+		}
+		if info.IsDir() || entry.Link != "" {
+			header.link = entry.Link
+			_, err := archive.create(header)
+			return err
+		}
+		if !export.checksums {
+			return exportFile(archive, header, absPath)
+		}
+		sum, status, err := storedChecksum(absPath)
+		if err != nil {
+			return err
+		}
+		if err := exportFile(archive, header, absPath); err != nil {
+			return err
+		}
+		if status == ChecksumOk {
+			after, afterStatus, err := storedChecksum(absPath)
+			if err != nil {
+				return err
+			}
+			if afterStatus != ChecksumOk || after != sum {
+				status = exportChanged
+			}
+		}
+		if status == ChecksumOk {
+			sums = append(sums, sum+"  "+name)
+		} else {
+			unverified = append(unverified, status+"  "+name)
+		}
+		return nil
+	})
+	if err != nil {
+		archive.Close()
+		return err
+	}
+	if len(tagged) != 0 {
+		if err := addListing(archive, exportTags, tagged); err != nil {
+			archive.Close()
+			return err
+		}
+	}
+	if export.checksums {
+		if err := addListing(archive, exportManifest, sums); err != nil {
+			archive.Close()
+			return err
+		}
+		if len(unverified) != 0 {
+			if err := addListing(archive, exportUnverified, unverified); err != nil {
+				archive.Close()
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// exportFile adds the decrypted contents of the file at path to the archive.
+// The size in the header is that of the contents opened, in case they were
+// written to since they were described.
+func exportFile(archive archiveWriter, header exportEntry, path string) error {
+	file, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header.size = file.Size()
+	dst, err := archive.create(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, file)
+	return err
+}
+
+// addListing adds a file with one line for each of lines, sorted, at the top
+// level of the archive.
+func addListing(archive archiveWriter, name string, lines []string) error {
+	sort.Strings(lines)
+	contents := ""
+	for _, line := range lines {
+		contents += line + "\n"
+	}
+	dst, err := archive.create(exportEntry{name: name, size: int64(len(contents)), modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(dst, contents)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (archive *tarArchive) create(entry exportEntry) (io.Writer, error) {
+	header := &tar.Header{
+		Name:    entry.name,
+		Mode:    0644,
+		Size:    entry.size,
+		ModTime: entry.modified,
+		Uname:   entry.owner,
+		Gname:   entry.group,
+		Format:  tar.FormatPAX,
+	}
+	if entry.isDir {
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		header.Mode = 0755
+		header.Size = 0
+	}
+	if len(entry.tags) != 0 {
+		header.PAXRecords = make(map[string]string)
+		for _, tag := range entry.tags {
+			header.PAXRecords["SCHILY.xattr.user."+tag.Key] = tag.Value
+		}
+	}
+	if entry.link != "" {
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = entry.link
+		header.Mode = 0777
+		header.Size = 0
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (archive *zipArchive) create(entry exportEntry) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     entry.name,
+		Method:   zip.Deflate,
+		Modified: entry.modified,
+	}
+	header.SetMode(0644)
+	if entry.isDir {
+		header.Name += "/"
+		header.Method = zip.Store
+		header.SetMode(os.ModeDir | 0755)
+	}
+	if entry.link == "" {
+		return archive.CreateHeader(header)
+	}
+	// Zip archives keep the target of a symlink as its contents.
+	header.Method = zip.Store
+	header.SetMode(os.ModeSymlink | 0777)
+	dst, err := archive.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(dst, entry.link)
+	return dst, err
+}
@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FindPageSize is the most matches a search returns at once.
+const FindPageSize = 100
+
+// FindQuery selects entries by name, path, type, size, modification time
+// and tags. Name is a glob matched against entry names, Regex is matched against
+// paths relative to where the search starts and Type is "f" or "d". Sizes
+// and times are left out of the search when negative or zero respectively,
+// and a Limit outside of 1 to FindPageSize is a full page.
+type FindQuery struct {
+	Name           string
+	Regex          string
+	Type           string
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  int64
+	ModifiedBefore int64
+	Tags           []TagFilter
+	Offset         int
+	Limit          int
+}
+
+// FindResult is one page of matches. Next is the offset of the following
+// page, or zero when this is the last one.
+type FindResult struct {
+	Entries []FileInfo `json:"entries"`
+	Next    int        `json:"next"`
+}
+
+// errPageFull ends a search once a page is full.
+var errPageFull = errors.New("page full")
+
+// find - Search below path for entries matching the query, skipping
+// everything the user may not access
+func Find(workingDir string, username string, path string, query FindQuery) (*FindResult, string, error) {
+	if _, err := filepath.Match(query.Name, ""); err != nil {
+		return nil, "Invalid name pattern.", nil
+	}
+	pattern, err := regexp.Compile(query.Regex)
+	if err != nil {
+		return nil, "Invalid regular expression.", nil
+	}
+	if query.Type != "" && query.Type != "f" && query.Type != "d" {
+		return nil, "Type must be f or d.", nil
+	}
+	if query.Limit <= 0 || query.Limit > FindPageSize {
+		query.Limit = FindPageSize
+	}
+	if path == "" {
+		path = "."
+	}
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return nil, "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return nil, "", err
+	}
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return nil, "Directory does not exist.", nil
+	}
+	permission, err := database.Dao.CheckUserPermission(username, root)
+	if err != nil {
+		return nil, "", err
+	}
+	if !permission {
+		return nil, "You are not authorized to access this directory.", nil
+	}
+	if query.Tags, err = encryptTagFilters(query.Tags); err != nil {
+		return nil, "", err
+	}
+	result := &FindResult{Entries: make([]FileInfo, 0)}
+	skip := query.Offset
+	err = filepath.Walk(root, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil || absPath == root {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+		permission, err := database.Dao.CheckUserPermission(username, absPath)
+		if err != nil {
+			return err
+		}
+		relPath := strings.TrimPrefix(absPath, root+"/")
+		if !permission || encryption.DecryptPath(&relPath) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry, err := describe(absPath, filepath.Base(relPath), info, true)
+		if err != nil {
+			return err
+		}
+		entry.Path = relPath
+		if !query.matches(entry, pattern) {
+			return nil
+		}
+		if tagged, err := hasTags(absPath, query.Tags); err != nil || !tagged {
+			return err
+		}
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if len(result.Entries) == query.Limit {
+			result.Next = query.Offset + query.Limit
+			return errPageFull
+		}
+		result.Entries = append(result.Entries, *entry)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		return nil, "", err
+	}
+	return result, "", nil
+}
+
+func (query FindQuery) matches(entry *FileInfo, pattern *regexp.Regexp) bool {
+	if query.Name != "" {
+		if matched, _ := filepath.Match(query.Name, entry.Name); !matched {
+			return false
+		}
+	}
+	if query.Type == "f" && entry.IsDir || query.Type == "d" && !entry.IsDir {
+		return false
+	}
+	if query.MinSize >= 0 && entry.Size < query.MinSize || query.MaxSize >= 0 && entry.Size > query.MaxSize {
+		return false
+	}
+	if query.ModifiedAfter > 0 && entry.Modified < query.ModifiedAfter {
+		return false
+	}
+	if query.ModifiedBefore > 0 && entry.Modified > query.ModifiedBefore {
+		return false
+	}
+	return pattern.MatchString(entry.Path)
+}
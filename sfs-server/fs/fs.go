@@ -3,7 +3,10 @@ package fs
 import (
 	"../database"
 	"../encryption"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -96,32 +99,19 @@ func ValidateCheckSums(username string) (string, error) {
 }
 
 func Ls(workingDir string, username string) (string, error) {
-	if err := encryption.EncryptMany(&username); err != nil {
-		return "", err
-	}
-	if err := os.Chdir(workingDir); err != nil {
-		return "", err
-	}
-	files, err := ioutil.ReadDir(".")
-	if err != nil {
-		return "", err
-	}
-	result := make([]string, 0)
-	for _, f := range files {
-		path := f.Name()
-		absPath, err := filepath.Abs(path)
-		if err != nil {
-			return "", err
-		}
-		hasPermission, err := database.Dao.CheckUserPermission(username, absPath)
-		if hasPermission {
-			if err := encryption.DecryptMany(&path); err != nil {
-				return "", nil
-			}
+	listing, output, err := List(workingDir, username, "", ListOptions{All: true})
+	if err != nil || listing == nil {
+		return output, err
+	}
+	names := make([]string, 0, len(listing.Entries))
+	for _, entry := range listing.Entries {
+		if entry.Link != "" {
+			names = append(names, entry.Name+" -> "+entry.Link)
+			continue
 		}
-		result = append(result, path)
+		names = append(names, entry.Name)
 	}
-	return strings.Join(result, "\n"), nil
+	return strings.Join(names, "\n"), nil
 }
 
 // mkdir <directory_name> - Create a new directory in current directory
@@ -133,15 +123,18 @@ func Mkdir(workingDir string, username string, directoryName string) (string, er
 	if err := os.Chdir(workingDir); err != nil {
 		return "", err
 	}
-	err := os.Mkdir(directoryName, os.ModeDir)
-	// looks like file exists
-	if os.IsExist(err) {
-		return "", err
-	}
 	absPath, err := filepath.Abs(directoryName)
 	if err != nil {
 		return "", err
 	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	err = os.Mkdir(directoryName, os.ModeDir)
+	// looks like file exists
+	if os.IsExist(err) {
+		return "", err
+	}
 	err = database.Dao.AddUserPermission(username, absPath)
 	if err != nil {
 		return "", err
@@ -157,7 +150,13 @@ func Mkdir(workingDir string, username string, directoryName string) (string, er
 // function to get functionality
 // this changes the 'virtual' directory - the shell directory stays the same
 func Cd(workingDir string, username string, newDir string) (string, error) {
-	if strings.Contains(newDir, "~") {
+	if strings.HasPrefix(newDir, "@") {
+		path, err := snapshotPath(username, newDir)
+		if err != nil {
+			return "", err
+		}
+		newDir = path
+	} else if strings.Contains(newDir, "~") {
 		rest := strings.Replace(newDir, "~", "", 1)
 		if rest != "" {
 			err := encryption.EncryptMany(&rest)
@@ -186,6 +185,13 @@ func Cd(workingDir string, username string, newDir string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	absPath, message, err := followLinks(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if message != "" {
+		return "", errors.New(message)
+	}
 	groupPermission, err := database.Dao.CheckUsersGroupPermission(username, absPath)
 	if err != nil {
 		return "", err
@@ -209,32 +215,113 @@ func Cd(workingDir string, username string, newDir string) (string, error) {
 
 // cat <file_name> - Show contents of file, line by line.
 // example: "cat file1"
-func Cat(workingDir string, username string, filePath string) (string, error) {
+// The file is returned open for streaming, and must be closed by the caller.
+// If it can't be read a message saying why is returned instead.
+func Cat(workingDir string, username string, filePath string) (*File, string, error) {
 	if err := encryption.EncryptMany(&username, &filePath); err != nil {
-		return "", err
+		return nil, "", err
 	}
 	if err := os.Chdir(workingDir); err != nil {
-		return "", err
+		return nil, "", err
 	}
 	absPath, err := filepath.Abs(filePath)
 	if err != nil {
-		return "", err
+		return nil, "", err
+	}
+	absPath, message, err := followLinks(username, absPath)
+	if err != nil || message != "" {
+		return nil, message, err
 	}
 	permission, err := database.Dao.CheckUserPermission(username, absPath)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 	if !permission {
-		return "You are not authorized to access this file.", nil
+		return nil, "You are not authorized to access this file.", nil
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || info.IsDir() {
+		return nil, "File does not exist.", nil
 	}
-	// https://golangcode.com/read-a-files-contents/
-	content, err := ioutil.ReadFile(absPath)
+	// The ETag is taken first, so a write in between makes it stale rather
+	// than new contents look like the old ones.
+	tag := etag(absPath)
+	file, err := openFile(absPath)
 	if err != nil {
-		return "", nil
+		return nil, "", err
 	}
-	// Convert []byte to string and print to screen
-	text := string(content)
-	return text, nil
+	file.ETag = tag
+	return file, "", nil
+}
+
+// TreeEntry is a file or directory below the root of a Tree, with its path
+// relative to that root.
+type TreeEntry struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"dir"`
+	// The SHA-256 of the decrypted contents of files, if asked for.
+	Checksum string `json:"sha256,omitempty"`
+}
+
+// tree - List the files and directories below path that the user may
+// access, for copying whole directories in and out of SFS. With checksums
+// the contents of every file are hashed, so they can be compared with
+// local copies.
+func Tree(workingDir string, username string, path string, checksums bool) ([]TreeEntry, string, error) {
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return nil, "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return nil, "", err
+	}
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return nil, "Directory does not exist.", nil
+	}
+	permission, err := database.Dao.CheckUserPermission(username, root)
+	if err != nil {
+		return nil, "", err
+	}
+	if !permission {
+		return nil, "You are not authorized to access this directory.", nil
+	}
+	entries := make([]TreeEntry, 0)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		permission, err := database.Dao.CheckUserPermission(username, path)
+		if err != nil {
+			return err
+		}
+		relPath := strings.TrimPrefix(path, root+"/")
+		if !permission || strings.HasPrefix(info.Name(), tempFilePrefix) || encryption.DecryptPath(&relPath) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Links would be copied out as empty files, so they are left out.
+		if _, isLink, err := database.Dao.GetLink(path); err != nil || isLink {
+			return err
+		}
+		entry := TreeEntry{Path: relPath, IsDir: info.IsDir()}
+		if checksums && !info.IsDir() {
+			if entry.Checksum, err = plainCheckSum(path); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, "", nil
 }
 
 // touch <file_name> - create a new file with provided name in current directory
@@ -250,6 +337,9 @@ func Touch(workingDir string, username string, filename string) (string, error)
 	if err != nil {
 		return "", err
 	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
 	permission, err := database.Dao.CheckUserPermission(username, filepath.Dir(absPath))
 	if err != nil {
 		return "", err
@@ -257,16 +347,20 @@ func Touch(workingDir string, username string, filename string) (string, error)
 	if !permission {
 		return "You do not have authorization to create a file in this location.", nil
 	}
-	if !pathExists(absPath) {
-		if err := database.Dao.AddUserPermission(username, absPath); err != nil {
-			return "", err
-		}
+	if pathExists(absPath) {
+		return "Done.", nil
+	}
+	if err := database.Dao.AddUserPermission(username, absPath); err != nil {
+		return "", err
 	}
-	_, err = os.OpenFile(absPath, os.O_RDONLY|os.O_CREATE, 0666)
+	if err := createFile(absPath); err != nil {
+		return "", err
+	}
+	checksum, err := encryption.CheckSum(absPath)
 	if err != nil {
 		return "", err
 	}
-	err = database.Dao.AddCheckSum(absPath, "")
+	err = database.Dao.AddCheckSum(absPath, string(checksum))
 	if err != nil {
 		return "", err
 	}
@@ -275,7 +369,7 @@ func Touch(workingDir string, username string, filename string) (string, error)
 
 // mv <old_path> <new_path> - move a file from one location to another
 // example: "mv /home/folder1/file1 /home/folder1/folder2/file1
-func Mv(workingDir string, username string, oldPath string, newPath string) (string, error) {
+func Mv(workingDir string, username string, sessionId string, oldPath string, newPath string, cond Precondition) (string, error) {
 	if err := encryption.EncryptMany(&username, &oldPath, &newPath); err != nil {
 		return "", err
 	}
@@ -290,6 +384,9 @@ func Mv(workingDir string, username string, oldPath string, newPath string) (str
 	if err != nil {
 		return "", err
 	}
+	if inSnapshot(oldPath) || inSnapshot(newPath) {
+		return snapshotReadOnly, nil
+	}
 	oldPathPermission, err := database.Dao.CheckUserPermission(username, oldPath)
 	if err != nil {
 		return "", err
@@ -304,83 +401,381 @@ func Mv(workingDir string, username string, oldPath string, newPath string) (str
 	if !oldPathPermission {
 		return "You are not authorized to move this object", nil
 	}
-	err = database.Dao.ChangeFilePath(oldPath, newPath)
-	if err != nil {
+	if newPath == oldPath || strings.HasPrefix(newPath, oldPath+"/") {
+		return "Cannot move a directory into itself.", nil
+	}
+	if pathExists(newPath) {
+		return "Something already exists at the destination.", nil
+	}
+	for _, path := range []string{oldPath, newPath} {
+		message, err := checkLocks(sessionId, path, true)
+		if err != nil || message != "" {
+			return message, err
+		}
+	}
+	if _, err := cond.check(oldPath); err != nil {
 		return "", err
 	}
-	err = os.Rename(oldPath, newPath)
+	err = database.Dao.ChangeFilePath(oldPath, newPath, func() error {
+		return os.Rename(oldPath, newPath)
+	})
 	if err != nil {
 		return "", err
 	}
+	moveLocks(oldPath, newPath)
 	return "Done.", nil
 }
 
-// rm <file_name> - Delete file
-func Rm(workingDir string, username string, path string) error {
-	if err := encryption.EncryptMany(&username, &path); err != nil {
-		return err
+// cp [-r] <src> <dst> - copy a file, or a directory when recursive is set
+// example: "cp -r folder1 folder2"
+func Cp(workingDir string, username string, sessionId string, srcPath string, dstPath string, recursive bool) (string, error) {
+	if err := encryption.EncryptMany(&username, &srcPath, &dstPath); err != nil {
+		return "", err
 	}
 	if err := os.Chdir(workingDir); err != nil {
-		return err
+		return "", err
 	}
-	// Removing file from the directory
-	absPath, err := filepath.Abs(path)
-	permission, err := database.Dao.CheckUserPermission(username, absPath)
+	srcPath, err := filepath.Abs(srcPath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if !permission {
-		return errors.New("No permission")
+	dstPath, err = filepath.Abs(dstPath)
+	if err != nil {
+		return "", err
 	}
+	srcInfo, err := os.Stat(srcPath)
 	if err != nil {
-		return err
+		return "No such file or directory.", nil
 	}
-	err = os.RemoveAll(absPath)
+	readPermission, err := database.Dao.CheckUserReadPermission(username, srcPath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	if !readPermission {
+		return "You are not authorized to copy this object", nil
+	}
+	if srcInfo.IsDir() && !recursive {
+		return "Omitting directory, use cp -r to copy directories.", nil
+	}
+	if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.IsDir() {
+		dstPath = filepath.Join(dstPath, filepath.Base(srcPath))
+	}
+	if pathExists(dstPath) {
+		return "Destination already exists.", nil
+	}
+	if dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/") {
+		return "Cannot copy a directory into itself.", nil
+	}
+	if inSnapshot(dstPath) {
+		return snapshotReadOnly, nil
+	}
+	writePermission, err := database.Dao.CheckUserWritePermission(username, filepath.Dir(dstPath))
+	if err != nil {
+		return "", err
+	}
+	if !writePermission {
+		return "You are not authorized to write to this location", nil
+	}
+	message, err := checkLocks(sessionId, dstPath, true)
+	if err != nil || message != "" {
+		return message, err
+	}
+	remaining, err := quotaRemaining(username)
+	if err != nil {
+		return "", err
+	}
+	skipped := make([]string, 0)
+	err = filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != srcPath {
+			readable, err := database.Dao.CheckUserReadPermission(username, path)
+			if err != nil {
+				return err
+			}
+			if !readable {
+				skipped = append(skipped, strings.TrimPrefix(path, srcPath+"/"))
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		target := dstPath + strings.TrimPrefix(path, srcPath)
+		if info.IsDir() {
+			if err := os.Mkdir(target, os.ModeDir); err != nil {
+				return err
+			}
+			if err := database.Dao.AddCopiedEntry(username, target, "", true); err != nil {
+				return err
+			}
+			return database.Dao.CopyTags(path, target)
+		}
+		if remaining >= 0 {
+			size, err := contentSize(path)
+			if err != nil {
+				return err
+			}
+			if size > remaining {
+				return ErrQuotaExceeded
+			}
+			remaining -= size
+		}
+		key, err := fileKey(target)
+		if err != nil {
+			return err
+		}
+		if err := copyStored(path, target, key); err != nil {
+			return err
+		}
+		checkSum, err := encryption.CheckSum(target)
+		if err != nil {
+			return err
+		}
+		if err := database.Dao.AddCopiedEntry(username, target, string(checkSum), false); err != nil {
+			return err
+		}
+		if err := copyLink(path, target); err != nil {
+			return err
+		}
+		if err := database.Dao.CopyTags(path, target); err != nil {
+			return err
+		}
+		if err := recordSize(target); err != nil {
+			return err
+		}
+		return indexFile(username, target)
+	})
+	if errors.Is(err, ErrQuotaExceeded) {
+		return "Copy stopped, it would exceed your quota. What was copied so far is kept.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	warning, err := quotaWarning(username)
+	if err != nil {
+		return "", err
+	}
+	if len(skipped) == 0 {
+		return "Done." + warning, nil
+	}
+	for i := range skipped {
+		if err := encryption.DecryptPath(&skipped[i]); err != nil {
+			return "", err
+		}
+	}
+	return "Copied, but skipped entries you are not authorized to read:\n" + strings.Join(skipped, "\n") + warning, nil
 }
 
-func Write(workingDir string, username string, filename string, data []byte) (string, error) {
-	if err := encryption.EncryptMany(&username, &filename); err != nil {
+// rm [-r] <path> - Move a file, or a directory and its contents when
+// recursive is set, to the user's trash. Every entry is checked for write
+// permission; entries the user may not remove are kept, together with the
+// directories holding them, and reported back.
+func Rm(workingDir string, username string, sessionId string, path string, recursive bool, cond Precondition) (string, error) {
+	if err := encryption.EncryptMany(&username, &path); err != nil {
 		return "", err
 	}
 	if err := os.Chdir(workingDir); err != nil {
 		return "", err
 	}
-	absPath, err := filepath.Abs(filename)
-	if pathExists(absPath) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "No such file or directory.", nil
+	}
+	if info.IsDir() && !recursive {
+		return "Cannot remove a directory, use rm -r or rmdir.", nil
+	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	permission, err := database.Dao.CheckUserWritePermission(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You are not authorized to remove this object", nil
+	}
+	message, err := checkLocks(sessionId, absPath, true)
+	if err != nil || message != "" {
+		return message, err
+	}
+	if _, err := cond.check(absPath); err != nil {
+		return "", err
+	}
+	entries := make([]string, 0)
+	err = filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return "", err
+			return err
+		}
+		entries = append(entries, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	kept := make(map[string]bool)
+	protected := make([]string, 0)
+	// Walk lists parents before their children, so go backwards to find the
+	// protected entries and keep every directory above them.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if kept[entry] {
+			continue
 		}
-		permission, err := database.Dao.CheckUserPermission(username, absPath)
+		permission, err := database.Dao.CheckUserWritePermission(username, entry)
 		if err != nil {
 			return "", err
 		}
 		if !permission {
-			return "You are not authorized to write to this file", nil
+			protected = append(protected, strings.TrimPrefix(entry, absPath+"/"))
+			kept[entry] = true
+			for dir := filepath.Dir(entry); strings.HasPrefix(dir, absPath); dir = filepath.Dir(dir) {
+				kept[dir] = true
+			}
 		}
-		f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
-		if err != nil {
-			return "", err
+	}
+	// Whatever is left is trashed as whole subtrees, rooted just below the
+	// directories that have to stay. Each subtree's rows move along with it
+	// in one transaction, so if one fails those trashed before stay recorded.
+	for _, entry := range entries {
+		if kept[entry] || (entry != absPath && !kept[filepath.Dir(entry)]) {
+			continue
 		}
-		_, err = f.Write(data)
-		if err != nil {
+		if err := moveToTrash(username, entry); err != nil {
 			return "", err
 		}
-		f.Close()
-		checksum, err := encryption.CheckSum(filename)
-		err = database.Dao.UpdateCheckSum(absPath, string(checksum))
-		if err != nil {
-			return "", nil
+		dropLocks(entry)
+	}
+	if len(protected) == 0 {
+		return "Moved to trash.", nil
+	}
+	for i := range protected {
+		if err := encryption.DecryptPath(&protected[i]); err != nil {
+			return "", err
 		}
-		return "Done.", nil
 	}
-	return "File does not exist.", nil
+	return "Partially moved to trash, you are not authorized to remove:\n" + strings.Join(protected, "\n"), nil
+}
+
+// rmdir <directory_name> - Move an empty directory to the user's trash
+func Rmdir(workingDir string, username string, sessionId string, path string) (string, error) {
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || !info.IsDir() {
+		return "No such directory.", nil
+	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	permission, err := database.Dao.CheckUserWritePermission(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You are not authorized to remove this directory", nil
+	}
+	message, err := checkLocks(sessionId, absPath, true)
+	if err != nil || message != "" {
+		return message, err
+	}
+	files, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return "", err
+	}
+	if len(files) != 0 {
+		return "Directory not empty.", nil
+	}
+	if err := moveToTrash(username, absPath); err != nil {
+		return "", err
+	}
+	return "Moved to trash.", nil
+}
+
+// write [-o | -t <length> | -p <offset>] <file_name> <data> - Change the
+// contents of a file. Depending on mode data is appended, replaces the
+// contents or is written at offset position; Truncate cuts the file down to
+// position bytes instead.
+func Write(workingDir string, username string, sessionId string, filename string, data io.Reader, mode WriteMode, position int64, cond Precondition) (string, error) {
+	if err := encryption.EncryptMany(&username, &filename); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	absPath, message, err := followLinks(username, absPath)
+	if err != nil || message != "" {
+		return message, err
+	}
+	if !pathExists(absPath) {
+		return "File does not exist.", nil
+	}
+	if position < 0 {
+		return "Offset and length can't be negative.", nil
+	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	permission, err := database.Dao.CheckUserWritePermission(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You are not authorized to write to this file", nil
+	}
+	message, err = checkLocks(sessionId, absPath, false)
+	if err != nil || message != "" {
+		return message, err
+	}
+	base, err := cond.check(absPath)
+	if err != nil {
+		return "", err
+	}
+	owner, err := fileOwner(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureVersioned(username, absPath); err != nil {
+		return "", err
+	}
+	err = writeFile(absPath, owner, data, mode, position, base)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return "Write rejected, it would exceed the quota.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := recordWrite(username, absPath, string(mode)); err != nil {
+		return "", err
+	}
+	warning, err := quotaWarning(owner)
+	if err != nil {
+		return "", err
+	}
+	return "Done." + warning, nil
 }
 
 func Pwd(workingDir string, username string) (string, error) {
+	if inSnapshot(workingDir) {
+		return snapshotDisplayPath(workingDir), nil
+	}
 	if err := encryption.EncryptMany(&username); err != nil {
 		return "", err
 	}
@@ -420,6 +815,38 @@ func GetHomeDir(username string) (string, error) {
 	return path, nil
 }
 
+func copyFile(srcPath string, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// plainCheckSum returns the hex SHA-256 of the decrypted contents of the
+// file at path.
+func plainCheckSum(path string) (string, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func pathExists(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -0,0 +1,322 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImportMapping gives the entries of an archive with one of the uids or gids
+// to an SFS user or group. Entries whose uid isn't mapped belong to the user
+// importing them, and those whose gid isn't mapped to no group of their own.
+type ImportMapping struct {
+	Users  map[int]string
+	Groups map[int]string
+}
+
+// ParseImportMapping reads mappings separated by commas, each of the form
+// uid:<uid>=<username> or gid:<gid>=<groupname>.
+func ParseImportMapping(spec string) (ImportMapping, error) {
+	mapping := ImportMapping{Users: make(map[int]string), Groups: make(map[int]string)}
+	if spec == "" {
+		return mapping, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return mapping, errors.New("invalid mapping " + entry)
+		}
+		ids := mapping.Users
+		id := strings.TrimPrefix(parts[0], "uid:")
+		if strings.HasPrefix(parts[0], "gid:") {
+			ids = mapping.Groups
+			id = strings.TrimPrefix(parts[0], "gid:")
+		} else if id == parts[0] {
+			return mapping, errors.New("invalid mapping " + entry)
+		}
+		number, err := strconv.Atoi(id)
+		if err != nil || number < 0 {
+			return mapping, errors.New("invalid mapping " + entry)
+		}
+		ids[number] = parts[1]
+	}
+	return mapping, nil
+}
+
+// importer unpacks an archive into root for username, both encrypted.
+type importer struct {
+	username string
+	root     string
+	mapping  ImportMapping
+	// created holds the directories this import made, which the importing
+	// user may not have access to when they belong to someone else.
+	created map[string]bool
+}
+
+// import - Unpack a tar archive into the directory at path, writing every
+// file and directory in it like any other, with checksums and permissions.
+// Entries that can't be imported are reported and skipped, the rest of the
+// archive is still imported
+func Import(workingDir string, username string, path string, archive io.Reader, mapping ImportMapping) (string, error) {
+	if path == "" {
+		path = "."
+	}
+	message, err := checkImportMapping(username, mapping)
+	if err != nil || message != "" {
+		return message, err
+	}
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if inSnapshot(root) {
+		return snapshotReadOnly, nil
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return "Directory does not exist.", nil
+	}
+	permission, err := database.Dao.CheckUserPermission(username, root)
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You do not have authorization to import into this directory.", nil
+	}
+	imp := &importer{username: username, root: root, mapping: encryptMapping(mapping), created: make(map[string]bool)}
+	reader := tar.NewReader(archive)
+	imported := 0
+	failed := make([]string, 0)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Nothing after a broken header can be found.
+			failed = append(failed, "Archive could not be read any further: "+err.Error())
+			break
+		}
+		reason := imp.add(header, reader)
+		if reason != "" {
+			failed = append(failed, header.Name+": "+reason)
+			continue
+		}
+		imported++
+	}
+	output := fmt.Sprintf("Imported %d entries.", imported)
+	if len(failed) != 0 {
+		output = fmt.Sprintf("Imported %d entries, but some entries failed:\n%s", imported, strings.Join(failed, "\n"))
+	}
+	warning, err := quotaWarning(username)
+	if err != nil {
+		return "", err
+	}
+	return output + warning, nil
+}
+
+// checkImportMapping returns a message if the users and groups mapped to
+// don't exist or username may not give files to them. Only admins may give
+// files to other users, or to groups they aren't in themselves.
+func checkImportMapping(username string, mapping ImportMapping) (string, error) {
+	admin := isAdmin(username)
+	encryptedUsername := username
+	if err := encryption.EncryptMany(&encryptedUsername); err != nil {
+		return "", err
+	}
+	for _, user := range mapping.Users {
+		if user == username {
+			continue
+		}
+		if !admin {
+			return "Only admins may import files for other users.", nil
+		}
+		if err := encryption.EncryptMany(&user); err != nil {
+			return "", err
+		}
+		exists, err := database.Dao.CheckUserExists(user)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "No such user.", nil
+		}
+	}
+	for _, group := range mapping.Groups {
+		if err := encryption.EncryptMany(&group); err != nil {
+			return "", err
+		}
+		exists, member, err := database.Dao.CheckGroup(encryptedUsername, group)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "No such group.", nil
+		}
+		if !member && !admin {
+			return "You can only import files for groups you are in.", nil
+		}
+	}
+	return "", nil
+}
+
+func encryptMapping(mapping ImportMapping) ImportMapping {
+	encrypted := ImportMapping{Users: make(map[int]string), Groups: make(map[int]string)}
+	for id, user := range mapping.Users {
+		if encryption.EncryptMany(&user) == nil {
+			encrypted.Users[id] = user
+		}
+	}
+	for id, group := range mapping.Groups {
+		if encryption.EncryptMany(&group) == nil {
+			encrypted.Groups[id] = group
+		}
+	}
+	return encrypted
+}
+
+// add imports one entry of the archive, reading a file's contents from data.
+// It returns why the entry couldn't be imported, if it couldn't.
+func (imp *importer) add(header *tar.Header, data io.Reader) string {
+	name := path.Clean(header.Name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "outside of the directory imported into"
+	}
+	if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg {
+		return "only files and directories can be imported"
+	}
+	if name == "." {
+		return ""
+	}
+	if err := encryption.EncryptMany(&name); err != nil {
+		return imp.failed(err)
+	}
+	absPath := filepath.Join(imp.root, name)
+	owner, ownerMapped := imp.mapping.Users[header.Uid]
+	if !ownerMapped {
+		owner = imp.username
+	}
+	if reason := imp.makeParents(filepath.Dir(absPath), owner); reason != "" {
+		return reason
+	}
+	if info, err := os.Stat(absPath); err == nil {
+		if info.IsDir() && header.Typeflag == tar.TypeDir {
+			return ""
+		}
+		return "already exists"
+	}
+	if header.Typeflag == tar.TypeDir {
+		if err := imp.mkdir(absPath, owner); err != nil {
+			return imp.failed(err)
+		}
+	} else if err := importFile(imp.username, owner, absPath, data); err == ErrQuotaExceeded {
+		return "it would exceed the quota"
+	} else if err != nil {
+		return imp.failed(err)
+	}
+	group, groupMapped := imp.mapping.Groups[header.Gid]
+	if !groupMapped {
+		return ""
+	}
+	read, write := header.Mode&0040 != 0, header.Mode&0020 != 0
+	if err := database.Dao.SetGroupAccess(group, absPath, read, write); err != nil {
+		return imp.failed(err)
+	}
+	return ""
+}
+
+// makeParents creates the directories up to dir that don't exist yet for
+// owner, and returns a message if username may not create entries in dir.
+func (imp *importer) makeParents(dir string, owner string) string {
+	if imp.created[dir] {
+		return ""
+	}
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return "a parent is not a directory"
+		}
+		permission, err := database.Dao.CheckUserPermission(imp.username, dir)
+		if err != nil {
+			return imp.failed(err)
+		}
+		if !permission {
+			return "not authorized to create entries in its directory"
+		}
+		return ""
+	}
+	if reason := imp.makeParents(filepath.Dir(dir), owner); reason != "" {
+		return reason
+	}
+	if err := imp.mkdir(dir, owner); err != nil {
+		return imp.failed(err)
+	}
+	return ""
+}
+
+func (imp *importer) mkdir(dir string, owner string) error {
+	if err := os.Mkdir(dir, os.ModeDir); err != nil {
+		return err
+	}
+	if err := database.Dao.AddCopiedEntry(owner, dir, "", true); err != nil {
+		os.Remove(dir)
+		return err
+	}
+	imp.created[dir] = true
+	return nil
+}
+
+// failed logs an error importing an entry, which is only reported as failed.
+func (imp *importer) failed(err error) string {
+	log.Println(fmt.Errorf("error thrown: %w", err))
+	return "import failed"
+}
+
+// importFile stores data as the contents of a new file at path owned by
+// owner, with its checksum, and records the write for username.
+func importFile(username string, owner string, path string, data io.Reader) error {
+	limit, err := quotaLimit(owner, path)
+	if err != nil {
+		return err
+	}
+	scope, err := chunkScope(owner)
+	if err != nil {
+		return err
+	}
+	compress, err := compressionEnabled(owner, path)
+	if err != nil {
+		return err
+	}
+	cw := newChunkWriter(scope, compress)
+	if _, err := io.Copy(&limitWriter{cw, limit, 0}, data); err != nil {
+		cw.abort()
+		return err
+	}
+	m, err := cw.Close()
+	if err != nil {
+		cw.abort()
+		return err
+	}
+	err = putManifest(path, m, func(checksum string, rename func() error) error {
+		return database.Dao.AddFile(owner, path, checksum, rename)
+	})
+	if err != nil {
+		return err
+	}
+	return recordWrite(username, path, "import")
+}
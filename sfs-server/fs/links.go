@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Links are empty files of their own whose target is kept in the database
+// rather than on disk. Unlike an OS symlink, which could lead anywhere on the
+// server, a link is only followed within the jail users are kept in, the
+// home directories and snapshots, and only by users who may read it.
+
+// ln -s <target> <link_name> - Create a link to target, a path relative to
+// the link's directory, or to the user's home with ~ or to the top of SFS
+// with /. The target doesn't have to exist
+func Ln(workingDir string, username string, target string, linkName string) (string, error) {
+	if target == "" {
+		return "Links need a target.", nil
+	}
+	if err := encryption.EncryptMany(&username, &linkName); err != nil {
+		return "", err
+	}
+	// Targets are kept as they were given, so ., .. and ~ are left as they
+	// are even on their own.
+	if err := encryption.EncryptPath(&target); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(linkName)
+	if err != nil {
+		return "", err
+	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	permission, err := database.Dao.CheckUserPermission(username, filepath.Dir(absPath))
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You do not have authorization to create a link in this location.", nil
+	}
+	if pathExists(absPath) {
+		return "An entry with this name exists already.", nil
+	}
+	if linkTarget(username, absPath, target) == "" {
+		return "Links can't lead outside of SFS.", nil
+	}
+	if err := createFile(absPath); err != nil {
+		return "", err
+	}
+	checksum, err := encryption.CheckSum(absPath)
+	if err == nil {
+		err = database.Dao.AddLink(username, absPath, string(checksum), target)
+	}
+	if err != nil {
+		os.Remove(absPath)
+		return "", err
+	}
+	return "Done.", nil
+}
+
+// followLinks resolves the links in path, an absolute path username asked
+// for, and returns the path of the entry it leads to. Every link on the way
+// must be readable by the user, the entry it leads to is left for the caller
+// to check. A message is returned instead if a link can't be followed.
+func followLinks(username string, path string) (string, string, error) {
+	resolved := "/"
+	rest := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	followed := 0
+	for len(rest) > 0 {
+		next := filepath.Join(resolved, rest[0])
+		rest = rest[1:]
+		target, isLink, err := database.Dao.GetLink(next)
+		if err != nil {
+			return "", "", err
+		}
+		if !isLink {
+			resolved = next
+			continue
+		}
+		if followed++; followed > config.LinkMaxDepth {
+			return "", "Too many levels of links.", nil
+		}
+		permission, err := database.Dao.CheckUserPermission(username, next)
+		if err != nil {
+			return "", "", err
+		}
+		if !permission {
+			return "", "You are not authorized to follow this link.", nil
+		}
+		to := linkTarget(username, next, target)
+		if to == "" {
+			return "", "Links can't lead outside of SFS.", nil
+		}
+		// The rest of the path goes on from the target, which is looked up
+		// from the top again as it may hold links of its own.
+		rest = append(strings.Split(strings.TrimPrefix(to, "/"), "/"), rest...)
+		resolved = "/"
+	}
+	return resolved, "", nil
+}
+
+// linkTarget returns the absolute path target leads to from the link at
+// path when username follows it, or an empty string if it leads out of the
+// jail.
+func linkTarget(username string, path string, target string) string {
+	var resolved string
+	switch {
+	case target == "~" || strings.HasPrefix(target, "~/"):
+		resolved = filepath.Join(HomeDir+username, strings.TrimPrefix(target, "~"))
+	case strings.HasPrefix(target, "/"):
+		resolved = filepath.Join(HomeDir, target)
+	default:
+		resolved = filepath.Join(filepath.Dir(path), target)
+	}
+	if !strings.HasPrefix(resolved, HomeDir) && !inSnapshot(resolved) {
+		return ""
+	}
+	return resolved
+}
+
+// readLink returns the decrypted target of the link at path, or an empty
+// string if it isn't a link.
+func readLink(path string) (string, error) {
+	target, isLink, err := database.Dao.GetLink(path)
+	if err != nil || !isLink {
+		return "", err
+	}
+	if err := encryption.DecryptPath(&target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// copyLink makes the copy at dstPath of the file at srcPath a link too, if
+// the file is one. Its target is kept as it was, relative targets lead
+// from the copy.
+func copyLink(srcPath string, dstPath string) error {
+	target, isLink, err := database.Dao.GetLink(srcPath)
+	if err != nil || !isLink {
+		return err
+	}
+	return database.Dao.SetLink(dstPath, target)
+}
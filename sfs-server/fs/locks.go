@@ -0,0 +1,247 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LockMode string
+
+const (
+	SharedLock    LockMode = "shared"
+	ExclusiveLock LockMode = "exclusive"
+)
+
+func ParseLockMode(mode string) (LockMode, error) {
+	switch LockMode(mode) {
+	case "", ExclusiveLock:
+		return ExclusiveLock, nil
+	case SharedLock:
+		return SharedLock, nil
+	}
+	return "", errors.New("unknown lock mode " + mode)
+}
+
+// fileLock is held on a path by one session until it is released, the
+// session logs out or the lock expires. Advisory locks only keep other
+// sessions from taking conflicting locks, mandatory ones also from writing
+// to, moving or removing the path.
+type fileLock struct {
+	session   string
+	username  string
+	mode      LockMode
+	mandatory bool
+	expires   time.Time
+}
+
+// locks holds the locks on each path. They are only kept in memory, like
+// the sessions they are bound to.
+var locks = struct {
+	lock  sync.Mutex
+	paths map[string][]*fileLock
+}{paths: make(map[string][]*fileLock)}
+
+// lock [-s] [-m] [-f] [-t <ttl>] <path> - Lock a path for the session,
+// shared or exclusive and advisory or mandatory, for ttl or the default
+// when zero. Taking a lock again changes it. Admins may force a lock,
+// breaking those in the way
+func Lock(workingDir string, username string, sessionId string, path string, mode LockMode, mandatory bool, ttl time.Duration, force bool) (string, error) {
+	if force && !isAdmin(username) {
+		return "Only admins may steal locks.", nil
+	}
+	if ttl < 0 {
+		return "The lock time can't be negative.", nil
+	}
+	if ttl == 0 {
+		ttl = config.LockTTL
+	}
+	if ttl > config.LockMaxTTL {
+		ttl = config.LockMaxTTL
+	}
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if !pathExists(absPath) {
+		return "No such file or directory.", nil
+	}
+	// Reading is enough to keep others from writing, changing what is read
+	// takes being allowed to write. Admins stealing a lock need neither.
+	permission, err := database.Dao.CheckUserReadPermission(username, absPath)
+	if mode == ExclusiveLock && err == nil {
+		permission, err = database.Dao.CheckUserWritePermission(username, absPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !permission && !force {
+		return "You are not authorized to lock this object.", nil
+	}
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	held := make([]*fileLock, 0)
+	for _, other := range liveLocks(absPath) {
+		if other.session == sessionId {
+			continue
+		}
+		if !force && (mode == ExclusiveLock || other.mode == ExclusiveLock) {
+			return lockedMessage(other)
+		}
+		if mode == SharedLock && other.mode == SharedLock {
+			held = append(held, other)
+		}
+	}
+	expires := time.Now().Add(ttl)
+	locks.paths[absPath] = append(held, &fileLock{
+		session:   sessionId,
+		username:  username,
+		mode:      mode,
+		mandatory: mandatory,
+		expires:   expires,
+	})
+	return "Locked until " + expires.Format("2006-01-02 15:04:05") + ".", nil
+}
+
+// unlock [-f] <path> - Release the session's lock on a path. Admins may
+// force all locks on it to be released
+func Unlock(workingDir string, username string, sessionId string, path string, force bool) (string, error) {
+	if force && !isAdmin(username) {
+		return "Only admins may break locks.", nil
+	}
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	held := make([]*fileLock, 0)
+	released := false
+	for _, other := range liveLocks(absPath) {
+		if force || other.session == sessionId {
+			released = true
+			continue
+		}
+		held = append(held, other)
+	}
+	setLocks(absPath, held)
+	if !released {
+		return "You hold no lock on this object.", nil
+	}
+	return "Unlocked.", nil
+}
+
+// ReleaseLocks releases every lock the session holds, once it has ended.
+func ReleaseLocks(sessionId string) {
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	for path := range locks.paths {
+		held := make([]*fileLock, 0)
+		for _, other := range liveLocks(path) {
+			if other.session != sessionId {
+				held = append(held, other)
+			}
+		}
+		setLocks(path, held)
+	}
+}
+
+// checkLocks returns a message if another session holds a mandatory lock on
+// path, or with below on anything below it.
+func checkLocks(sessionId string, path string, below bool) (string, error) {
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	for lockedPath := range locks.paths {
+		if lockedPath != path && !(below && strings.HasPrefix(lockedPath, path+"/")) {
+			continue
+		}
+		for _, other := range liveLocks(lockedPath) {
+			if other.mandatory && other.session != sessionId {
+				return lockedMessage(other)
+			}
+		}
+	}
+	return "", nil
+}
+
+// moveLocks moves the locks on oldPath, and on everything below it, along
+// with the entries to newPath.
+func moveLocks(oldPath string, newPath string) {
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	moved := make(map[string][]*fileLock)
+	for path, held := range locks.paths {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			delete(locks.paths, path)
+			moved[newPath+strings.TrimPrefix(path, oldPath)] = held
+		}
+	}
+	for path, held := range moved {
+		locks.paths[path] = held
+	}
+}
+
+// dropLocks releases the locks on path and everything below it once they
+// are removed.
+func dropLocks(path string) {
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	for lockedPath := range locks.paths {
+		if lockedPath == path || strings.HasPrefix(lockedPath, path+"/") {
+			delete(locks.paths, lockedPath)
+		}
+	}
+}
+
+// liveLocks returns the locks on path that haven't expired, dropping those
+// that have. locks.lock must be held.
+func liveLocks(path string) []*fileLock {
+	live := make([]*fileLock, 0)
+	now := time.Now()
+	for _, held := range locks.paths[path] {
+		if held.expires.After(now) {
+			live = append(live, held)
+		}
+	}
+	setLocks(path, live)
+	return live
+}
+
+func setLocks(path string, held []*fileLock) {
+	if len(held) == 0 {
+		delete(locks.paths, path)
+		return
+	}
+	locks.paths[path] = held
+}
+
+func lockedMessage(held *fileLock) (string, error) {
+	username := held.username
+	if err := encryption.DecryptMany(&username); err != nil {
+		return "", err
+	}
+	kind := "advisory"
+	if held.mandatory {
+		kind = "mandatory"
+	}
+	return fmt.Sprintf("Locked by %s (%s, %s) until %s.", username, held.mode, kind, held.expires.Format("2006-01-02 15:04:05")), nil
+}
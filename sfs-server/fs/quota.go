@@ -0,0 +1,199 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrQuotaExceeded stops a write that would take its owner, or one of their
+// groups, over a hard limit.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quota - Show how much the user stores and the limits that apply to them
+// and their groups. Usage counts the size of the files they own, trashed ones
+// included until the trash is emptied, along with their older versions, the
+// files in snapshots and uploads in progress.
+func Quota(username string) (string, error) {
+	if err := encryption.EncryptMany(&username); err != nil {
+		return "", err
+	}
+	quotas, err := database.Dao.GetQuotas(username, config.UserQuotaSoft, config.UserQuotaHard)
+	if err != nil {
+		return "", err
+	}
+	lines := make([]string, 0)
+	for _, quota := range quotas {
+		if err := encryption.DecryptMany(&quota.Name); err != nil {
+			return "", err
+		}
+		kind := "user"
+		if quota.Group {
+			kind = "group"
+		}
+		line := fmt.Sprintf("%s %s: %s used, soft limit %s, hard limit %s", kind, quota.Name,
+			formatBytes(quota.Used), formatLimit(quota.Soft), formatLimit(quota.Hard))
+		if quota.Hard > 0 && quota.Used >= quota.Hard {
+			line += " (hard limit reached)"
+		} else if quota.Soft > 0 && quota.Used > quota.Soft {
+			line += " (over the soft limit)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// quota set [-g] <name> <soft> <hard> - Change the limits of a user, or
+// with isGroup a group. Only admins may do this, and limits of zero don't
+// apply.
+func SetQuota(username string, name string, isGroup bool, soft int64, hard int64) (string, error) {
+	if !isAdmin(username) {
+		return "You are not authorized to change quotas.", nil
+	}
+	if soft < 0 || hard < 0 {
+		return "Limits can't be negative.", nil
+	}
+	if hard > 0 && soft > hard {
+		return "The soft limit can't be above the hard limit.", nil
+	}
+	if err := encryption.EncryptMany(&name); err != nil {
+		return "", err
+	}
+	found, err := database.Dao.SetQuota(name, isGroup, soft, hard)
+	if err != nil {
+		return "", err
+	}
+	if !found && isGroup {
+		return "No such group.", nil
+	}
+	if !found {
+		return "No such user.", nil
+	}
+	return "Quota updated.", nil
+}
+
+func isAdmin(username string) bool {
+	for _, admin := range config.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// fileOwner returns the owner of path, or the already encrypted username
+// for paths without one.
+func fileOwner(username string, path string) (string, error) {
+	metadata, err := database.Dao.GetFileMetadata(path)
+	if err == sql.ErrNoRows {
+		return username, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return metadata.Owner, nil
+}
+
+// quotaRemaining returns how many more bytes owner may store before a hard
+// limit is reached, or -1 if no hard limit applies.
+func quotaRemaining(owner string) (int64, error) {
+	quotas, err := database.Dao.GetQuotas(owner, config.UserQuotaSoft, config.UserQuotaHard)
+	if err != nil {
+		return 0, err
+	}
+	remaining := int64(-1)
+	for _, quota := range quotas {
+		if quota.Hard <= 0 {
+			continue
+		}
+		left := quota.Hard - quota.Used
+		if left < 0 {
+			left = 0
+		}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining, nil
+}
+
+// quotaLimit returns how large the file at path, owned by owner, may grow,
+// or -1 if there is no limit. A file may always shrink or keep its size,
+// even when its owner is over their quota.
+func quotaLimit(owner string, path string) (int64, error) {
+	remaining, err := quotaRemaining(owner)
+	if err != nil || remaining < 0 || !pathExists(path) {
+		return remaining, err
+	}
+	size, err := contentSize(path)
+	return remaining + size, err
+}
+
+// quotaWarning returns a warning to add to the answer of a write if owner,
+// or one of their groups, is over a soft limit.
+func quotaWarning(owner string) (string, error) {
+	quotas, err := database.Dao.GetQuotas(owner, config.UserQuotaSoft, config.UserQuotaHard)
+	if err != nil {
+		return "", err
+	}
+	for _, quota := range quotas {
+		if quota.Soft <= 0 || quota.Used <= quota.Soft {
+			continue
+		}
+		if err := encryption.DecryptMany(&quota.Name); err != nil {
+			return "", err
+		}
+		kind := "User"
+		if quota.Group {
+			kind = "Group"
+		}
+		return fmt.Sprintf("\nWarning: %s %s is over its soft quota, %s used of %s.",
+			kind, quota.Name, formatBytes(quota.Used), formatBytes(quota.Soft)), nil
+	}
+	return "", nil
+}
+
+// recordSize stores the size of the file at path for the quotas of its
+// owner. Files count in full, even where their chunks are shared.
+func recordSize(path string) error {
+	size, err := contentSize(path)
+	if err != nil {
+		return err
+	}
+	return database.Dao.SetFileSize(path, size)
+}
+
+// contentSize returns the size of the decrypted contents of the file at
+// path, which is larger than the file itself if it holds a manifest.
+func contentSize(path string) (int64, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.Size(), nil
+}
+
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "none"
+	}
+	return formatBytes(limit)
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, prefix := float64(size)/unit, 0
+	for value >= unit && prefix < 3 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[prefix])
+}
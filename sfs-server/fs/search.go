@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxIndexedBytes is how much of a file is read to index or search it.
+	maxIndexedBytes = 16 << 20
+	// maxTokenLength leaves out runs of characters that aren't words.
+	maxTokenLength   = 64
+	maxSearchResults = 100
+	snippetContext   = 40
+)
+
+// token is a lower cased word and where it was found in a text.
+type token struct {
+	word  string
+	start int
+	end   int
+}
+
+// match is a file found by a search, with the path it is shown with.
+type match struct {
+	path    string
+	display string
+}
+
+// search <terms> - List the files the user may read that contain every one
+// of the terms, each with a snippet around the first match. Terms are
+// looked up in the search index of every user, which only holds keyed
+// hashes of the words in their files.
+func Search(username string, terms string) (string, error) {
+	words := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, t := range tokenize(terms) {
+		if !seen[t.word] {
+			seen[t.word] = true
+			words = append(words, t.word)
+		}
+	}
+	if len(words) == 0 {
+		return "Nothing to search for.", nil
+	}
+	if err := encryption.EncryptMany(&username); err != nil {
+		return "", err
+	}
+	owners, err := database.Dao.GetSearchOwners()
+	if err != nil {
+		return "", err
+	}
+	paths := make([]string, 0)
+	for _, owner := range owners {
+		hashes := make([]string, len(words))
+		for i, word := range words {
+			hashes[i] = encryption.TokenHash(owner, word)
+		}
+		found, err := database.Dao.SearchIndex(owner, hashes)
+		if err != nil {
+			return "", err
+		}
+		paths = append(paths, found...)
+	}
+	// Matches are ordered by the path shown before any are read, so only
+	// those shown are read for their snippets.
+	matches := make([]match, 0)
+	for _, path := range paths {
+		readable, err := database.Dao.CheckUserReadPermission(username, path)
+		if err != nil {
+			return "", err
+		}
+		if readable && pathExists(path) {
+			matches = append(matches, match{path: path, display: displayPath(username, path)})
+		}
+	}
+	if len(matches) == 0 {
+		return "No matches.", nil
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].display < matches[j].display })
+	truncated := len(matches) > maxSearchResults
+	if truncated {
+		matches = matches[:maxSearchResults]
+	}
+	results := make([]string, 0, len(matches)+1)
+	for _, m := range matches {
+		text, _, err := readText(m.path)
+		if err != nil {
+			return "", err
+		}
+		results = append(results, m.display+"\n    "+snippet(text, seen))
+	}
+	if truncated {
+		results = append(results, "Only the first matches are shown, try more terms.")
+	}
+	return strings.Join(results, "\n"), nil
+}
+
+// indexFile replaces the search tokens of the file at path, which must be
+// absolute, with those of its current contents. The tokens go to the index
+// of the file's owner, or of the already encrypted username for files
+// without one. Contents that aren't text aren't indexed.
+func indexFile(username string, path string) error {
+	owner, err := fileOwner(username, path)
+	if err != nil {
+		return err
+	}
+	text, isText, err := readText(path)
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, 0)
+	if isText {
+		seen := make(map[string]bool)
+		for _, t := range tokenize(text) {
+			hash := encryption.TokenHash(owner, t.word)
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return database.Dao.IndexFile(path, owner, hashes)
+}
+
+// indexTree indexes every file at or below path.
+func indexTree(username string, path string) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return indexFile(username, path)
+	})
+}
+
+// readText decrypts up to maxIndexedBytes of the file at path and tells
+// whether they are text.
+func readText(path string) (string, bool, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxIndexedBytes))
+	if err != nil {
+		return "", false, err
+	}
+	// The limit may have cut the last character short.
+	for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+	isText := utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+	return string(data), isText, nil
+}
+
+// tokenize splits text into lower cased words of letters and digits.
+func tokenize(text string) []token {
+	tokens := make([]token, 0)
+	start := -1
+	for i, r := range text + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			if i-start <= maxTokenLength {
+				tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			}
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// snippet returns the text around the first of words found in text, on a
+// single line.
+func snippet(text string, words map[string]bool) string {
+	for _, t := range tokenize(text) {
+		if !words[t.word] {
+			continue
+		}
+		start, end := t.start-snippetContext, t.end+snippetContext
+		prefix, suffix := "...", "..."
+		if start <= 0 {
+			start, prefix = 0, ""
+		}
+		if end >= len(text) {
+			end, suffix = len(text), ""
+		}
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+		return prefix + strings.Join(strings.Fields(text[start:end]), " ") + suffix
+	}
+	return ""
+}
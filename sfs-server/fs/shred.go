@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Every file's manifest is sealed with a data key of its own, kept in the
+// database wrapped with the server's key. Versions of a file are sealed with
+// its key too, while copies and snapshots get keys of their own. Once a file
+// and its versions are removed for good their key is destroyed, so what is
+// left of them on disk can't be read even with the server's key. Chunks are
+// keyed by their contents and the server's key instead, for deduplication,
+// so the chunks only they listed are overwritten as they are removed.
+// Files not written since data keys exist, and versions kept from before,
+// are still sealed with the server's key. Destroying keys does nothing for
+// them, only config.ShredOverwrite does.
+
+// ErrShredded is returned when reading contents whose key was destroyed.
+var ErrShredded = errors.New("the contents were shredded")
+
+// fileKey returns the data key the file at path is sealed with, giving it a
+// new one if it has none yet.
+func fileKey(path string) (*encryption.DataKey, error) {
+	stored, found, err := database.Dao.FindFileKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		key, err := encryption.NewDataKey()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := encryption.WrapKey(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		// Another write may have given the file a key in the meantime, in
+		// which case that one is kept.
+		stored, err = database.Dao.GetFileKey(path, database.DataKey{Id: key.Id, Wrapped: wrapped})
+		if err != nil {
+			return nil, err
+		}
+		if stored.Id == key.Id {
+			return key, nil
+		}
+	}
+	unwrapped, err := encryption.UnwrapKey(stored.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return &encryption.DataKey{Id: stored.Id, Key: unwrapped}, nil
+}
+
+// lookupKey finds the data keys contents are read with.
+func lookupKey(id string) ([]byte, error) {
+	wrapped, found, err := database.Dao.GetDataKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrShredded
+	}
+	return encryption.UnwrapKey(wrapped)
+}
+
+// destroyUnusedKeys destroys the data keys of files and versions removed for
+// good. It is called once what they sealed was removed, as removing version
+// blobs still reads them.
+func destroyUnusedKeys() error {
+	return database.Dao.RemoveUnusedDataKeys()
+}
+
+// removeStored removes the stored file at path, shredding it if
+// config.ShredOverwrite is set.
+func removeStored(path string) error {
+	if config.ShredOverwrite {
+		return shred(path)
+	}
+	return os.Remove(path)
+}
+
+// shred overwrites the stored file at path and removes it.
+func shred(path string) error {
+	if err := overwrite(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeStoredTree is removeStored for path and everything below it.
+func removeStoredTree(path string) error {
+	if config.ShredOverwrite {
+		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			return overwrite(path)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// overwrite replaces the contents of the file at path with random data of
+// the same length and waits for it to reach the disk.
+func overwrite(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// UserDeleted is the message DeleteUser answers with once the user is gone.
+const UserDeleted = "User deleted, everything they owned was shredded."
+
+// deluser <username> - Delete a user and shred everything they own: their
+// home directory, trash and snapshots, and their files elsewhere. Files
+// others own in their home directory are left. Users may delete themselves,
+// admins anyone
+func DeleteUser(username string, name string) (string, error) {
+	if name != username && !isAdmin(username) {
+		return "Only admins may delete other users.", nil
+	}
+	if err := encryption.EncryptMany(&username, &name); err != nil {
+		return "", err
+	}
+	exists, err := database.Dao.CheckUserExists(name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "No such user.", nil
+	}
+	paths, err := ownedPaths(name)
+	if err != nil {
+		return "", err
+	}
+	blobHashes := make([]string, 0)
+	chunkIds := make([]string, 0)
+	for _, path := range paths {
+		hashes, err := database.Dao.GetBlobHashesUnderPath(path)
+		if err != nil {
+			return "", err
+		}
+		blobHashes = append(blobHashes, hashes...)
+		if !pathExists(path) {
+			continue
+		}
+		ids, err := manifestChunksBelow(path)
+		if err != nil {
+			return "", err
+		}
+		chunkIds = append(chunkIds, ids...)
+	}
+	err = database.Dao.DeleteUser(name, paths, func() error {
+		for _, path := range paths {
+			if err := removeStoredTree(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		dropLocks(path)
+	}
+	if err := releaseChunks(chunkIds); err != nil {
+		return "", err
+	}
+	if err := removeUnreferencedBlobs(blobHashes); err != nil {
+		return "", err
+	}
+	if err := destroyUnusedKeys(); err != nil {
+		return "", err
+	}
+	if err := database.Dao.AddAuditEntry(username, "deluser", HomeDir+name, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return UserDeleted, nil
+}
+
+// ownedPaths returns the paths of the already encrypted username's trash
+// and snapshots, of their home directory unless others own files in it, and
+// of the files they own elsewhere. Directories they made elsewhere are left,
+// as others may keep files in them.
+func ownedPaths(username string) ([]string, error) {
+	paths := []string{TrashDir + username, SnapshotDir + username}
+	shared, err := database.Dao.CheckOthersOwnBelow(username, HomeDir+username)
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		paths = append(paths, HomeDir+username)
+	}
+	owned, err := database.Dao.GetOwnedPaths(username)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range owned {
+		if info, err := os.Stat(path); err != nil || info.IsDir() || below(path, paths) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// below tells whether path is one of dirs or below one of them.
+func below(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,548 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SnapshotDir holds one directory per user with copies of their home
+// directory. Files in a snapshot share their chunks with the files they were
+// copied from, so a snapshot only takes up space for its manifests, though
+// they count against quotas in full. Like the trash it lives outside
+// HomeDir, snapshots are browsed with cd @name.
+const SnapshotDir = "/home/ubuntu/ECE_422_Project_1/snapshots/"
+
+// autoSnapshotPrefix starts the names of scheduled snapshots, which are the
+// only ones dropped to keep their number down.
+const autoSnapshotPrefix = "auto-"
+
+const snapshotReadOnly = "Snapshots are read-only."
+
+// snapshot create <name> - Take a snapshot of the user's home directory,
+// with the names, permissions and checksums of everything in it
+func CreateSnapshot(username string, name string) (string, error) {
+	name = strings.TrimPrefix(name, "@")
+	if message := checkSnapshotName(name); message != "" {
+		return message, nil
+	}
+	if strings.HasPrefix(name, autoSnapshotPrefix) {
+		return "Names starting with " + autoSnapshotPrefix + " are kept for scheduled snapshots.", nil
+	}
+	homeDir, err := GetHomeDir(username)
+	if err != nil {
+		return "", err
+	}
+	if err := encryption.EncryptMany(&username, &name); err != nil {
+		return "", err
+	}
+	snapshot, err := findSnapshot(username, name)
+	if err != nil {
+		return "", err
+	}
+	if snapshot != nil {
+		return "A snapshot with this name exists already.", nil
+	}
+	taken, err := filterSnapshots(username, false)
+	if err != nil {
+		return "", err
+	}
+	if len(taken) >= config.SnapshotMaxCount {
+		return fmt.Sprintf("You can keep at most %d snapshots, remove one first.", config.SnapshotMaxCount), nil
+	}
+	fits, err := snapshotFits(username, homeDir)
+	if err != nil {
+		return "", err
+	}
+	if !fits {
+		return "Snapshot rejected, it would exceed your quota.", nil
+	}
+	if err := takeSnapshot(username, name, homeDir); err != nil {
+		return "", err
+	}
+	return "Snapshot created.", nil
+}
+
+// snapshot ls - List the user's snapshots, oldest first
+func ListSnapshots(username string) (string, error) {
+	if err := encryption.EncryptMany(&username); err != nil {
+		return "", err
+	}
+	snapshots, err := database.Dao.GetSnapshots(username)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "No snapshots.", nil
+	}
+	result := make([]string, 0)
+	for _, snapshot := range snapshots {
+		if err := encryption.DecryptMany(&snapshot.Name); err != nil {
+			return "", err
+		}
+		createdAt := time.Unix(snapshot.CreatedAt, 0).Format("2006-01-02 15:04:05")
+		result = append(result, createdAt+"\t@"+snapshot.Name)
+	}
+	return strings.Join(result, "\n"), nil
+}
+
+// snapshot rm <name> - Delete a snapshot
+func RemoveSnapshot(username string, name string) (string, error) {
+	name = strings.TrimPrefix(name, "@")
+	if message := checkSnapshotName(name); message != "" {
+		return message, nil
+	}
+	if err := encryption.EncryptMany(&username, &name); err != nil {
+		return "", err
+	}
+	snapshot, err := findSnapshot(username, name)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil {
+		return "No such snapshot.", nil
+	}
+	if err := removeSnapshot(*snapshot); err != nil {
+		return "", err
+	}
+	return "Snapshot removed.", nil
+}
+
+// snapshot restore <name> [path] - Copy a path, relative to the home
+// directory, back from a snapshot, or the whole home directory without a
+// path. Entries that are replaced are moved to the trash first.
+func RestoreSnapshot(username string, sessionId string, name string, path string) (string, error) {
+	name = strings.TrimPrefix(name, "@")
+	if message := checkSnapshotName(name); message != "" {
+		return message, nil
+	}
+	homeDir, err := GetHomeDir(username)
+	if err != nil {
+		return "", err
+	}
+	path = strings.Trim(filepath.Clean("/"+strings.TrimPrefix(path, "~")), "/")
+	if err := encryption.EncryptMany(&username, &name); err != nil {
+		return "", err
+	}
+	if path != "" {
+		if err := encryption.EncryptMany(&path); err != nil {
+			return "", err
+		}
+	}
+	snapshot, err := findSnapshot(username, name)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil {
+		return "No such snapshot.", nil
+	}
+	// Whole trees are restored entry by entry, and everything in the home
+	// directory is replaced.
+	restored := []string{path}
+	replaced := []string{path}
+	if path == "" {
+		if restored, err = dirEntries(snapshot.Path); err != nil {
+			return "", err
+		}
+		if replaced, err = dirEntries(homeDir); err != nil {
+			return "", err
+		}
+	}
+	for _, entry := range restored {
+		if !pathExists(filepath.Join(snapshot.Path, entry)) {
+			return "No such path in the snapshot.", nil
+		}
+		dstDir := filepath.Dir(filepath.Join(homeDir, entry))
+		if !pathExists(dstDir) {
+			return "The directory to restore into no longer exists.", nil
+		}
+		permission, err := database.Dao.CheckUserWritePermission(username, dstDir)
+		if err != nil {
+			return "", err
+		}
+		if !permission {
+			return "You are not authorized to write to the directory to restore into.", nil
+		}
+	}
+	for _, entry := range replaced {
+		dst := filepath.Join(homeDir, entry)
+		if !pathExists(dst) {
+			continue
+		}
+		permission, err := database.Dao.CheckUserWritePermission(username, dst)
+		if err != nil {
+			return "", err
+		}
+		if !permission {
+			return "You are not authorized to replace " + displayPath(username, dst) + ".", nil
+		}
+		message, err := checkLocks(sessionId, dst, true)
+		if err != nil || message != "" {
+			return message, err
+		}
+	}
+	size := int64(0)
+	for _, entry := range restored {
+		entrySize, err := treeSize(filepath.Join(snapshot.Path, entry))
+		if err != nil {
+			return "", err
+		}
+		size += entrySize
+	}
+	remaining, err := quotaRemaining(username)
+	if err != nil {
+		return "", err
+	}
+	if remaining >= 0 && size > remaining {
+		return "Restore rejected, it would exceed your quota.", nil
+	}
+	trashed := false
+	for _, entry := range replaced {
+		if dst := filepath.Join(homeDir, entry); pathExists(dst) {
+			if err := moveToTrash(username, dst); err != nil {
+				return "", err
+			}
+			trashed = true
+		}
+	}
+	for _, entry := range restored {
+		if err := restoreEntry(username, filepath.Join(snapshot.Path, entry), filepath.Join(homeDir, entry)); err != nil {
+			return "", err
+		}
+	}
+	if trashed {
+		return "Restored, what it replaced was moved to the trash.", nil
+	}
+	return "Restored.", nil
+}
+
+// SnapshotSchedule snapshots every home directory once every snapshot
+// interval, keeping the configured number of scheduled snapshots per user.
+func SnapshotSchedule() {
+	if config.SnapshotInterval <= 0 {
+		return
+	}
+	time.AfterFunc(config.SnapshotInterval, func() {
+		if err := takeScheduledSnapshots(); err != nil {
+			log.Println(fmt.Errorf("error thrown: %w", err))
+		}
+		SnapshotSchedule()
+	})
+}
+
+// takeScheduledSnapshots snapshots every home directory, logging the users
+// whose snapshot failed rather than skipping the rest.
+func takeScheduledSnapshots() error {
+	usernames, err := database.Dao.GetUsernames()
+	if err != nil {
+		return err
+	}
+	name := autoSnapshotPrefix + time.Now().Format("2006-01-02-150405")
+	if err := encryption.EncryptMany(&name); err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if err := takeScheduledSnapshot(username, name); err != nil {
+			log.Println(fmt.Errorf("error thrown: %w", err))
+		}
+	}
+	return nil
+}
+
+func takeScheduledSnapshot(username string, name string) error {
+	plainUsername := username
+	if err := encryption.DecryptMany(&plainUsername); err != nil {
+		return err
+	}
+	homeDir, err := GetHomeDir(plainUsername)
+	if err != nil {
+		return err
+	}
+	fits, err := snapshotFits(username, homeDir)
+	if err != nil {
+		return err
+	}
+	if !fits {
+		return errors.New("scheduled snapshot of " + plainUsername + " skipped, it would exceed the quota")
+	}
+	if err := takeSnapshot(username, name, homeDir); err != nil {
+		return err
+	}
+	return applySnapshotRetention(username)
+}
+
+// applySnapshotRetention drops the oldest scheduled snapshots of username
+// beyond the configured count.
+func applySnapshotRetention(username string) error {
+	scheduled, err := filterSnapshots(username, true)
+	if err != nil {
+		return err
+	}
+	for len(scheduled) > config.SnapshotRetentionCount {
+		if err := removeSnapshot(scheduled[0]); err != nil {
+			return err
+		}
+		scheduled = scheduled[1:]
+	}
+	return nil
+}
+
+// filterSnapshots returns the scheduled snapshots of the already encrypted
+// username, or the others, oldest first.
+func filterSnapshots(username string, scheduled bool) ([]database.Snapshot, error) {
+	snapshots, err := database.Dao.GetSnapshots(username)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]database.Snapshot, 0)
+	for _, snapshot := range snapshots {
+		name := snapshot.Name
+		if err := encryption.DecryptMany(&name); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, autoSnapshotPrefix) == scheduled {
+			filtered = append(filtered, snapshot)
+		}
+	}
+	return filtered, nil
+}
+
+// snapshotFits returns whether a snapshot of homeDir, which counts against
+// the quota like the files in it, fits in what is left of the quota of the
+// already encrypted username.
+func snapshotFits(username string, homeDir string) (bool, error) {
+	size, err := treeSize(homeDir)
+	if err != nil {
+		return false, err
+	}
+	remaining, err := quotaRemaining(username)
+	if err != nil {
+		return false, err
+	}
+	return remaining < 0 || size <= remaining, nil
+}
+
+// takeSnapshot copies homeDir into a snapshot called name of the already
+// encrypted username.
+func takeSnapshot(username string, name string, homeDir string) error {
+	userDir := SnapshotDir + username
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return err
+	}
+	// The tree is copied first, as copies take references to chunks, and
+	// dropped again if it can't be recorded.
+	path := userDir + "/" + name
+	if pathExists(path) {
+		return errors.New("snapshot exists already")
+	}
+	err := copyTree(homeDir, path)
+	if err == nil {
+		err = database.Dao.AddSnapshot(username, name, homeDir, path, time.Now().Unix())
+	}
+	if err != nil {
+		discardTree(path)
+	}
+	return err
+}
+
+func removeSnapshot(snapshot database.Snapshot) error {
+	chunkIds, err := manifestChunksBelow(snapshot.Path)
+	if err != nil {
+		return err
+	}
+	err = database.Dao.RemoveSnapshot(snapshot, func() error {
+		return removeStoredTree(snapshot.Path)
+	})
+	if err != nil {
+		return err
+	}
+	if err := releaseChunks(chunkIds); err != nil {
+		return err
+	}
+	return destroyUnusedKeys()
+}
+
+// restoreEntry copies the entry at src in a snapshot to dst, along with its
+// permissions, checksums and metadata.
+func restoreEntry(username string, src string, dst string) error {
+	err := copyTree(src, dst)
+	if err == nil {
+		err = database.Dao.CopyFilePath(src, dst)
+	}
+	if err != nil {
+		discardTree(dst)
+		return err
+	}
+	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return recordSize(path)
+	})
+	if err != nil {
+		return err
+	}
+	if err := indexTree(username, dst); err != nil {
+		return err
+	}
+	return database.Dao.AddAuditEntry(username, "restore", dst, time.Now().Unix())
+}
+
+// findSnapshot returns the snapshot called name of username, both already
+// encrypted, or nil if there is none.
+func findSnapshot(username string, name string) (*database.Snapshot, error) {
+	snapshots, err := database.Dao.GetSnapshots(username)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return &snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+func checkSnapshotName(name string) string {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "Invalid snapshot name."
+	}
+	return ""
+}
+
+// snapshotPath resolves dir, a path starting with @ and the name of a
+// snapshot of username, to where it is stored.
+func snapshotPath(username string, dir string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(dir, "@"), "/", 2)
+	name, rest := parts[0], ""
+	if len(parts) > 1 {
+		rest = parts[1]
+	}
+	if err := encryption.EncryptMany(&username, &name); err != nil {
+		return "", err
+	}
+	if rest != "" {
+		if err := encryption.EncryptMany(&rest); err != nil {
+			return "", err
+		}
+	}
+	snapshot, err := findSnapshot(username, name)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil {
+		return "", errors.New("no such snapshot")
+	}
+	return filepath.Join(snapshot.Path, rest), nil
+}
+
+// inSnapshot tells whether path, which must be absolute, is in a snapshot,
+// where nothing may be changed.
+func inSnapshot(path string) bool {
+	return strings.HasPrefix(path, SnapshotDir)
+}
+
+// snapshotDisplayPath shows a path in a snapshot as @name followed by the
+// decrypted path within it.
+func snapshotDisplayPath(path string) string {
+	// The path starts with the user's directory, then the snapshot's.
+	parts := strings.SplitN(strings.TrimPrefix(path, SnapshotDir), "/", 3)
+	if len(parts) < 2 {
+		return path
+	}
+	display := parts[1]
+	if len(parts) == 3 {
+		display += "/" + parts[2]
+	}
+	if err := encryption.DecryptPath(&display); err != nil {
+		return path
+	}
+	return "@" + display
+}
+
+// copyTree copies the file or directory at src to dst, which must not exist
+// yet. Copied files share their chunks with those they were copied from, but
+// are sealed with keys of their own.
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), tempFilePrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := dst + strings.TrimPrefix(path, src)
+		if info.IsDir() {
+			return os.Mkdir(target, os.ModeDir)
+		}
+		key, err := fileKey(target)
+		if err != nil {
+			return err
+		}
+		return copyStored(path, target, key)
+	})
+}
+
+// discardTree removes what a failed copyTree left at path, gives up the
+// chunks of its files and destroys their keys.
+func discardTree(path string) error {
+	if !pathExists(path) {
+		return nil
+	}
+	chunkIds, err := manifestChunksBelow(path)
+	if err != nil {
+		return err
+	}
+	if err := removeStoredTree(path); err != nil {
+		return err
+	}
+	if err := releaseChunks(chunkIds); err != nil {
+		return err
+	}
+	if err := database.Dao.RemoveFileKeys(path); err != nil {
+		return err
+	}
+	return destroyUnusedKeys()
+}
+
+// treeSize adds up the sizes of the contents of every file at or below
+// path.
+func treeSize(path string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		fileSize, err := contentSize(path)
+		size += fileSize
+		return err
+	})
+	return size, err
+}
+
+// dirEntries returns the names of the entries in dir, leaving out
+// temporary files.
+func dirEntries(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), tempFilePrefix) {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,352 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ChecksumOk       = "ok"
+	ChecksumMismatch = "mismatch"
+	ChecksumMissing  = "missing"
+)
+
+// FileInfo describes a file or directory. Entries the user has no access to
+// keep their encrypted name and only show what can be seen on disk.
+type FileInfo struct {
+	Name string `json:"name"`
+	// Path is relative to the listed directory, and differs from Name in
+	// recursive listings.
+	Path        string   `json:"path"`
+	IsDir       bool     `json:"dir"`
+	Size        int64    `json:"size"`
+	Owner       string   `json:"owner,omitempty"`
+	Group       string   `json:"group,omitempty"`
+	Acl         []string `json:"acl,omitempty"`
+	Created     int64    `json:"created,omitempty"`
+	Modified    int64    `json:"modified"`
+	Checksum    string   `json:"checksum,omitempty"`
+	Compression string   `json:"compression,omitempty"`
+	ETag        string   `json:"etag,omitempty"`
+	Encrypted   bool     `json:"encrypted,omitempty"`
+	// Link is the target of links, as it was given.
+	Link string `json:"link,omitempty"`
+}
+
+// ListOptions select and order the entries of a listing. Sort is "name",
+// "size" or "modified", and a Limit of zero lists everything from Offset on.
+type ListOptions struct {
+	All       bool
+	Recursive bool
+	Sort      string
+	Reverse   bool
+	Offset    int
+	Limit     int
+	// Tags leaves out the entries that don't match every filter.
+	Tags []TagFilter
+}
+
+// Listing is one page of a directory listing, with the number of entries on
+// all pages.
+type Listing struct {
+	Entries []FileInfo `json:"entries"`
+	Total   int        `json:"total"`
+}
+
+// stat - Describe a file or directory, including whether its contents still
+// match the checksum taken when they were written
+func Stat(workingDir string, username string, path string) (*FileInfo, string, error) {
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return nil, "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return nil, "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, "No such file or directory.", nil
+	}
+	permission, err := database.Dao.CheckUserPermission(username, absPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !permission {
+		return nil, "You are not authorized to access this file.", nil
+	}
+	name := filepath.Base(absPath)
+	if err := encryption.DecryptMany(&name); err != nil {
+		return nil, "", err
+	}
+	fileInfo, err := describe(absPath, name, info, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		fileInfo.ETag = etag(absPath)
+		if fileInfo.Checksum, err = checksumStatus(absPath); err != nil {
+			return nil, "", err
+		}
+		if fileInfo.Compression, err = fileCompression(absPath); err != nil {
+			return nil, "", err
+		}
+	}
+	return fileInfo, "", nil
+}
+
+// ls - List the directory at path, or the current one if path is empty
+func List(workingDir string, username string, path string, options ListOptions) (*Listing, string, error) {
+	// The current directory is listed without checking it, like ls always
+	// did.
+	checkDir := path != ""
+	if !checkDir {
+		path = "."
+	}
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return nil, "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return nil, "", err
+	}
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if options.Tags, err = encryptTagFilters(options.Tags); err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, "No such file or directory.", nil
+	}
+	if checkDir {
+		permission, err := database.Dao.CheckUserPermission(username, dir)
+		if err != nil {
+			return nil, "", err
+		}
+		if !permission {
+			return nil, "You are not authorized to access this directory.", nil
+		}
+	}
+	entries := make([]FileInfo, 0)
+	if info.IsDir() {
+		entries, err = listDir(username, dir, "", options)
+	} else {
+		// Like ls, a file is listed on its own.
+		name := filepath.Base(dir)
+		if err := encryption.DecryptMany(&name); err != nil {
+			return nil, "", err
+		}
+		var entry *FileInfo
+		var matches bool
+		if entry, err = describe(dir, name, info, true); err == nil {
+			matches, err = hasTags(dir, options.Tags)
+		}
+		if err == nil && matches {
+			entries = append(entries, *entry)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	sortEntries(entries, options)
+	listing := &Listing{Total: len(entries)}
+	if options.Offset > len(entries) {
+		options.Offset = len(entries)
+	}
+	entries = entries[options.Offset:]
+	if options.Limit > 0 && options.Limit < len(entries) {
+		entries = entries[:options.Limit]
+	}
+	listing.Entries = entries
+	return listing, "", nil
+}
+
+// listDir describes the entries of dir, whose path relative to the listed
+// directory is relDir, and those below them when listing recursively.
+func listDir(username string, dir string, relDir string, options ListOptions) ([]FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]FileInfo, 0)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), tempFilePrefix) {
+			continue
+		}
+		absPath := filepath.Join(dir, f.Name())
+		permission, err := database.Dao.CheckUserPermission(username, absPath)
+		if err != nil {
+			return nil, err
+		}
+		name := f.Name()
+		if permission {
+			// Names that don't decrypt aren't entries of SFS.
+			if encryption.DecryptMany(&name) != nil {
+				continue
+			}
+			if !options.All && strings.HasPrefix(name, ".") {
+				continue
+			}
+		}
+		entry, err := describe(absPath, name, f, permission)
+		if err != nil {
+			return nil, err
+		}
+		if relDir != "" {
+			entry.Path = relDir + "/" + name
+		}
+		// Tags are only compared for entries the user may access, while
+		// recursive listings go on below directories that don't match.
+		matches := len(options.Tags) == 0
+		if permission && !matches {
+			if matches, err = hasTags(absPath, options.Tags); err != nil {
+				return nil, err
+			}
+		}
+		if matches {
+			entries = append(entries, *entry)
+		}
+		if options.Recursive && permission && f.IsDir() {
+			below, err := listDir(username, absPath, entry.Path, options)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, below...)
+		}
+	}
+	return entries, nil
+}
+
+// describe builds the FileInfo of the entry at path. Owner, group, ACL and
+// the decrypted size are only looked up for entries the user may access.
+func describe(path string, name string, info os.FileInfo, permission bool) (*FileInfo, error) {
+	fileInfo := &FileInfo{
+		Name:      name,
+		Path:      name,
+		IsDir:     info.IsDir(),
+		Size:      info.Size(),
+		Modified:  info.ModTime().Unix(),
+		Encrypted: !permission,
+	}
+	if !permission {
+		return fileInfo, nil
+	}
+	if !info.IsDir() {
+		file, err := openFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileInfo.Size = file.Size()
+		file.Close()
+		if fileInfo.Link, err = readLink(path); err != nil {
+			return nil, err
+		}
+	}
+	metadata, err := database.Dao.GetFileMetadata(path)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		fileInfo.Owner = metadata.Owner
+		fileInfo.Created = metadata.CreatedAt
+		if err := encryption.DecryptMany(&fileInfo.Owner); err != nil {
+			return nil, err
+		}
+	}
+	acl, err := database.Dao.GetFileAcl(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range acl {
+		access := ""
+		if entry.Read {
+			access += "r"
+		}
+		if entry.Write {
+			access += "w"
+		}
+		if access == "" {
+			access = "-"
+		}
+		if entry.User.Valid {
+			user := entry.User.String
+			if err := encryption.DecryptMany(&user); err != nil {
+				return nil, err
+			}
+			fileInfo.Acl = append(fileInfo.Acl, "user:"+user+" "+access)
+		} else if entry.Group.Valid {
+			group := entry.Group.String
+			if err := encryption.DecryptMany(&group); err != nil {
+				return nil, err
+			}
+			if fileInfo.Group == "" {
+				fileInfo.Group = group
+			}
+			fileInfo.Acl = append(fileInfo.Acl, "group:"+group+" "+access)
+		}
+	}
+	return fileInfo, nil
+}
+
+// checksumStatus compares the contents of the file at path with the
+// checksum stored for them.
+func checksumStatus(path string) (string, error) {
+	_, status, err := storedChecksum(path)
+	return status, err
+}
+
+// storedChecksum returns the checksum stored for the file at path, in hex,
+// along with how the stored contents compare to it.
+func storedChecksum(path string) (string, string, error) {
+	stored, err := database.Dao.GetCheckSum(path)
+	if err != nil {
+		return "", ChecksumMissing, nil
+	}
+	actual, err := encryption.CheckSum(path)
+	if err != nil {
+		return "", "", err
+	}
+	if string(actual) != stored {
+		return "", ChecksumMismatch, nil
+	}
+	return hex.EncodeToString(actual), ChecksumOk, nil
+}
+
+func sortEntries(entries []FileInfo, options ListOptions) {
+	less := func(a FileInfo, b FileInfo) bool {
+		return a.Path < b.Path
+	}
+	switch options.Sort {
+	case "size":
+		less = func(a FileInfo, b FileInfo) bool {
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+			return a.Path < b.Path
+		}
+	case "modified":
+		less = func(a FileInfo, b FileInfo) bool {
+			if a.Modified != b.Modified {
+				return a.Modified > b.Modified
+			}
+			return a.Path < b.Path
+		}
+	}
+	sort.SliceStable(entries, func(i int, j int) bool {
+		if options.Reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
@@ -0,0 +1,217 @@
+package fs
+
+import (
+	"../database"
+	"../encryption"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TagFilter selects entries with the tag Key, set to Value unless Value is
+// empty, in which case any value will do.
+type TagFilter struct {
+	Key   string
+	Value string
+}
+
+// ParseTagFilters reads filters separated by commas, each either a key or
+// of the form key=value.
+func ParseTagFilters(spec string) ([]TagFilter, error) {
+	filters := make([]TagFilter, 0)
+	if spec == "" {
+		return filters, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if parts[0] == "" {
+			return nil, errors.New("invalid tag filter " + entry)
+		}
+		filter := TagFilter{Key: parts[0]}
+		if len(parts) == 2 {
+			filter.Value = parts[1]
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// tag set <path> <key> <value> - Set a tag of a file or directory, replacing
+// the value it had
+func SetTag(workingDir string, username string, path string, key string, value string) (string, error) {
+	if key == "" || strings.ContainsAny(key, "=,") {
+		return "Tag keys can't be empty or contain = or commas.", nil
+	}
+	if value == "" {
+		return "Tags need a value.", nil
+	}
+	absPath, message, err := tagPath(workingDir, username, path, true)
+	if err != nil || message != "" {
+		return message, err
+	}
+	if err := encryption.EncryptPath(&key); err != nil {
+		return "", err
+	}
+	if err := encryption.EncryptPath(&value); err != nil {
+		return "", err
+	}
+	if err := database.Dao.SetTag(absPath, key, value); err != nil {
+		return "", err
+	}
+	return "Done.", nil
+}
+
+// tag get <path> <key> - Show the value of a tag of a file or directory
+func GetTag(workingDir string, username string, path string, key string) (string, error) {
+	absPath, message, err := tagPath(workingDir, username, path, false)
+	if err != nil || message != "" {
+		return message, err
+	}
+	tags, err := readTags(absPath)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag.Value, nil
+		}
+	}
+	return "No such tag.", nil
+}
+
+// tag rm <path> <key> - Remove a tag of a file or directory
+func RemoveTag(workingDir string, username string, path string, key string) (string, error) {
+	absPath, message, err := tagPath(workingDir, username, path, true)
+	if err != nil || message != "" {
+		return message, err
+	}
+	if err := encryption.EncryptPath(&key); err != nil {
+		return "", err
+	}
+	removed, err := database.Dao.RemoveTag(absPath, key)
+	if err != nil {
+		return "", err
+	}
+	if !removed {
+		return "No such tag.", nil
+	}
+	return "Done.", nil
+}
+
+// tag list <path> - Show every tag of a file or directory as key=value
+func ListTags(workingDir string, username string, path string) (string, error) {
+	absPath, message, err := tagPath(workingDir, username, path, false)
+	if err != nil || message != "" {
+		return message, err
+	}
+	tags, err := readTags(absPath)
+	if err != nil {
+		return "", err
+	}
+	if len(tags) == 0 {
+		return "No tags.", nil
+	}
+	lines := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		lines = append(lines, tag.Key+"="+tag.Value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// tagPath returns the absolute path of the entry whose tags are asked for,
+// or a message if it doesn't exist or the user may not read it, or with
+// write change its tags.
+func tagPath(workingDir string, username string, path string, write bool) (string, string, error) {
+	if err := encryption.EncryptMany(&username, &path); err != nil {
+		return "", "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	if !pathExists(absPath) {
+		return "", "No such file or directory.", nil
+	}
+	if write && inSnapshot(absPath) {
+		return "", snapshotReadOnly, nil
+	}
+	var permission bool
+	if write {
+		permission, err = database.Dao.CheckUserWritePermission(username, absPath)
+	} else {
+		permission, err = database.Dao.CheckUserReadPermission(username, absPath)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !permission {
+		return "", "You are not authorized to access the tags of this object.", nil
+	}
+	return absPath, "", nil
+}
+
+// readTags returns the decrypted tags of path, ordered by key.
+func readTags(path string) ([]database.Tag, error) {
+	tags, err := database.Dao.GetTags(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tags {
+		if err := encryption.DecryptPath(&tags[i].Key); err != nil {
+			return nil, err
+		}
+		if err := encryption.DecryptPath(&tags[i].Value); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags, nil
+}
+
+// hasTags returns whether the entry at path matches every filter, which
+// are encrypted like the tags they are compared with.
+func hasTags(path string, filters []TagFilter) (bool, error) {
+	if len(filters) == 0 {
+		return true, nil
+	}
+	tags, err := database.Dao.GetTags(path)
+	if err != nil {
+		return false, err
+	}
+	for _, filter := range filters {
+		found := false
+		for _, tag := range tags {
+			if tag.Key == filter.Key && (filter.Value == "" || tag.Value == filter.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// encryptTagFilters returns the filters with their keys and values encrypted,
+// so they can be compared with stored tags.
+func encryptTagFilters(filters []TagFilter) ([]TagFilter, error) {
+	encrypted := make([]TagFilter, 0, len(filters))
+	for _, filter := range filters {
+		if err := encryption.EncryptPath(&filter.Key); err != nil {
+			return nil, err
+		}
+		if filter.Value != "" {
+			if err := encryption.EncryptPath(&filter.Value); err != nil {
+				return nil, err
+			}
+		}
+		encrypted = append(encrypted, filter)
+	}
+	return encrypted, nil
+}
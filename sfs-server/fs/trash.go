@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TrashDir holds one directory per user with the entries they removed. It
+// lives outside HomeDir so trashed entries can't be reached with cd.
+const TrashDir = "/home/ubuntu/ECE_422_Project_1/trash/"
+
+// trash ls - List the entries in the user's trash
+func TrashLs(username string) (string, error) {
+	if err := encryption.EncryptMany(&username); err != nil {
+		return "", err
+	}
+	items, err := database.Dao.GetTrashItems(username)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "Trash is empty.", nil
+	}
+	result := make([]string, 0)
+	for _, item := range items {
+		deletedAt := time.Unix(item.DeletedAt, 0).Format("2006-01-02 15:04:05")
+		result = append(result, deletedAt+"\t"+displayPath(username, item.OriginalPath))
+	}
+	return strings.Join(result, "\n"), nil
+}
+
+// trash restore <path> - Move the most recently removed entry at path back
+// to where it was removed from
+func TrashRestore(workingDir string, username string, path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		rest := strings.TrimPrefix(path, "~")
+		if rest != "" {
+			if err := encryption.EncryptMany(&rest); err != nil {
+				return "", err
+			}
+		}
+		homeDir, err := GetHomeDir(username)
+		if err != nil {
+			return "", err
+		}
+		path = homeDir + rest
+	} else if err := encryption.EncryptMany(&path); err != nil {
+		return "", err
+	}
+	if err := encryption.EncryptMany(&username); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	items, err := database.Dao.GetTrashItems(username)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range items {
+		if item.OriginalPath != absPath {
+			continue
+		}
+		if pathExists(item.OriginalPath) {
+			return "Something already exists at the original location.", nil
+		}
+		if !pathExists(filepath.Dir(item.OriginalPath)) {
+			return "The original location no longer exists.", nil
+		}
+		permission, err := database.Dao.CheckUserWritePermission(username, filepath.Dir(item.OriginalPath))
+		if err != nil {
+			return "", err
+		}
+		if !permission {
+			return "You are not authorized to write to the original location", nil
+		}
+		err = database.Dao.RestoreTrashItem(item, func() error {
+			return os.Rename(item.TrashPath, item.OriginalPath)
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := indexTree(username, item.OriginalPath); err != nil {
+			return "", err
+		}
+		return "Restored.", nil
+	}
+	return "No such entry in the trash.", nil
+}
+
+// trash empty - Permanently delete everything in the user's trash
+func TrashEmpty(username string) (string, error) {
+	if err := encryption.EncryptMany(&username); err != nil {
+		return "", err
+	}
+	items, err := database.Dao.GetTrashItems(username)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range items {
+		if err := purgeTrashItem(item); err != nil {
+			return "", err
+		}
+	}
+	return "Trash emptied.", nil
+}
+
+// PurgeTrash permanently deletes every trashed entry older than the
+// configured retention period. Entries that fail to be deleted are logged
+// and tried again on the next purge, without holding up the others.
+func PurgeTrash() error {
+	deletedBefore := time.Now().Add(-config.TrashRetention).Unix()
+	items, err := database.Dao.GetExpiredTrashItems(deletedBefore)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := purgeTrashItem(item); err != nil {
+			log.Println(fmt.Errorf("error thrown: %w", err))
+		}
+	}
+	return nil
+}
+
+// TrashGC purges expired trash now and then again every purge interval.
+func TrashGC() {
+	if err := PurgeTrash(); err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+	}
+	time.AfterFunc(config.TrashPurgeInterval, TrashGC)
+}
+
+// moveToTrash moves path, which must be absolute, into the trash of the
+// already encrypted username, keeping its permissions and checksums.
+func moveToTrash(username string, path string) error {
+	userTrashDir := TrashDir + username
+	if err := os.MkdirAll(userTrashDir, 0700); err != nil {
+		return err
+	}
+	now := time.Now()
+	trashPath := filepath.Join(userTrashDir, fmt.Sprintf("%d-%s", now.UnixNano(), filepath.Base(path)))
+	return database.Dao.TrashPath(username, path, trashPath, now.Unix(), func() error {
+		return os.Rename(path, trashPath)
+	})
+}
+
+func purgeTrashItem(item database.TrashItem) error {
+	blobHashes, err := database.Dao.GetBlobHashesUnderPath(item.TrashPath)
+	if err != nil {
+		return err
+	}
+	chunkIds, err := manifestChunksBelow(item.TrashPath)
+	if err != nil {
+		return err
+	}
+	err = database.Dao.RemoveTrashItem(item, func() error {
+		return removeStoredTree(item.TrashPath)
+	})
+	if err != nil {
+		return err
+	}
+	if err := releaseChunks(chunkIds); err != nil {
+		return err
+	}
+	if err := removeUnreferencedBlobs(blobHashes); err != nil {
+		return err
+	}
+	return destroyUnusedKeys()
+}
+
+// displayPath decrypts the names in an absolute path below HomeDir, showing
+// paths inside the user's own home relative to ~.
+func displayPath(username string, path string) string {
+	homeDir := HomeDir + username
+	rest := strings.TrimPrefix(path, HomeDir)
+	prefix := "/"
+	if path == homeDir || strings.HasPrefix(path, homeDir+"/") {
+		rest = strings.TrimPrefix(path, homeDir)
+		prefix = "~"
+	}
+	if err := encryption.DecryptPath(&rest); err != nil {
+		return path
+	}
+	return prefix + rest
+}
@@ -0,0 +1,430 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// UploadDir holds the encrypted contents of chunked uploads that are still
+// in progress. They are only moved into HomeDir once the last chunk arrives.
+const UploadDir = "/home/ubuntu/ECE_422_Project_1/uploads/"
+
+var (
+	ErrUnknownUpload = errors.New("unknown or expired upload")
+	ErrUploadOffset  = errors.New("chunk does not start at the upload offset")
+)
+
+// uploadSession is a chunked upload in progress. The contents received so
+// far are encrypted into a file in UploadDir as they arrive, with a key of
+// its own, so offset only counts bytes the server already holds.
+type uploadSession struct {
+	lock     sync.Mutex
+	session  string
+	username string
+	path     string
+	length   int64
+	offset   int64
+	done     bool
+	file     *os.File
+	content  *encryption.ContentWriter
+	// updated and busy are guarded by the lock of uploadSessions rather than
+	// lock. Uploads are busy while a chunk is being taken, and never expire
+	// then.
+	updated time.Time
+	busy    bool
+}
+
+// uploadSessions are kept in memory, so uploads have to start over after the
+// server restarts.
+var uploadSessions = struct {
+	lock     sync.Mutex
+	sessions map[string]*uploadSession
+}{sessions: make(map[string]*uploadSession)}
+
+// StartUpload begins a chunked upload of length bytes to filename, which is
+// created or has its contents replaced once all chunks are in. It returns the
+// id of the upload, or a message explaining why it can't start.
+func StartUpload(workingDir string, username string, sessionId string, filename string, length int64) (string, string, error) {
+	if err := encryption.EncryptMany(&username, &filename); err != nil {
+		return "", "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", "", err
+	}
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return "", "", err
+	}
+	if length < 0 {
+		return "", "Length can't be negative.", nil
+	}
+	message, err := checkUploadPermission(username, absPath)
+	if err != nil || message != "" {
+		return "", message, err
+	}
+	message, err = checkLocks(sessionId, absPath, false)
+	if err != nil || message != "" {
+		return "", message, err
+	}
+	// The encrypted contents will be a little larger still, which is checked
+	// once they are complete.
+	message, err = checkUploadQuota(username, absPath, length)
+	if err != nil || message != "" {
+		return "", message, err
+	}
+	if err := os.MkdirAll(UploadDir, 0700); err != nil {
+		return "", "", err
+	}
+	id, err := newUploadId()
+	if err != nil {
+		return "", "", err
+	}
+	// The file is created and registered under the list's lock, so that it
+	// is never seen by removeExpiredUploads as belonging to no upload.
+	uploadSessions.lock.Lock()
+	defer uploadSessions.lock.Unlock()
+	file, err := os.OpenFile(UploadDir+id, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := fileKey(file.Name())
+	if err != nil {
+		file.Close()
+		removeUpload(file.Name())
+		return "", "", err
+	}
+	content, err := encryption.NewContentWriterKey(file, 0, key)
+	if err != nil {
+		file.Close()
+		removeUpload(file.Name())
+		return "", "", err
+	}
+	uploadSessions.sessions[id] = &uploadSession{
+		session:  sessionId,
+		username: username,
+		path:     absPath,
+		length:   length,
+		file:     file,
+		content:  content,
+		updated:  time.Now(),
+	}
+	return id, "", nil
+}
+
+// UploadOffset returns how many bytes of the upload the server holds, which
+// is where an interrupted upload has to continue from.
+func UploadOffset(username string, id string) (int64, error) {
+	upload, err := getUploadSession(username, id)
+	if err != nil {
+		return 0, err
+	}
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	return upload.offset, nil
+}
+
+// UploadChunk adds data to the upload, starting at offset. Whatever part of
+// data arrives is kept even if the transfer breaks off, and the new offset
+// is returned. Once all bytes are in the file is committed and the returned
+// message says how that went.
+func UploadChunk(username string, id string, offset int64, data io.Reader) (int64, string, error) {
+	upload, err := getUploadSession(username, id)
+	if err != nil {
+		return 0, "", err
+	}
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	if upload.done {
+		return 0, "", ErrUnknownUpload
+	}
+	if offset != upload.offset {
+		return upload.offset, "", ErrUploadOffset
+	}
+	touchUploadSession(upload, true)
+	defer touchUploadSession(upload, false)
+	// Reads past the announced length are not taken.
+	written, err := io.Copy(upload.content, io.LimitReader(data, upload.length-upload.offset))
+	upload.offset += written
+	if usageErr := database.Dao.AddUsage(upload.username, written); err == nil {
+		err = usageErr
+	}
+	if err != nil {
+		return upload.offset, "", err
+	}
+	if upload.offset < upload.length {
+		return upload.offset, "", nil
+	}
+	// The session is only dropped after the commit, so the file isn't taken
+	// for a leftover in the meantime.
+	upload.done = true
+	output, err := upload.commit()
+	removeUploadSession(id)
+	return upload.offset, output, err
+}
+
+// PurgeUploads drops uploads which haven't received a chunk for longer than
+// the configured expiry, as well as leftovers of uploads from before the
+// server restarted.
+func PurgeUploads() error {
+	expired, err := removeExpiredUploads()
+	for _, upload := range expired {
+		upload.discard()
+	}
+	return err
+}
+
+// UploadGC purges stale uploads as often as the trash is checked.
+func UploadGC() {
+	if err := PurgeUploads(); err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+	}
+	time.AfterFunc(config.TrashPurgeInterval, UploadGC)
+}
+
+// commit stores the uploaded contents as chunks and puts a manifest of them
+// in place along with its checksum. The permissions and locks are checked
+// again as they may have changed during the upload.
+func (upload *uploadSession) commit() (string, error) {
+	defer removeUpload(upload.file.Name())
+	// The contents stop counting as an upload, and are checked against the
+	// quota as the file they become instead.
+	if err := database.Dao.AddUsage(upload.username, -upload.offset); err != nil {
+		upload.content.Close()
+		upload.file.Close()
+		return "", err
+	}
+	if err := upload.content.Close(); err != nil {
+		upload.file.Close()
+		return "", err
+	}
+	if err := upload.file.Close(); err != nil {
+		return "", err
+	}
+	message, err := checkUploadPermission(upload.username, upload.path)
+	if err != nil || message != "" {
+		return message, err
+	}
+	message, err = checkLocks(upload.session, upload.path, false)
+	if err != nil || message != "" {
+		return message, err
+	}
+	message, err = checkUploadQuota(upload.username, upload.path, upload.length)
+	if err != nil || message != "" {
+		return message, err
+	}
+	owner, err := fileOwner(upload.username, upload.path)
+	if err != nil {
+		return "", err
+	}
+	m, err := storeUpload(upload.file.Name(), owner, upload.path)
+	if err != nil {
+		return "", err
+	}
+	if pathExists(upload.path) {
+		if err := ensureVersioned(upload.username, upload.path); err != nil {
+			releaseChunks(m.ids())
+			return "", err
+		}
+		oldManifest, err := readManifest(upload.path)
+		if err != nil {
+			releaseChunks(m.ids())
+			return "", err
+		}
+		err = putManifest(upload.path, m, func(checksum string, rename func() error) error {
+			return database.Dao.ReplaceCheckSum(upload.path, checksum, rename)
+		})
+		if err == nil && oldManifest != nil {
+			err = releaseChunks(oldManifest.ids())
+		}
+	} else {
+		err = putManifest(upload.path, m, func(checksum string, rename func() error) error {
+			return database.Dao.AddFile(upload.username, upload.path, checksum, rename)
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := recordWrite(upload.username, upload.path, "upload"); err != nil {
+		return "", err
+	}
+	warning, err := quotaWarning(owner)
+	if err != nil {
+		return "", err
+	}
+	return "Done." + warning, nil
+}
+
+// storeUpload stores the contents of the finished upload at path as chunks
+// in the scope of owner, for the file at dstPath.
+func storeUpload(path string, owner string, dstPath string) (*manifest, error) {
+	scope, err := chunkScope(owner)
+	if err != nil {
+		return nil, err
+	}
+	compress, err := compressionEnabled(owner, dstPath)
+	if err != nil {
+		return nil, err
+	}
+	content, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	cw := newChunkWriter(scope, compress)
+	if _, err := io.Copy(cw, content); err != nil {
+		cw.abort()
+		return nil, err
+	}
+	m, err := cw.Close()
+	if err != nil {
+		cw.abort()
+	}
+	return m, err
+}
+
+func (upload *uploadSession) discard() {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	if upload.done {
+		return
+	}
+	upload.done = true
+	upload.file.Close()
+	removeUpload(upload.file.Name())
+	if err := database.Dao.AddUsage(upload.username, -upload.offset); err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+	}
+}
+
+// removeUpload removes the file at path holding the contents of an upload
+// and destroys the key they were sealed with.
+func removeUpload(path string) error {
+	if err := removeStored(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := database.Dao.RemoveFileKeys(path); err != nil {
+		return err
+	}
+	return destroyUnusedKeys()
+}
+
+// checkUploadPermission returns a message if username may not upload to
+// path: existing files need write access, new ones access to the directory.
+func checkUploadPermission(username string, path string) (string, error) {
+	if inSnapshot(path) {
+		return snapshotReadOnly, nil
+	}
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return "Can't upload to a directory.", nil
+		}
+		permission, err := database.Dao.CheckUserWritePermission(username, path)
+		if err != nil || permission {
+			return "", err
+		}
+		return "You are not authorized to write to this file", nil
+	}
+	permission, err := database.Dao.CheckUserPermission(username, filepath.Dir(path))
+	if err != nil || permission {
+		return "", err
+	}
+	return "You do not have authorization to create a file in this location.", nil
+}
+
+// checkUploadQuota returns a message if size bytes at path would exceed the
+// quota of its owner, who is the uploading user for new files.
+func checkUploadQuota(username string, path string, size int64) (string, error) {
+	owner, err := fileOwner(username, path)
+	if err != nil {
+		return "", err
+	}
+	limit, err := quotaLimit(owner, path)
+	if err != nil {
+		return "", err
+	}
+	if limit >= 0 && size > limit {
+		return "Upload rejected, it would exceed the quota.", nil
+	}
+	return "", nil
+}
+
+func getUploadSession(username string, id string) (*uploadSession, error) {
+	if err := encryption.EncryptMany(&username); err != nil {
+		return nil, err
+	}
+	uploadSessions.lock.Lock()
+	defer uploadSessions.lock.Unlock()
+	upload, ok := uploadSessions.sessions[id]
+	if !ok || upload.username != username {
+		return nil, ErrUnknownUpload
+	}
+	return upload, nil
+}
+
+// removeExpiredUploads takes expired uploads out of the session list and
+// removes the files in UploadDir that belong to no upload. The expired
+// uploads are returned to be discarded, which removes their files, once
+// their current chunk is done. Session locks are always taken before the
+// list's, never while holding it.
+func removeExpiredUploads() ([]*uploadSession, error) {
+	uploadSessions.lock.Lock()
+	defer uploadSessions.lock.Unlock()
+	var expired []*uploadSession
+	expiredFiles := make(map[string]bool)
+	oldest := time.Now().Add(-config.UploadExpiry)
+	for id, upload := range uploadSessions.sessions {
+		if !upload.busy && upload.updated.Before(oldest) {
+			delete(uploadSessions.sessions, id)
+			expired = append(expired, upload)
+			expiredFiles[id] = true
+		}
+	}
+	files, err := ioutil.ReadDir(UploadDir)
+	if os.IsNotExist(err) {
+		return expired, nil
+	}
+	if err != nil {
+		return expired, err
+	}
+	for _, file := range files {
+		if _, ok := uploadSessions.sessions[file.Name()]; !ok && !expiredFiles[file.Name()] {
+			if err := removeUpload(UploadDir + file.Name()); err != nil {
+				return expired, err
+			}
+		}
+	}
+	return expired, nil
+}
+
+func touchUploadSession(upload *uploadSession, busy bool) {
+	uploadSessions.lock.Lock()
+	defer uploadSessions.lock.Unlock()
+	upload.updated = time.Now()
+	upload.busy = busy
+}
+
+func removeUploadSession(id string) {
+	uploadSessions.lock.Lock()
+	defer uploadSessions.lock.Unlock()
+	delete(uploadSessions.sessions, id)
+}
+
+func newUploadId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,392 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VersionDir holds a blob for every kept file version, which like files
+// themselves lists the chunks of the contents. Blobs are named by the keyed
+// hash of the id of the file key they are sealed with and their contents, so
+// identical versions are stored only once, but blobs are only shared between
+// versions sealed with the same file key.
+const VersionDir = "/home/ubuntu/ECE_422_Project_1/versions/"
+
+// blobLock keeps a blob from being removed while it is added again. It is
+// held from storing a blob until the version referring to it is recorded,
+// and from counting a blob's references until it is removed.
+var blobLock sync.Mutex
+
+// versions <file_name> - List the kept versions of a file, newest first
+func Versions(workingDir string, username string, filename string) (string, error) {
+	absPath, message, err := readableFile(workingDir, username, filename)
+	if err != nil || message != "" {
+		return message, err
+	}
+	versions, err := database.Dao.GetFileVersions(absPath)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "No versions kept for this file.", nil
+	}
+	result := make([]string, 0)
+	for _, version := range versions {
+		author := version.Author
+		if author == "" {
+			// The author was deleted since.
+			author = "-"
+		} else if err := encryption.DecryptMany(&author); err != nil {
+			return "", err
+		}
+		createdAt := time.Unix(version.CreatedAt, 0).Format("2006-01-02 15:04:05")
+		result = append(result, fmt.Sprintf("%d\t%s\t%s\t%d bytes", version.Version, createdAt, author, version.Size))
+	}
+	return strings.Join(result, "\n"), nil
+}
+
+// versions cat <file_name> <version> - Show the contents of a file version
+func CatVersion(workingDir string, username string, filename string, version int) (string, error) {
+	absPath, message, err := readableFile(workingDir, username, filename)
+	if err != nil || message != "" {
+		return message, err
+	}
+	content, message, err := readVersion(absPath, version)
+	if err != nil || message != "" {
+		return message, err
+	}
+	return string(content), nil
+}
+
+// diff <file_name> <version> <version> - Compare two versions line by line
+func DiffVersions(workingDir string, username string, filename string, version int, otherVersion int) (string, error) {
+	absPath, message, err := readableFile(workingDir, username, filename)
+	if err != nil || message != "" {
+		return message, err
+	}
+	content, message, err := readVersion(absPath, version)
+	if err != nil || message != "" {
+		return message, err
+	}
+	otherContent, message, err := readVersion(absPath, otherVersion)
+	if err != nil || message != "" {
+		return message, err
+	}
+	return diffLines(string(content), string(otherContent)), nil
+}
+
+// revert <file_name> <version> - Replace the contents of a file with those of
+// an earlier version. The revert is kept as a new version of its own.
+func Revert(workingDir string, username string, sessionId string, filename string, version int) (string, error) {
+	if err := encryption.EncryptMany(&username, &filename); err != nil {
+		return "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	if !pathExists(absPath) {
+		return "File does not exist.", nil
+	}
+	if inSnapshot(absPath) {
+		return snapshotReadOnly, nil
+	}
+	permission, err := database.Dao.CheckUserWritePermission(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	if !permission {
+		return "You are not authorized to write to this file", nil
+	}
+	message, err := checkLocks(sessionId, absPath, false)
+	if err != nil || message != "" {
+		return message, err
+	}
+	content, message, err := openVersion(absPath, version)
+	if err != nil || message != "" {
+		return message, err
+	}
+	defer content.Close()
+	owner, err := fileOwner(username, absPath)
+	if err != nil {
+		return "", err
+	}
+	err = writeFile(absPath, owner, content, Overwrite, 0, "")
+	if errors.Is(err, ErrQuotaExceeded) {
+		return "Revert rejected, it would exceed the quota.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := recordWrite(username, absPath, "revert"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Reverted to version %d.", version), nil
+}
+
+// readableFile resolves filename and checks the user may read it, returning
+// a user facing message otherwise.
+func readableFile(workingDir string, username string, filename string) (string, string, error) {
+	if err := encryption.EncryptMany(&username, &filename); err != nil {
+		return "", "", err
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		return "", "", err
+	}
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return "", "", err
+	}
+	permission, err := database.Dao.CheckUserReadPermission(username, absPath)
+	if err != nil {
+		return "", "", err
+	}
+	if !permission {
+		return "", "You are not authorized to access this file.", nil
+	}
+	return absPath, "", nil
+}
+
+// openVersion opens the blob of a version of path, returning a user facing
+// message if there is no such version.
+func openVersion(path string, version int) (*File, string, error) {
+	fileVersion, err := database.Dao.GetFileVersion(path, version)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Sprintf("Version %d does not exist.", version), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := openFile(VersionDir + fileVersion.BlobHash)
+	return content, "", err
+}
+
+func readVersion(path string, version int) ([]byte, string, error) {
+	content, message, err := openVersion(path, version)
+	if err != nil || message != "" {
+		return nil, message, err
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	return data, "", err
+}
+
+// ensureVersioned keeps the current contents of a file that has no history
+// yet, so the first write made to it can still be undone.
+func ensureVersioned(username string, path string) error {
+	versions, err := database.Dao.GetFileVersions(path)
+	if err != nil || len(versions) != 0 {
+		return err
+	}
+	return recordVersion(username, path)
+}
+
+// recordWrite keeps the contents a write left behind as a new version of
+// path, records their size and indexes them for search, and adds the write
+// to the audit log.
+func recordWrite(username string, path string, action string) error {
+	if err := recordVersion(username, path); err != nil {
+		return err
+	}
+	if err := recordSize(path); err != nil {
+		return err
+	}
+	if err := indexFile(username, path); err != nil {
+		return err
+	}
+	return database.Dao.AddAuditEntry(username, action, path, time.Now().Unix())
+}
+
+// recordVersion keeps the current contents of path as its newest version.
+// Blobs are sealed with the key of path and named by the keyed hash of that
+// key's id and the contents, and a blob is only added, sharing the chunks of
+// path, if no identical one exists yet.
+func recordVersion(username string, path string) error {
+	content, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	key, err := fileKey(path)
+	if err != nil {
+		return err
+	}
+	hasher := encryption.NewContentHasher()
+	hasher.Write([]byte(key.Id))
+	if _, err := io.Copy(hasher, content); err != nil {
+		return err
+	}
+	blobHash := hex.EncodeToString(hasher.Sum(nil))
+	blobLock.Lock()
+	err = storeBlob(path, blobHash, key)
+	if err == nil {
+		err = database.Dao.AddFileVersion(username, path, blobHash, key.Id, time.Now().Unix(), content.Size())
+	}
+	blobLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return applyVersionRetention(path)
+}
+
+// VersionGC applies the version retention to every versioned file now and
+// then again every trash purge interval, so versions beyond a lowered count,
+// or past the retention age, are dropped even from files no longer written.
+func VersionGC() {
+	if err := pruneVersions(); err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+	}
+	time.AfterFunc(config.TrashPurgeInterval, VersionGC)
+}
+
+// pruneVersions applies the version retention to every versioned file.
+// Files that fail to be pruned are logged without holding up the others.
+func pruneVersions() error {
+	paths, err := database.Dao.GetVersionedPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := applyVersionRetention(path); err != nil {
+			log.Println(fmt.Errorf("error thrown: %w", err))
+		}
+	}
+	return nil
+}
+
+// storeBlob copies the file at path to the blob named blobHash, sealed with
+// key, unless that blob exists already. blobLock must be held.
+func storeBlob(path string, blobHash string, key *encryption.DataKey) error {
+	if pathExists(VersionDir + blobHash) {
+		return nil
+	}
+	if err := os.MkdirAll(VersionDir, 0700); err != nil {
+		return err
+	}
+	tmp := VersionDir + tempFilePrefix + blobHash
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if err := copyStored(path, tmp, key); err != nil {
+		return err
+	}
+	return os.Rename(tmp, VersionDir+blobHash)
+}
+
+// applyVersionRetention drops versions of path beyond the configured count
+// or age. The latest version is always kept.
+func applyVersionRetention(path string) error {
+	versions, err := database.Dao.GetFileVersions(path)
+	if err != nil {
+		return err
+	}
+	oldest := int64(0)
+	if config.VersionRetention > 0 {
+		oldest = time.Now().Add(-config.VersionRetention).Unix()
+	}
+	dropped := make([]string, 0)
+	for i, version := range versions {
+		if i == 0 || (i < config.VersionRetentionCount && version.CreatedAt >= oldest) {
+			continue
+		}
+		if err := database.Dao.RemoveFileVersion(version.Id); err != nil {
+			return err
+		}
+		dropped = append(dropped, version.BlobHash)
+	}
+	return removeUnreferencedBlobs(dropped)
+}
+
+func removeUnreferencedBlobs(blobHashes []string) error {
+	for _, blobHash := range blobHashes {
+		if err := removeBlob(blobHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBlob removes the blob named blobHash and gives up its chunks, unless
+// a version still refers to it.
+func removeBlob(blobHash string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	count, err := database.Dao.CountBlobReferences(blobHash)
+	if err != nil || count != 0 {
+		return err
+	}
+	m, err := readManifest(VersionDir + blobHash)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := removeStored(VersionDir + blobHash); err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+	return releaseChunks(m.ids())
+}
+
+// diffLines compares two texts line by line using their longest common
+// subsequence, marking removed lines with "-" and added lines with "+".
+func diffLines(a string, b string) string {
+	linesA := strings.Split(a, "\n")
+	linesB := strings.Split(b, "\n")
+	if len(linesA)*len(linesB) > 4000000 {
+		if a == b {
+			return "Versions are identical."
+		}
+		return "Versions differ, but are too large to compare line by line."
+	}
+	lcs := make([][]int, len(linesA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(linesB)+1)
+	}
+	for i := len(linesA) - 1; i >= 0; i-- {
+		for j := len(linesB) - 1; j >= 0; j-- {
+			if linesA[i] == linesB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	result := make([]string, 0)
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case i < len(linesA) && j < len(linesB) && linesA[i] == linesB[j]:
+			result = append(result, "  "+linesA[i])
+			i++
+			j++
+		case j < len(linesB) && (i == len(linesA) || lcs[i][j+1] > lcs[i+1][j]):
+			result = append(result, "+ "+linesB[j])
+			j++
+		default:
+			result = append(result, "- "+linesA[i])
+			i++
+		}
+	}
+	return strings.Join(result, "\n")
+}
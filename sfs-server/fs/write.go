@@ -0,0 +1,273 @@
+package fs
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// tempFilePrefix starts the names of files a write is still putting together
+// next to the file it replaces.
+const tempFilePrefix = ".tmp-"
+
+type WriteMode string
+
+const (
+	Append    WriteMode = "append"
+	Overwrite WriteMode = "overwrite"
+	Truncate  WriteMode = "truncate"
+	Pwrite    WriteMode = "pwrite"
+)
+
+func ParseWriteMode(mode string) (WriteMode, error) {
+	switch WriteMode(mode) {
+	case "", Append:
+		return Append, nil
+	case Overwrite, Truncate, Pwrite:
+		return WriteMode(mode), nil
+	}
+	return "", errors.New("unknown write mode " + mode)
+}
+
+var (
+	ErrRequestTooLarge = fmt.Errorf("write exceeds the limit of %d bytes per request", config.MaxWriteBytes)
+	ErrUserUploadLimit = fmt.Errorf("write exceeds the limit of %d bytes uploading at once per user", config.MaxUserUploadBytes)
+)
+
+// uploads tracks how many bytes each user is uploading at the moment.
+var uploads = struct {
+	lock     sync.Mutex
+	inFlight map[string]int64
+}{inFlight: make(map[string]int64)}
+
+// Upload counts the bytes read from a request body against the per request
+// and per user limits. It must be closed once the write is done to hand the
+// user's share back.
+type Upload struct {
+	username string
+	body     io.Reader
+	read     int64
+}
+
+// NewUpload wraps a request body that is already capped at the per request
+// limit, e.g. by http.MaxBytesReader.
+func NewUpload(username string, body io.Reader) *Upload {
+	return &Upload{username: username, body: body}
+}
+
+func (u *Upload) Read(p []byte) (int, error) {
+	n, err := u.body.Read(p)
+	u.read += int64(n)
+	if err != nil && err != io.EOF && u.read >= config.MaxWriteBytes {
+		err = ErrRequestTooLarge
+	}
+	uploads.lock.Lock()
+	defer uploads.lock.Unlock()
+	uploads.inFlight[u.username] += int64(n)
+	if uploads.inFlight[u.username] > config.MaxUserUploadBytes {
+		return n, ErrUserUploadLimit
+	}
+	return n, err
+}
+
+func (u *Upload) Close() error {
+	uploads.lock.Lock()
+	defer uploads.lock.Unlock()
+	uploads.inFlight[u.username] -= u.read
+	if uploads.inFlight[u.username] <= 0 {
+		delete(uploads.inFlight, u.username)
+	}
+	return nil
+}
+
+// File is an open file whose contents are decrypted as they are read.
+type File struct {
+	content
+	file    *os.File
+	ModTime time.Time
+	ETag    string
+}
+
+// content reads the contents of a file, either from the file itself or from
+// the chunks its manifest lists.
+type content interface {
+	io.ReadSeeker
+	Size() int64
+}
+
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+func openFile(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	reader, err := encryption.NewContentReaderKeys(f, info.Size(), lookupKey)
+	if err == encryption.ErrNoHeader {
+		// Files stored before contents were encrypted are read as they are,
+		// until they are written again.
+		return &File{content: io.NewSectionReader(f, 0, info.Size()), file: f, ModTime: info.ModTime()}, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if reader.Flags()&encryption.FlagManifest == 0 {
+		return &File{content: reader, file: f, ModTime: info.ModTime()}, nil
+	}
+	m, err := decodeManifest(reader)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{content: newChunkReader(m), file: f, ModTime: info.ModTime()}, nil
+}
+
+// createFile creates a new file at path with empty contents, which have no
+// chunks, sealed with a key of its own.
+func createFile(path string) error {
+	key, err := fileKey(path)
+	if err != nil {
+		return err
+	}
+	return createManifest(path, &manifest{Chunks: make([]chunkRef, 0)}, key)
+}
+
+// writeFile applies a write to the contents of the file at path, owned by
+// owner, and swaps a manifest of the new contents in, so readers see either
+// the old or the new contents. The new checksum is stored in the same step,
+// rolled back if the swap fails, and chunks only the old contents used are
+// removed after it. The write fails with ErrQuotaExceeded if it would take
+// the owner over a hard limit, and with ErrPreconditionFailed if base is set
+// and the stored checksum no longer is base by the time of the swap.
+func writeFile(path string, owner string, data io.Reader, mode WriteMode, position int64, base string) error {
+	limit, err := quotaLimit(owner, path)
+	if err != nil {
+		return err
+	}
+	scope, err := chunkScope(owner)
+	if err != nil {
+		return err
+	}
+	compress, err := compressionEnabled(owner, path)
+	if err != nil {
+		return err
+	}
+	old, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	oldManifest, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	cw := newChunkWriter(scope, compress)
+	if err := applyWrite(&limitWriter{cw, limit, 0}, old, data, mode, position); err != nil {
+		cw.abort()
+		return err
+	}
+	m, err := cw.Close()
+	if err != nil {
+		cw.abort()
+		return err
+	}
+	err = putManifest(path, m, func(checksum string, rename func() error) error {
+		if base == "" {
+			return database.Dao.ReplaceCheckSum(path, checksum, rename)
+		}
+		swapped, err := database.Dao.SwapCheckSum(path, base, checksum, rename)
+		if err == nil && !swapped {
+			err = ErrPreconditionFailed
+		}
+		return err
+	})
+	if err != nil || oldManifest == nil {
+		return err
+	}
+	return releaseChunks(oldManifest.ids())
+}
+
+// applyWrite writes the contents of old, changed by the write, to dst.
+func applyWrite(dst io.Writer, old *File, data io.Reader, mode WriteMode, position int64) error {
+	switch mode {
+	case Append:
+		if _, err := io.Copy(dst, old); err != nil {
+			return err
+		}
+		_, err := io.Copy(dst, data)
+		return err
+	case Overwrite:
+		_, err := io.Copy(dst, data)
+		return err
+	case Truncate:
+		return copyPrefix(dst, old, position)
+	case Pwrite:
+		if err := copyPrefix(dst, old, position); err != nil {
+			return err
+		}
+		written, err := io.Copy(dst, data)
+		if err != nil {
+			return err
+		}
+		if position+written >= old.Size() {
+			return nil
+		}
+		if _, err := old.Seek(position+written, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, old)
+		return err
+	}
+	return errors.New("unknown write mode " + string(mode))
+}
+
+// copyPrefix copies the first length bytes of old to dst, padding with zeros
+// when old is shorter, like extending a file with truncate does.
+func copyPrefix(dst io.Writer, old *File, length int64) error {
+	copied, err := io.Copy(dst, io.LimitReader(old, length))
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, zeros{}, length-copied)
+	return err
+}
+
+// limitWriter fails once more than limit bytes were written to it, unless
+// limit is negative.
+type limitWriter struct {
+	writer  io.Writer
+	limit   int64
+	written int64
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.limit >= 0 && w.written+int64(len(p)) > w.limit {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
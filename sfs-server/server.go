@@ -1,23 +1,59 @@
 package main
 
 import (
+	"./config"
 	"./fs"
 	"./session"
 	_ "./session/providers/memory"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
-	FilePathParam  = "filepath"
-	NewPathParam   = "newpath"
-	UserNameParam  = "username"
-	GroupNameParam = "groupname"
+	FilePathParam     = "filepath"
+	NewPathParam      = "newpath"
+	UserNameParam     = "username"
+	GroupNameParam    = "groupname"
+	RecursiveParam    = "recursive"
+	VersionParam      = "version"
+	OtherVersionParam = "otherversion"
+	ModeParam         = "mode"
+	OffsetParam       = "offset"
+	LengthParam       = "length"
+	UploadIdParam     = "uploadid"
+	ChecksumsParam    = "checksums"
+	AllParam          = "all"
+	SortParam         = "sort"
+	ReverseParam      = "reverse"
+	LimitParam        = "limit"
+	NameParam         = "name"
+	RegexParam        = "regex"
+	TypeParam         = "type"
+	MinSizeParam      = "minsize"
+	MaxSizeParam      = "maxsize"
+	NewerParam        = "newer"
+	OlderParam        = "older"
+	TermsParam        = "terms"
+	SoftParam         = "soft"
+	HardParam         = "hard"
+	SettingParam      = "setting"
+	FormatParam       = "format"
+	MapParam          = "map"
+	MandatoryParam    = "mandatory"
+	TtlParam          = "ttl"
+	ForceParam        = "force"
+	TargetParam       = "target"
+	KeyParam          = "key"
+	ValueParam        = "value"
+	TagsParam         = "tags"
 )
 
 type Credentials struct {
@@ -73,6 +109,9 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if session.SessionManager.SessionExists(w, r) {
+		fs.ReleaseLocks(getSessionId(w, r))
+	}
 	err := session.SessionManager.SessionEnd(w, r)
 	var message = new(bytes.Buffer)
 	if err != nil {
@@ -139,6 +178,149 @@ func lsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(output))
 }
 
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	query := r.URL.Query()
+	options := fs.ListOptions{
+		All:       query.Get(AllParam) == "true",
+		Recursive: query.Get(RecursiveParam) == "true",
+		Sort:      query.Get(SortParam),
+		Reverse:   query.Get(ReverseParam) == "true",
+	}
+	tags, err := fs.ParseTagFilters(query.Get(TagsParam))
+	if err != nil {
+		w.Write([]byte("Invalid " + TagsParam + "."))
+		return
+	}
+	options.Tags = tags
+	for param, value := range map[string]*int{OffsetParam: &options.Offset, LimitParam: &options.Limit} {
+		if query.Get(param) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(query.Get(param))
+		if err != nil || number < 0 {
+			w.Write([]byte("Invalid " + param + "."))
+			return
+		}
+		*value = number
+	}
+	listing, output, err := fs.List(workingDir, username, query.Get(FilePathParam), options)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Unable to read contents of dir"))
+		return
+	}
+	if listing == nil {
+		w.Write([]byte(output))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+func findHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	query := r.URL.Query()
+	search := fs.FindQuery{
+		Name:    query.Get(NameParam),
+		Regex:   query.Get(RegexParam),
+		Type:    query.Get(TypeParam),
+		MinSize: -1,
+		MaxSize: -1,
+	}
+	tags, err := fs.ParseTagFilters(query.Get(TagsParam))
+	if err != nil {
+		w.Write([]byte("Invalid " + TagsParam + "."))
+		return
+	}
+	search.Tags = tags
+	numbers := map[string]*int64{
+		MinSizeParam: &search.MinSize,
+		MaxSizeParam: &search.MaxSize,
+		NewerParam:   &search.ModifiedAfter,
+		OlderParam:   &search.ModifiedBefore,
+	}
+	for param, value := range numbers {
+		if query.Get(param) == "" {
+			continue
+		}
+		number, err := strconv.ParseInt(query.Get(param), 10, 64)
+		if err != nil || number < 0 {
+			w.Write([]byte("Invalid " + param + "."))
+			return
+		}
+		*value = number
+	}
+	for param, value := range map[string]*int{OffsetParam: &search.Offset, LimitParam: &search.Limit} {
+		if query.Get(param) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(query.Get(param))
+		if err != nil || number < 0 {
+			w.Write([]byte("Invalid " + param + "."))
+			return
+		}
+		*value = number
+	}
+	result, output, err := fs.Find(workingDir, username, query.Get(FilePathParam), search)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Search failed, try again."))
+		return
+	}
+	if result == nil {
+		w.Write([]byte(output))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.Search(username, r.URL.Query().Get(TermsParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Search failed, try again."
+	}
+	w.Write([]byte(output))
+}
+
+func statHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	info, output, err := fs.Stat(workingDir, username, r.URL.Query().Get(FilePathParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Command failed, try again."))
+		return
+	}
+	if info == nil {
+		w.Write([]byte(output))
+		return
+	}
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
 func pwdHandler(w http.ResponseWriter, r *http.Request) {
 	if !session.SessionManager.SessionExists(w, r) {
 		w.Write([]byte("Not logged in"))
@@ -196,10 +378,150 @@ func catHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	username, workingDir := getSessionInfo(w, r)
 	path := r.URL.Query().Get(FilePathParam)
-	output, err := fs.Cat(workingDir, username, path)
+	file, output, err := fs.Cat(workingDir, username, path)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Command failed, try again."))
+		return
+	}
+	if file == nil {
+		w.Write([]byte(output))
+		return
+	}
+	defer file.Close()
+	// ServeContent streams the file and takes care of Range requests, as
+	// well as of conditional ones on the ETag.
+	if file.ETag != "" {
+		w.Header().Set("ETag", file.ETag)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", file.ModTime, file)
+}
+
+func treeHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	path := r.URL.Query().Get(FilePathParam)
+	checksums := r.URL.Query().Get(ChecksumsParam) == "true"
+	entries, output, err := fs.Tree(workingDir, username, path, checksums)
 	if err != nil {
 		log.Println(fmt.Errorf("error thrown: %w", err))
 		w.Write([]byte("Command failed, try again."))
+		return
+	}
+	if entries == nil {
+		w.Write([]byte(output))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	query := r.URL.Query()
+	format, err := fs.ParseExportFormat(query.Get(FormatParam))
+	if err != nil {
+		w.Write([]byte("Format must be tar or zip."))
+		return
+	}
+	checksums := query.Get(ChecksumsParam) == "true"
+	export, output, err := fs.ExportDir(workingDir, username, query.Get(FilePathParam), format, checksums)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Export failed, try again."))
+		return
+	}
+	if export == nil {
+		w.Write([]byte(output))
+		return
+	}
+	// The archive is streamed as it is made, so a failure part way through
+	// can only cut it off.
+	if format == fs.ExportZip {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.Name+"."+string(format)))
+	if err := export.Stream(w); err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+	}
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	mapping, err := fs.ParseImportMapping(r.URL.Query().Get(MapParam))
+	if err != nil {
+		w.Write([]byte("Mappings must look like uid:<uid>=<username> or gid:<gid>=<groupname>."))
+		return
+	}
+	// The archive is unpacked as it arrives, each file counting against the
+	// quota of its owner.
+	output, err := fs.Import(workingDir, username, r.URL.Query().Get(FilePathParam), r.Body, mapping)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Import failed, try again."))
+		return
+	}
+	w.Write([]byte(output))
+}
+
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	query := r.URL.Query()
+	mode, err := fs.ParseLockMode(query.Get(ModeParam))
+	if err != nil {
+		w.Write([]byte("Lock mode must be shared or exclusive."))
+		return
+	}
+	var ttl time.Duration
+	if query.Get(TtlParam) != "" {
+		ttl, err = time.ParseDuration(query.Get(TtlParam))
+		if err != nil {
+			w.Write([]byte("Invalid " + TtlParam + "."))
+			return
+		}
+	}
+	mandatory := query.Get(MandatoryParam) == "true"
+	force := query.Get(ForceParam) == "true"
+	output, err := fs.Lock(workingDir, username, getSessionId(w, r), query.Get(FilePathParam), mode, mandatory, ttl, force)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Command failed, try again."))
+		return
+	}
+	w.Write([]byte(output))
+}
+
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	path := r.URL.Query().Get(FilePathParam)
+	force := r.URL.Query().Get(ForceParam) == "true"
+	output, err := fs.Unlock(workingDir, username, getSessionId(w, r), path, force)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Command failed, try again."))
+		return
 	}
 	w.Write([]byte(output))
 }
@@ -219,6 +541,22 @@ func touchHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(output))
 }
 
+func lnHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	linkName := r.URL.Query().Get(FilePathParam)
+	target := r.URL.Query().Get(TargetParam)
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.Ln(workingDir, username, target, linkName)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to create link " + linkName
+	}
+	w.Write([]byte(output))
+}
+
 func mvHandler(w http.ResponseWriter, r *http.Request) {
 	if !session.SessionManager.SessionExists(w, r) {
 		w.Write([]byte("Not logged in"))
@@ -228,7 +566,11 @@ func mvHandler(w http.ResponseWriter, r *http.Request) {
 	newPath := r.URL.Query().Get(NewPathParam)
 	username, workingDir := getSessionInfo(w, r)
 	var output string
-	output, err := fs.Mv(workingDir, username, path, newPath)
+	output, err := fs.Mv(workingDir, username, getSessionId(w, r), path, newPath, getPrecondition(r))
+	if errors.Is(err, fs.ErrPreconditionFailed) {
+		writePreconditionFailed(w)
+		return
+	}
 	if err != nil {
 		log.Println(fmt.Errorf("error thrown: %w", err))
 		output = "Failed to move file " + path
@@ -236,19 +578,298 @@ func mvHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(output))
 }
 
+func cpHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	path := r.URL.Query().Get(FilePathParam)
+	newPath := r.URL.Query().Get(NewPathParam)
+	recursive := r.URL.Query().Get(RecursiveParam) == "true"
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.Cp(workingDir, username, getSessionId(w, r), path, newPath, recursive)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to copy " + path
+	}
+	w.Write([]byte(output))
+}
+
 func rmHandler(w http.ResponseWriter, r *http.Request) {
 	if !session.SessionManager.SessionExists(w, r) {
 		w.Write([]byte("Not logged in"))
 		return
 	}
 	filepath := r.URL.Query().Get(FilePathParam)
+	recursive := r.URL.Query().Get(RecursiveParam) == "true"
 	username, workingDir := getSessionInfo(w, r)
-	var output string
-	if err := fs.Rm(workingDir, username, filepath); err != nil || filepath == "" {
+	output, err := fs.Rm(workingDir, username, getSessionId(w, r), filepath, recursive, getPrecondition(r))
+	if errors.Is(err, fs.ErrPreconditionFailed) {
+		writePreconditionFailed(w)
+		return
+	}
+	if err != nil || filepath == "" {
 		log.Println(fmt.Errorf("error thrown: %w", err))
 		output = "Failed to remove file " + filepath
-	} else {
-		output = "Done."
+	}
+	w.Write([]byte(output))
+}
+
+func rmdirHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	filepath := r.URL.Query().Get(FilePathParam)
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.Rmdir(workingDir, username, getSessionId(w, r), filepath)
+	if err != nil || filepath == "" {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to remove directory " + filepath
+	}
+	w.Write([]byte(output))
+}
+
+func trashLsHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.TrashLs(username)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Unable to read contents of trash"
+	}
+	w.Write([]byte(output))
+}
+
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	path := r.URL.Query().Get(FilePathParam)
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.TrashRestore(workingDir, username, path)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to restore " + path
+	}
+	w.Write([]byte(output))
+}
+
+func tagSetHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	query := r.URL.Query()
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.SetTag(workingDir, username, query.Get(FilePathParam), query.Get(KeyParam), query.Get(ValueParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to set tag " + query.Get(KeyParam)
+	}
+	w.Write([]byte(output))
+}
+
+func tagGetHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	query := r.URL.Query()
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.GetTag(workingDir, username, query.Get(FilePathParam), query.Get(KeyParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to get tag " + query.Get(KeyParam)
+	}
+	w.Write([]byte(output))
+}
+
+func tagRmHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	query := r.URL.Query()
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.RemoveTag(workingDir, username, query.Get(FilePathParam), query.Get(KeyParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to remove tag " + query.Get(KeyParam)
+	}
+	w.Write([]byte(output))
+}
+
+func tagListHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.ListTags(workingDir, username, r.URL.Query().Get(FilePathParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Unable to list tags"
+	}
+	w.Write([]byte(output))
+}
+
+func snapshotCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	name := r.URL.Query().Get(NameParam)
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.CreateSnapshot(username, name)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to create snapshot " + name
+	}
+	w.Write([]byte(output))
+}
+
+func snapshotLsHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.ListSnapshots(username)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Unable to list snapshots"
+	}
+	w.Write([]byte(output))
+}
+
+func snapshotRmHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	name := r.URL.Query().Get(NameParam)
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.RemoveSnapshot(username, name)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to remove snapshot " + name
+	}
+	w.Write([]byte(output))
+}
+
+// snapshotRestoreHandler restores a path, relative to the home directory,
+// from a snapshot, or the whole home directory if no path is given
+func snapshotRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get(NameParam)
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.RestoreSnapshot(username, getSessionId(w, r), name, query.Get(FilePathParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to restore from snapshot " + name
+	}
+	w.Write([]byte(output))
+}
+
+func trashEmptyHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.TrashEmpty(username)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to empty trash"
+	}
+	w.Write([]byte(output))
+}
+
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	path := r.URL.Query().Get(FilePathParam)
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.Versions(workingDir, username, path)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to list versions of " + path
+	}
+	w.Write([]byte(output))
+}
+
+func catVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	path := r.URL.Query().Get(FilePathParam)
+	version, err := strconv.Atoi(r.URL.Query().Get(VersionParam))
+	if err != nil {
+		w.Write([]byte("Invalid version"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.CatVersion(workingDir, username, path, version)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Command failed, try again."
+	}
+	w.Write([]byte(output))
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	path := r.URL.Query().Get(FilePathParam)
+	version, err := strconv.Atoi(r.URL.Query().Get(VersionParam))
+	if err != nil {
+		w.Write([]byte("Invalid version"))
+		return
+	}
+	otherVersion, err := strconv.Atoi(r.URL.Query().Get(OtherVersionParam))
+	if err != nil {
+		w.Write([]byte("Invalid version"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.DiffVersions(workingDir, username, path, version, otherVersion)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Command failed, try again."
+	}
+	w.Write([]byte(output))
+}
+
+func revertHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	path := r.URL.Query().Get(FilePathParam)
+	version, err := strconv.Atoi(r.URL.Query().Get(VersionParam))
+	if err != nil {
+		w.Write([]byte("Invalid version"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	output, err := fs.Revert(workingDir, username, getSessionId(w, r), path, version)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to revert " + path
 	}
 	w.Write([]byte(output))
 }
@@ -286,6 +907,90 @@ func addUserToGroupHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(output))
 }
 
+// deleteUserHandler deletes a user and shreds everything they own, ending
+// the session if users delete themselves.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	name := r.URL.Query().Get(UserNameParam)
+	output, err := fs.DeleteUser(username, name)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to delete user " + name
+	} else if output == fs.UserDeleted {
+		// Sessions of the deleted user would otherwise act as whoever
+		// registers the name next.
+		for _, sessionId := range session.SessionManager.SessionEndAll(session.Username, name) {
+			fs.ReleaseLocks(sessionId)
+		}
+	}
+	w.Write([]byte(output))
+}
+
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	output, err := fs.Quota(username)
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Unable to read quota"
+	}
+	w.Write([]byte(output))
+}
+
+// setQuotaHandler lets admins override the limits of a user, or of a group
+// when groupname is given instead.
+func setQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	query := r.URL.Query()
+	name, isGroup := query.Get(UserNameParam), false
+	if query.Get(GroupNameParam) != "" {
+		name, isGroup = query.Get(GroupNameParam), true
+	}
+	limits := make(map[string]int64)
+	for _, param := range []string{SoftParam, HardParam} {
+		limit, err := strconv.ParseInt(query.Get(param), 10, 64)
+		if err != nil {
+			w.Write([]byte("Invalid " + param + "."))
+			return
+		}
+		limits[param] = limit
+	}
+	output, err := fs.SetQuota(username, name, isGroup, limits[SoftParam], limits[HardParam])
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to set quota"
+	}
+	w.Write([]byte(output))
+}
+
+// compressionHandler shows or changes whether new file contents are
+// compressed, for the user or for a directory
+func compressionHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	query := r.URL.Query()
+	output, err := fs.Compression(workingDir, username, query.Get(SettingParam), query.Get(FilePathParam))
+	if err != nil {
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		output = "Failed to change compression"
+	}
+	w.Write([]byte(output))
+}
+
 func writeHandler(w http.ResponseWriter, r *http.Request) {
 	if !session.SessionManager.SessionExists(w, r) {
 		w.Write([]byte("Not logged in"))
@@ -293,21 +998,146 @@ func writeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fileName := r.URL.Query().Get(FilePathParam)
 	username, workingDir := getSessionInfo(w, r)
-	data, err := ioutil.ReadAll(r.Body)
+	if r.ContentLength > config.MaxWriteBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Write failed: " + fs.ErrRequestTooLarge.Error()))
+		return
+	}
+	mode, err := fs.ParseWriteMode(r.URL.Query().Get(ModeParam))
+	if err != nil {
+		w.Write([]byte("Unknown write mode."))
+		return
+	}
+	var position int64
+	if mode == fs.Pwrite || mode == fs.Truncate {
+		param := OffsetParam
+		if mode == fs.Truncate {
+			param = LengthParam
+		}
+		position, err = strconv.ParseInt(r.URL.Query().Get(param), 10, 64)
+		if err != nil {
+			w.Write([]byte("Invalid " + param + "."))
+			return
+		}
+	}
+	// The body is streamed into the file rather than read up front, so its
+	// size is only known, and checked, as it arrives.
+	data := fs.NewUpload(username, http.MaxBytesReader(w, r.Body, config.MaxWriteBytes))
+	defer data.Close()
+	output, err := fs.Write(workingDir, username, getSessionId(w, r), fileName, data, mode, position, getPrecondition(r))
+	if errors.Is(err, fs.ErrPreconditionFailed) {
+		writePreconditionFailed(w)
+		return
+	}
+	if errors.Is(err, fs.ErrRequestTooLarge) || errors.Is(err, fs.ErrUserUploadLimit) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Write failed: " + err.Error()))
+		return
+	}
 	if err != nil {
 		log.Println(fmt.Errorf("error thrown: %w", err))
 		w.Write([]byte("Write failed. please try again."))
 		return
 	}
-	output, err := fs.Write(workingDir, username, fileName, data)
+	w.Write([]byte(output))
+}
+
+// Chunked uploads hand their id and offset back in the Upload-Id and
+// Upload-Offset headers, so the body is left for messages.
+const (
+	UploadIdHeader     = "Upload-Id"
+	UploadOffsetHeader = "Upload-Offset"
+)
+
+func startUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	fileName := r.URL.Query().Get(FilePathParam)
+	length, err := strconv.ParseInt(r.URL.Query().Get(LengthParam), 10, 64)
+	if err != nil {
+		w.Write([]byte("Invalid " + LengthParam + "."))
+		return
+	}
+	username, workingDir := getSessionInfo(w, r)
+	id, output, err := fs.StartUpload(workingDir, username, getSessionId(w, r), fileName, length)
 	if err != nil {
 		log.Println(fmt.Errorf("error thrown: %w", err))
-		w.Write([]byte("Write failed. please try again."))
+		w.Write([]byte("Upload failed. please try again."))
+		return
+	}
+	if id != "" {
+		w.Header().Set(UploadIdHeader, id)
+		w.Header().Set(UploadOffsetHeader, "0")
+	}
+	w.Write([]byte(output))
+}
+
+func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	id := r.URL.Query().Get(UploadIdParam)
+	offset, err := strconv.ParseInt(r.URL.Query().Get(OffsetParam), 10, 64)
+	if err != nil {
+		w.Write([]byte("Invalid " + OffsetParam + "."))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	if r.ContentLength > config.MaxWriteBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Upload failed: " + fs.ErrRequestTooLarge.Error()))
 		return
 	}
+	data := fs.NewUpload(username, http.MaxBytesReader(w, r.Body, config.MaxWriteBytes))
+	defer data.Close()
+	offset, output, err := fs.UploadChunk(username, id, offset, data)
+	writeUploadError(w, offset, err)
+	if err != nil {
+		return
+	}
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
 	w.Write([]byte(output))
 }
 
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.SessionManager.SessionExists(w, r) {
+		w.Write([]byte("Not logged in"))
+		return
+	}
+	username, _ := getSessionInfo(w, r)
+	offset, err := fs.UploadOffset(username, r.URL.Query().Get(UploadIdParam))
+	writeUploadError(w, offset, err)
+	if err != nil {
+		return
+	}
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+}
+
+// writeUploadError answers a failed chunked upload request. The offset is
+// sent along where the client can pick the upload up again from it.
+func writeUploadError(w http.ResponseWriter, offset int64, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrUnknownUpload):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Upload failed: " + err.Error()))
+	case errors.Is(err, fs.ErrUploadOffset):
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Upload failed: " + err.Error()))
+	case errors.Is(err, fs.ErrRequestTooLarge) || errors.Is(err, fs.ErrUserUploadLimit):
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Upload failed: " + err.Error()))
+	default:
+		log.Println(fmt.Errorf("error thrown: %w", err))
+		w.Write([]byte("Upload failed. please try again."))
+	}
+}
+
 func getSessionInfo(w http.ResponseWriter, r *http.Request) (string, string) {
 	sess := session.SessionManager.SessionStart(w, r)
 	workingDir := sess.Get(session.WorkingDir)
@@ -315,6 +1145,23 @@ func getSessionInfo(w http.ResponseWriter, r *http.Request) (string, string) {
 	return fmt.Sprint(username), fmt.Sprint(workingDir)
 }
 
+// getSessionId returns the id of the request's session, which locks are
+// bound to.
+func getSessionId(w http.ResponseWriter, r *http.Request) string {
+	return session.SessionManager.SessionStart(w, r).SessionID()
+}
+
+// getPrecondition returns the ETags the request's change is conditional on.
+func getPrecondition(r *http.Request) fs.Precondition {
+	return fs.Precondition{IfMatch: r.Header.Get("If-Match"), IfNoneMatch: r.Header.Get("If-None-Match")}
+}
+
+// writePreconditionFailed answers a change whose ETags didn't match.
+func writePreconditionFailed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusPreconditionFailed)
+	w.Write([]byte("Precondition failed, the file was changed or removed."))
+}
+
 func changeWorkingDir(w http.ResponseWriter, r *http.Request, workingDir string) error {
 	sess := session.SessionManager.SessionStart(w, r)
 	err := sess.Set(session.WorkingDir, workingDir)
@@ -330,16 +1177,54 @@ func main() {
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/signup", signupHandler)
 	http.HandleFunc("/ls", lsHandler)
+	http.HandleFunc("/list", listHandler)
+	http.HandleFunc("/stat", statHandler)
+	http.HandleFunc("/find", findHandler)
+	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/quota", quotaHandler)
+	http.HandleFunc("/quota/set", setQuotaHandler)
+	http.HandleFunc("/compress", compressionHandler)
 	http.HandleFunc("/pwd", pwdHandler)
 	http.HandleFunc("/mkdir", mkdirHandler)
 	http.HandleFunc("/cd", cdHandler)
 	http.HandleFunc("/cat", catHandler)
+	http.HandleFunc("/tree", treeHandler)
+	http.HandleFunc("/export", exportHandler)
+	http.HandleFunc("/import", importHandler)
+	http.HandleFunc("/lock", lockHandler)
+	http.HandleFunc("/unlock", unlockHandler)
 	http.HandleFunc("/touch", touchHandler)
+	http.HandleFunc("/ln", lnHandler)
 	http.HandleFunc("/mv", mvHandler)
+	http.HandleFunc("/cp", cpHandler)
 	http.HandleFunc("/write", writeHandler)
+	http.HandleFunc("/upload/start", startUploadHandler)
+	http.HandleFunc("/upload/chunk", uploadChunkHandler)
+	http.HandleFunc("/upload/status", uploadStatusHandler)
 	http.HandleFunc("/rm", rmHandler)
+	http.HandleFunc("/rmdir", rmdirHandler)
+	http.HandleFunc("/trash/ls", trashLsHandler)
+	http.HandleFunc("/trash/restore", trashRestoreHandler)
+	http.HandleFunc("/trash/empty", trashEmptyHandler)
+	http.HandleFunc("/tag/set", tagSetHandler)
+	http.HandleFunc("/tag/get", tagGetHandler)
+	http.HandleFunc("/tag/rm", tagRmHandler)
+	http.HandleFunc("/tag/list", tagListHandler)
+	http.HandleFunc("/snapshot/create", snapshotCreateHandler)
+	http.HandleFunc("/snapshot/ls", snapshotLsHandler)
+	http.HandleFunc("/snapshot/rm", snapshotRmHandler)
+	http.HandleFunc("/snapshot/restore", snapshotRestoreHandler)
+	http.HandleFunc("/versions", versionsHandler)
+	http.HandleFunc("/versions/cat", catVersionHandler)
+	http.HandleFunc("/versions/diff", diffHandler)
+	http.HandleFunc("/versions/revert", revertHandler)
 	http.HandleFunc("/addgroup", addGroupHandler)
 	http.HandleFunc("/addtogroup", addUserToGroupHandler)
+	http.HandleFunc("/deluser", deleteUserHandler)
+	go fs.TrashGC()
+	go fs.VersionGC()
+	go fs.UploadGC()
+	go fs.SnapshotSchedule()
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
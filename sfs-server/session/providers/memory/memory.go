@@ -76,6 +76,20 @@ func (pder *SessionProvider) SessionDestroy(sid string) error {
 	return nil
 }
 
+func (pder *SessionProvider) SessionDestroyAll(key, value interface{}) []string {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+	destroyed := make([]string, 0)
+	for sid, element := range pder.sessions {
+		if v, ok := element.Value.(*SessionStore).value[key]; ok && v == value {
+			delete(pder.sessions, sid)
+			pder.list.Remove(element)
+			destroyed = append(destroyed, sid)
+		}
+	}
+	return destroyed
+}
+
 func (pder *SessionProvider) SessionGC(maxLifetime int) {
 	pder.lock.Lock()
 	defer pder.lock.Unlock()
@@ -29,6 +29,9 @@ type Provider interface {
 	SessionInit(sid string) (Session, error)
 	SessionRead(sid string) (Session, error)
 	SessionDestroy(sid string) error
+	// SessionDestroyAll destroys every session holding value under key and
+	// returns their ids.
+	SessionDestroyAll(key, value interface{}) []string
 	SessionGC(maxLifetime int)
 }
 
@@ -95,6 +98,14 @@ func (manager *Manager) SessionEnd(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
+// SessionEndAll ends every session holding value under key, such as all
+// sessions of a user, and returns their ids.
+func (manager *Manager) SessionEndAll(key, value interface{}) []string {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.provider.SessionDestroyAll(key, value)
+}
+
 func (manager *Manager) GC() {
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
@@ -2,6 +2,7 @@ package test
 
 import (
 	"../database"
+	"errors"
 	"testing"
 )
 
@@ -116,3 +117,714 @@ func TestCheckUserPermissions(t *testing.T) {
 		return
 	}
 }
+
+func TestCheckUserReadWritePermissions(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUser(TestUserB, TestPasswordB)
+	err = dao.AddGroup(TestGroupA)
+	err = dao.AddUserToGroup(TestUserB, TestGroupA)
+	err = dao.AddGroupPermission(TestGroupA, TestFileA)
+	canRead, err := dao.CheckUserReadPermission(TestUserB, TestFileA)
+	if err != nil || !canRead {
+		t.Errorf("Expected group member to have read permission: %s", err)
+		return
+	}
+	canWrite, err := dao.CheckUserWritePermission(TestUserA, TestFileA)
+	if err != nil || canWrite {
+		t.Errorf("Expected non member to be denied write permission: %s", err)
+		return
+	}
+}
+
+func TestChangeFilePathMovesDescendants(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUserPermission(TestUserA, TestDirA)
+	err = dao.AddUserPermission(TestUserA, TestDirA+"/test.txt")
+	err = dao.AddCheckSum(TestDirA+"/test.txt", "sum")
+	err = dao.ChangeFilePath(TestDirA, "/b/folder", func() error { return nil })
+	if err != nil {
+		t.Errorf("Failed to change file path: %s", err)
+		return
+	}
+	moved, err := dao.CheckUserPermission(TestUserA, "/b/folder/test.txt")
+	if err != nil || !moved {
+		t.Errorf("Expected child permission to move with its directory: %s", err)
+		return
+	}
+	sum, err := dao.GetCheckSum("/b/folder/test.txt")
+	if err != nil || sum != "sum" {
+		t.Errorf("Expected child checksum to move with its directory: %s", err)
+		return
+	}
+}
+
+func TestChangeFilePathRollsBackOnFailedMove(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUserPermission(TestUserA, TestFileA)
+	err = dao.ChangeFilePath(TestFileA, TestFileB, func() error { return errors.New("rename failed") })
+	if err == nil {
+		t.Errorf("Expected failed move to be reported")
+		return
+	}
+	kept, err := dao.CheckUserPermission(TestUserA, TestFileA)
+	if err != nil || !kept {
+		t.Errorf("Expected permission to stay at the old path: %s", err)
+		return
+	}
+}
+
+func TestChangeFilePathKeepsExistingDestination(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUserPermission(TestUserA, TestFileA)
+	err = dao.AddCheckSum(TestFileA, "sumA")
+	err = dao.AddCheckSum(TestFileB, "sumB")
+	err = dao.ChangeFilePath(TestFileA, TestFileB, func() error { return nil })
+	if err != database.ErrPathTaken {
+		t.Errorf("Expected move onto an existing path to be refused: %v", err)
+		return
+	}
+	sum, err := dao.GetCheckSum(TestFileB)
+	if err != nil || sum != "sumB" {
+		t.Errorf("Expected destination checksum to be kept: %s", err)
+		return
+	}
+	sum, err = dao.GetCheckSum(TestFileA)
+	if err != nil || sum != "sumA" {
+		t.Errorf("Expected source checksum to stay at the old path: %s", err)
+		return
+	}
+}
+
+func TestTrashAndRestorePath(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUserPermission(TestUserA, TestFileA)
+	err = dao.TrashPath(TestUserA, TestFileA, "/trash/test.txt", 1, func() error { return nil })
+	if err != nil {
+		t.Errorf("Failed to trash path: %s", err)
+		return
+	}
+	items, err := dao.GetTrashItems(TestUserA)
+	if err != nil || len(items) != 1 || items[0].OriginalPath != TestFileA {
+		t.Errorf("Expected one trash item for the removed path: %s", err)
+		return
+	}
+	err = dao.RestoreTrashItem(items[0], func() error { return nil })
+	restored, err := dao.CheckUserPermission(TestUserA, TestFileA)
+	if err != nil || !restored {
+		t.Errorf("Expected permission to be restored with the path: %s", err)
+		return
+	}
+}
+
+func TestRecursiveRemovalTakesEveryRowBelow(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	for _, path := range []string{TestDirA, TestDirA + "/sub"} {
+		err = dao.AddCopiedEntry(TestUserA, path, "", true)
+	}
+	for _, path := range []string{TestDirA + "/x.txt", TestDirA + "/sub/y.txt", TestDirA + "2/z.txt"} {
+		err = dao.AddCopiedEntry(TestUserA, path, "sum", false)
+	}
+	err = dao.TrashPath(TestUserA, TestDirA, "/trash/folder", 1, func() error { return nil })
+	if err != nil {
+		t.Errorf("Failed to trash path: %s", err)
+		return
+	}
+	for _, path := range []string{TestDirA, TestDirA + "/x.txt", TestDirA + "/sub/y.txt"} {
+		if permission, err := dao.CheckUserPermission(TestUserA, path); err != nil || permission {
+			t.Errorf("Expected the rows of %s to move to the trash: %s", path, err)
+			return
+		}
+	}
+	items, err := dao.GetTrashItems(TestUserA)
+	if err != nil || len(items) != 1 {
+		t.Errorf("Expected one trash item for the directory, got %+v: %s", items, err)
+		return
+	}
+	err = dao.RemoveTrashItem(items[0], func() error { return nil })
+	for _, path := range []string{"/trash/folder", "/trash/folder/x.txt", "/trash/folder/sub/y.txt"} {
+		if permission, err := dao.CheckUserPermission(TestUserA, path); err != nil || permission {
+			t.Errorf("Expected the rows of %s to be removed: %s", path, err)
+			return
+		}
+	}
+	if permission, err := dao.CheckUserPermission(TestUserA, TestDirA+"2/z.txt"); err != nil || !permission {
+		t.Errorf("Expected the rows of a sibling sharing the prefix to stay: %s", err)
+	}
+}
+
+func TestAddFileOnlyCommitsCreatedFiles(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddFile(TestUserA, TestFileA, "sum", func() error { return errors.New("rename failed") })
+	if err == nil {
+		t.Errorf("Expected failed create to be reported")
+		return
+	}
+	if _, err := dao.GetCheckSum(TestFileA); err == nil {
+		t.Errorf("Expected no checksum for a file that wasn't created")
+		return
+	}
+	err = dao.AddFile(TestUserA, TestFileA, "sum", func() error { return nil })
+	if err != nil {
+		t.Errorf("Failed to add file: %s", err)
+		return
+	}
+	permission, err := dao.CheckUserWritePermission(TestUserA, TestFileA)
+	if err != nil || !permission {
+		t.Errorf("Expected the user to be able to write the new file: %s", err)
+		return
+	}
+	checkSum, err := dao.GetCheckSum(TestFileA)
+	if err != nil || checkSum != "sum" {
+		t.Errorf("Expected checksum to be stored, got %q: %s", checkSum, err)
+		return
+	}
+}
+
+func TestGetFileMetadataAndAcl(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddGroup(TestGroupA)
+	err = dao.AddUserToGroup(TestUserA, TestGroupA)
+	err = dao.AddCopiedEntry(TestUserA, TestDirA, "", true)
+	if err != nil {
+		t.Errorf("Failed to add entry: %s", err)
+		return
+	}
+	metadata, err := dao.GetFileMetadata(TestDirA)
+	if err != nil || metadata.Owner != TestUserA || metadata.CreatedAt == 0 {
+		t.Errorf("Expected owner and creation time to be recorded, got %+v: %s", metadata, err)
+		return
+	}
+	acl, err := dao.GetFileAcl(TestDirA)
+	if err != nil || len(acl) != 2 {
+		t.Errorf("Expected a user and a group row, got %+v: %s", acl, err)
+		return
+	}
+	if acl[0].User.String != TestUserA || acl[1].Group.String != TestGroupA || !acl[1].Read || !acl[1].Write {
+		t.Errorf("Unexpected ACL %+v", acl)
+		return
+	}
+	err = dao.ChangeFilePath(TestDirA, TestFileB, func() error { return nil })
+	if _, err := dao.GetFileMetadata(TestFileB); err != nil {
+		t.Errorf("Expected metadata to move with the path: %s", err)
+		return
+	}
+}
+
+func TestSearchIndexMovesAndLeavesWithPath(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.IndexFile(TestFileA, TestUserA, []string{"fox", "dog"})
+	if err != nil {
+		t.Errorf("Failed to index file: %s", err)
+		return
+	}
+	paths, err := dao.SearchIndex(TestUserA, []string{"fox", "dog"})
+	if err != nil || len(paths) != 1 || paths[0] != TestFileA {
+		t.Errorf("Expected the file to match both tokens, got %v: %s", paths, err)
+		return
+	}
+	paths, err = dao.SearchIndex(TestUserA, []string{"fox", "cat"})
+	if err != nil || len(paths) != 0 {
+		t.Errorf("Expected no file to match every token, got %v: %s", paths, err)
+		return
+	}
+	err = dao.ChangeFilePath(TestFileA, TestFileB, func() error { return nil })
+	paths, err = dao.SearchIndex(TestUserA, []string{"fox"})
+	if err != nil || len(paths) != 1 || paths[0] != TestFileB {
+		t.Errorf("Expected the tokens to move with the path, got %v: %s", paths, err)
+		return
+	}
+	err = dao.TrashPath(TestUserA, TestFileB, "/trash/test.txt", 1, func() error { return nil })
+	paths, err = dao.SearchIndex(TestUserA, []string{"fox"})
+	if err != nil || len(paths) != 0 {
+		t.Errorf("Expected trashed files to leave the index, got %v: %s", paths, err)
+		return
+	}
+}
+
+func TestQuotasCountOwnedFiles(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddGroup(TestGroupA)
+	err = dao.AddUserToGroup(TestUserA, TestGroupA)
+	err = dao.AddCopiedEntry(TestUserA, TestFileA, "sum", false)
+	err = dao.SetFileSize(TestFileA, 100)
+	if err != nil {
+		t.Errorf("Failed to record file size: %s", err)
+		return
+	}
+	found, err := dao.SetQuota(TestGroupA, true, 150, 300)
+	if err != nil || !found {
+		t.Errorf("Failed to set group quota: %s", err)
+		return
+	}
+	quotas, err := dao.GetQuotas(TestUserA, 10, 20)
+	if err != nil || len(quotas) != 2 {
+		t.Errorf("Expected a user and a group quota, got %+v: %s", quotas, err)
+		return
+	}
+	if quotas[0].Group || quotas[0].Soft != 10 || quotas[0].Hard != 20 || quotas[0].Used != 100 {
+		t.Errorf("Expected the default limits and the file's size, got %+v", quotas[0])
+		return
+	}
+	if !quotas[1].Group || quotas[1].Name != TestGroupA || quotas[1].Hard != 300 || quotas[1].Used != 100 {
+		t.Errorf("Expected the group's limits and its members' usage, got %+v", quotas[1])
+		return
+	}
+	found, err = dao.SetQuota(TestUserB, false, 1, 2)
+	if err != nil || found {
+		t.Errorf("Expected no quota to be set for a missing user: %s", err)
+		return
+	}
+}
+
+func TestChunksAreRemovedWithTheirLastReference(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	chunk := database.Chunk{Id: "abcd", Scope: "user:" + TestUserA, Size: 10}
+	err = dao.RetainChunks([]database.Chunk{chunk, chunk})
+	if err != nil {
+		t.Errorf("Failed to retain chunks: %s", err)
+		return
+	}
+	unreferenced, err := dao.ReleaseChunks([]string{chunk.Id})
+	if err != nil || len(unreferenced) != 0 {
+		t.Errorf("Expected the chunk to still be referenced, got %+v: %s", unreferenced, err)
+		return
+	}
+	unreferenced, err = dao.ReleaseChunks([]string{chunk.Id})
+	if err != nil || len(unreferenced) != 1 || unreferenced[0].Id != chunk.Id {
+		t.Errorf("Expected the chunk to be unreferenced, got %+v: %s", unreferenced, err)
+		return
+	}
+	unreferenced, err = dao.ReleaseChunks([]string{chunk.Id})
+	if err != nil || len(unreferenced) != 0 {
+		t.Errorf("Expected the chunk to be gone, got %+v: %s", unreferenced, err)
+		return
+	}
+}
+
+func TestCompressionFollowsClosestSetting(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	on, off := true, false
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	enabled, err := dao.GetCompression(TestUserA, TestFileA, true)
+	if err != nil || !enabled {
+		t.Errorf("Expected the default without settings: %s", err)
+		return
+	}
+	err = dao.SetUserCompression(TestUserA, &off)
+	enabled, err = dao.GetCompression(TestUserA, TestFileA, true)
+	if err != nil || enabled {
+		t.Errorf("Expected the user's setting to win over the default: %s", err)
+		return
+	}
+	err = dao.SetDirCompression("/a", &on)
+	enabled, err = dao.GetCompression(TestUserA, TestFileA, false)
+	if err != nil || !enabled {
+		t.Errorf("Expected the directory's setting to win over the user's: %s", err)
+		return
+	}
+	err = dao.ChangeFilePath("/a", "/c", func() error { return nil })
+	enabled, err = dao.GetCompression(TestUserA, "/c/test.txt", false)
+	if err != nil || !enabled {
+		t.Errorf("Expected the setting to move with the directory: %s", err)
+		return
+	}
+	err = dao.SetDirCompression("/c", nil)
+	enabled, err = dao.GetCompression(TestUserA, "/c/test.txt", true)
+	if err != nil || enabled {
+		t.Errorf("Expected the user's setting once the directory's is removed: %s", err)
+		return
+	}
+}
+
+func TestUsageFollowsFilesVersionsAndUploads(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUser(TestUserB, TestPasswordB)
+	err = dao.AddCopiedEntry(TestUserA, TestFileA, "sum", false)
+	err = dao.SetFileSize(TestFileA, 100)
+	err = dao.AddFileVersion(TestUserB, TestFileA, "blob1", "key", 1, 100)
+	err = dao.AddFileVersion(TestUserB, TestFileA, "blob2", "key", 2, 40)
+	err = dao.SetFileSize(TestFileA, 40)
+	err = dao.AddUsage(TestUserA, 7)
+	if err != nil {
+		t.Errorf("Failed to record usage: %s", err)
+		return
+	}
+	quotas, err := dao.GetQuotas(TestUserA, 0, 0)
+	if err != nil || len(quotas) != 1 || quotas[0].Used != 147 {
+		t.Errorf("Expected the file, its older version and the upload to count, got %+v: %s", quotas, err)
+		return
+	}
+	err = dao.ChangeFilePath(TestFileA, TestFileB, func() error { return nil })
+	err = dao.AddCopiedEntry(TestUserA, TestFileB, "sum", false)
+	err = dao.AddUsage(TestUserA, -7)
+	quotas, err = dao.GetQuotas(TestUserA, 0, 0)
+	if err != nil || len(quotas) != 1 || quotas[0].Used != 100 {
+		t.Errorf("Expected moving and replacing the file to count only its versions, got %+v: %s", quotas, err)
+		return
+	}
+	err = dao.RemoveTrashItem(database.TrashItem{TrashPath: TestFileB}, func() error { return nil })
+	quotas, err = dao.GetQuotas(TestUserA, 0, 0)
+	if err != nil || len(quotas) != 1 || quotas[0].Used != 0 {
+		t.Errorf("Expected nothing to count once the file is removed, got %+v: %s", quotas, err)
+		return
+	}
+	quotas, err = dao.GetQuotas(TestUserB, 0, 0)
+	if err != nil || len(quotas) != 1 || quotas[0].Used != 0 {
+		t.Errorf("Expected versions not to count against their author, got %+v: %s", quotas, err)
+	}
+}
+
+func TestSnapshotsCopyRowsWithUsage(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddCopiedEntry(TestUserA, TestFileA, "sum", false)
+	err = dao.SetFileSize(TestFileA, 100)
+	err = dao.AddSnapshot(TestUserA, "one", "/a", "/snapshots/one", 1)
+	if err != nil {
+		t.Errorf("Failed to add snapshot: %s", err)
+		return
+	}
+	snapshots, err := dao.GetSnapshots(TestUserA)
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "one" {
+		t.Errorf("Expected the snapshot to be listed, got %+v: %s", snapshots, err)
+		return
+	}
+	permission, err := dao.CheckUserReadPermission(TestUserA, "/snapshots/one/test.txt")
+	if err != nil || !permission {
+		t.Errorf("Expected the permissions to be copied: %s", err)
+		return
+	}
+	checkSum, err := dao.GetCheckSum("/snapshots/one/test.txt")
+	if err != nil || checkSum != "sum" {
+		t.Errorf("Expected the checksum to be copied, got %q: %s", checkSum, err)
+		return
+	}
+	quotas, err := dao.GetQuotas(TestUserA, 0, 0)
+	if err != nil || len(quotas) != 1 || quotas[0].Used != 200 {
+		t.Errorf("Expected snapshots to count against quotas, got %+v: %s", quotas, err)
+		return
+	}
+	err = dao.RemoveSnapshot(snapshots[0], func() error { return nil })
+	quotas, err = dao.GetQuotas(TestUserA, 0, 0)
+	if err != nil || len(quotas) != 1 || quotas[0].Used != 100 {
+		t.Errorf("Expected the snapshot's usage to go with it, got %+v: %s", quotas, err)
+		return
+	}
+	permission, err = dao.CheckUserReadPermission(TestUserA, "/snapshots/one/test.txt")
+	if err != nil || permission {
+		t.Errorf("Expected the rows to be removed with the snapshot: %s", err)
+		return
+	}
+	snapshots, err = dao.GetSnapshots(TestUserA)
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("Expected no snapshots, got %+v: %s", snapshots, err)
+		return
+	}
+}
+
+func TestImportedGroupAccessFollowsMode(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUser(TestUserB, TestPasswordB)
+	err = dao.AddGroup(TestGroupA)
+	err = dao.AddUserToGroup(TestUserB, TestGroupA)
+	exists, member, err := dao.CheckGroup(TestUserB, TestGroupA)
+	if err != nil || !exists || !member {
+		t.Errorf("Expected %s to be in %s: %s", TestUserB, TestGroupA, err)
+		return
+	}
+	exists, member, err = dao.CheckGroup(TestUserA, TestGroupB)
+	if err != nil || exists || member {
+		t.Errorf("Expected %s not to exist: %s", TestGroupB, err)
+		return
+	}
+	err = dao.AddCopiedEntry(TestUserA, TestFileA, "sum", false)
+	err = dao.SetGroupAccess(TestGroupA, TestFileA, true, false)
+	if err != nil {
+		t.Errorf("Failed to set group access: %s", err)
+		return
+	}
+	read, err := dao.CheckUserReadPermission(TestUserB, TestFileA)
+	if err != nil || !read {
+		t.Errorf("Expected the group to read the file: %s", err)
+		return
+	}
+	write, err := dao.CheckUserWritePermission(TestUserB, TestFileA)
+	if err != nil || write {
+		t.Errorf("Expected the group not to write the file: %s", err)
+		return
+	}
+}
+
+func TestImportedGroupAccessReplacesOwnersGroups(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUser(TestUserB, TestPasswordB)
+	err = dao.AddGroup(TestGroupA)
+	err = dao.AddUserToGroup(TestUserA, TestGroupA)
+	err = dao.AddUserToGroup(TestUserB, TestGroupA)
+	err = dao.AddCopiedEntry(TestUserA, TestFileA, "sum", false)
+	err = dao.AddCopiedEntry(TestUserA, TestFileB, "sum", false)
+	write, err := dao.CheckUserWritePermission(TestUserB, TestFileA)
+	if err != nil || !write {
+		t.Errorf("Expected the owner's group to write the file: %s", err)
+		return
+	}
+	err = dao.SetGroupAccess(TestGroupA, TestFileA, true, false)
+	err = dao.SetGroupAccess(TestGroupA, TestFileB, false, false)
+	if err != nil {
+		t.Errorf("Failed to set group access: %s", err)
+		return
+	}
+	write, err = dao.CheckUserWritePermission(TestUserB, TestFileA)
+	if err != nil || write {
+		t.Errorf("Expected the group not to write the file anymore: %s", err)
+		return
+	}
+	read, err := dao.CheckUserReadPermission(TestUserB, TestFileB)
+	if err != nil || read {
+		t.Errorf("Expected the group not to read the file anymore: %s", err)
+		return
+	}
+	write, err = dao.CheckUserWritePermission(TestUserA, TestFileA)
+	if err != nil || !write {
+		t.Errorf("Expected the owner to still write the file: %s", err)
+		return
+	}
+}
+
+func TestSwapCheckSumOnlyReplacesExpected(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddFile(TestUserA, TestFileA, "old", func() error { return nil })
+	replaced := false
+	swapped, err := dao.SwapCheckSum(TestFileA, "stale", "new", func() error { replaced = true; return nil })
+	if err != nil || swapped || replaced {
+		t.Errorf("Expected a stale checksum not to be swapped: %s", err)
+		return
+	}
+	swapped, err = dao.SwapCheckSum(TestFileA, "old", "new", func() error { replaced = true; return nil })
+	if err != nil || !swapped || !replaced {
+		t.Errorf("Expected the current checksum to be swapped: %s", err)
+		return
+	}
+	checkSum, err := dao.GetCheckSum(TestFileA)
+	if err != nil || checkSum != "new" {
+		t.Errorf("Expected checksum to be replaced, got %q: %s", checkSum, err)
+		return
+	}
+}
+
+func TestLinksMoveAndLeaveWithPath(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddLink(TestUserA, TestDirA+"/link", "sum", "../test.txt")
+	if err != nil {
+		t.Errorf("Failed to add link: %s", err)
+		return
+	}
+	if _, isLink, err := dao.GetLink(TestFileA); err != nil || isLink {
+		t.Errorf("Expected a plain path not to be a link: %s", err)
+		return
+	}
+	err = dao.ChangeFilePath(TestDirA, "/b/folder", func() error { return nil })
+	target, isLink, err := dao.GetLink("/b/folder/link")
+	if err != nil || !isLink || target != "../test.txt" {
+		t.Errorf("Expected the link to move with its directory, got %q: %s", target, err)
+		return
+	}
+	err = dao.TrashPath(TestUserA, "/b/folder", "/trash/folder", 0, func() error { return nil })
+	items, err := dao.GetTrashItems(TestUserA)
+	if err != nil || len(items) != 1 {
+		t.Errorf("Expected one trash item: %s", err)
+		return
+	}
+	err = dao.RemoveTrashItem(items[0], func() error { return nil })
+	if _, isLink, err := dao.GetLink("/trash/folder/link"); err != nil || isLink {
+		t.Errorf("Expected the link to be removed with its directory: %s", err)
+		return
+	}
+}
+
+func TestTagsMoveAndCopyWithPath(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.SetTag(TestDirA+"/test.txt", "project", "apollo")
+	err = dao.SetTag(TestDirA+"/test.txt", "project", "gemini")
+	if err != nil {
+		t.Errorf("Failed to set tag: %s", err)
+		return
+	}
+	err = dao.ChangeFilePath(TestDirA, "/b/folder", func() error { return nil })
+	tags, err := dao.GetTags("/b/folder/test.txt")
+	if err != nil || len(tags) != 1 || tags[0].Value != "gemini" {
+		t.Errorf("Expected the replaced tag to move with its directory, got %v: %s", tags, err)
+		return
+	}
+	err = dao.CopyTags("/b/folder/test.txt", TestFileB)
+	tags, err = dao.GetTags(TestFileB)
+	if err != nil || len(tags) != 1 || tags[0].Key != "project" {
+		t.Errorf("Expected the tag to be copied, got %v: %s", tags, err)
+		return
+	}
+	removed, err := dao.RemoveTag(TestFileB, "project")
+	if err != nil || !removed {
+		t.Errorf("Expected the tag to be removed: %s", err)
+		return
+	}
+	removed, err = dao.RemoveTag(TestFileB, "project")
+	if err != nil || removed {
+		t.Errorf("Expected no tag left to remove: %s", err)
+		return
+	}
+}
+
+func TestDataKeysDestroyedOnceUnused(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	key, err := dao.GetFileKey(TestDirA+"/test.txt", database.DataKey{Id: "k1", Wrapped: "w1"})
+	key, err = dao.GetFileKey(TestDirA+"/test.txt", database.DataKey{Id: "k2", Wrapped: "w2"})
+	if err != nil || key.Id != "k1" {
+		t.Errorf("Expected the file to keep its first key, got %v: %s", key, err)
+		return
+	}
+	err = dao.ChangeFilePath(TestDirA, "/b/folder", func() error { return nil })
+	err = dao.AddFileVersion(TestUserA, "/b/folder/test.txt", "blob", "k1", 1, 0)
+	err = dao.RemoveFileKeys("/b/folder")
+	err = dao.RemoveUnusedDataKeys()
+	if _, found, err := dao.GetDataKey("k1"); err != nil || !found {
+		t.Errorf("Expected the key of a kept version to stay: %s", err)
+		return
+	}
+	if _, found, err := dao.GetDataKey("k2"); err != nil || found {
+		t.Errorf("Expected the second key not to be stored: %s", err)
+		return
+	}
+	err = dao.DeleteUser(TestUserA, []string{"/b/folder"}, func() error { return nil })
+	err = dao.RemoveUnusedDataKeys()
+	if _, found, err := dao.GetDataKey("k1"); err != nil || found {
+		t.Errorf("Expected the key to be destroyed with the user's files: %s", err)
+		return
+	}
+	exists, err := dao.CheckUserExists(TestUserA)
+	if err != nil || exists {
+		t.Errorf("Expected the user to be deleted: %s", err)
+	}
+}
+
+func TestOthersOwningFilesBelowPath(t *testing.T) {
+	dao, err := database.NewPermissionDao()
+	if err != nil {
+		t.Errorf("Failed to create permissions dao: %s", err)
+		return
+	}
+	err = dao.AddUser(TestUserA, TestPasswordA)
+	err = dao.AddUser(TestUserB, TestPasswordB)
+	err = dao.AddCopiedEntry(TestUserA, TestDirA, "", true)
+	err = dao.AddCopiedEntry(TestUserA, TestDirA+"/a.txt", "sum", false)
+	shared, err := dao.CheckOthersOwnBelow(TestUserA, TestDirA)
+	if err != nil || shared {
+		t.Errorf("Expected only %s to own files in the directory: %s", TestUserA, err)
+		return
+	}
+	err = dao.AddCopiedEntry(TestUserB, TestDirA+"/b.txt", "sum", false)
+	shared, err = dao.CheckOthersOwnBelow(TestUserA, TestDirA)
+	if err != nil || !shared {
+		t.Errorf("Expected %s to own a file in the directory: %s", TestUserB, err)
+		return
+	}
+	shared, err = dao.CheckOthersOwnBelow(TestUserA, "/a")
+	if err != nil || !shared {
+		t.Errorf("Expected the file to count below parents too: %s", err)
+	}
+}
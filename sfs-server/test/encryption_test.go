@@ -3,6 +3,10 @@ package test
 import (
 	"../database"
 	"../encryption"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -48,3 +52,59 @@ func TestChecksum(t *testing.T) {
 		t.Errorf("failed")
 	}
 }
+
+func TestEncryptContent(t *testing.T) {
+	content := []byte("line one\nline two\n")
+	encrypted, err := encryption.EncryptContent(content)
+	if err != nil || string(encrypted) == string(content) {
+		t.Errorf("failed to encrypt content with error: %s", err)
+		return
+	}
+	decrypted, err := encryption.DecryptContent(encrypted)
+	if err != nil || string(decrypted) != string(content) {
+		t.Errorf("failed to decrypt content with error: %s", err)
+	}
+	if encryption.ContentHash(content) != encryption.ContentHash(decrypted) {
+		t.Errorf("expected equal contents to hash the same")
+	}
+}
+
+func TestContentReaderSeek(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), encryption.ChunkSize/4)
+	encrypted, err := encryption.EncryptContent(content)
+	if err != nil {
+		t.Errorf("failed to encrypt content with error: %s", err)
+		return
+	}
+	reader, err := encryption.NewContentReader(bytes.NewReader(encrypted), int64(len(encrypted)))
+	if err != nil || reader.Size() != int64(len(content)) {
+		t.Errorf("failed to open encrypted content with error: %s", err)
+		return
+	}
+	offset := int64(encryption.ChunkSize - 5)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		t.Errorf("failed to seek with error: %s", err)
+		return
+	}
+	part := make([]byte, 10)
+	if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[offset:offset+10]) {
+		t.Errorf("failed to read across chunks with error: %s", err)
+	}
+	truncated := encrypted[:encryption.HeaderSize+encryption.ChunkSize+16]
+	reader, err = encryption.NewContentReader(bytes.NewReader(truncated), int64(len(truncated)))
+	if err == nil {
+		_, err = ioutil.ReadAll(reader)
+	}
+	if err == nil {
+		t.Errorf("expected contents cut short at a chunk boundary to be rejected")
+	}
+}
+
+func TestContentReaderRejectsPlaintext(t *testing.T) {
+	for _, plaintext := range []string{"hi", "plaintext from before encryption"} {
+		_, err := encryption.NewContentReader(strings.NewReader(plaintext), int64(len(plaintext)))
+		if err != encryption.ErrNoHeader {
+			t.Errorf("expected %q to have no header, got %v", plaintext, err)
+		}
+	}
+}
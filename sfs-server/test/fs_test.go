@@ -0,0 +1,776 @@
+package test
+
+import (
+	"../config"
+	"../database"
+	"../encryption"
+	"../fs"
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	TestExportUser = "Exporter"
+	TestFsUserA    = "Alice"
+	TestFsUserB    = "Bob"
+	TestSessionA   = "sessionA"
+	TestSessionB   = "sessionB"
+)
+
+// setupHome starts from an empty database and returns the home directory of
+// a new user called username, which the caller removes again.
+func setupHome(username string) (string, error) {
+	if _, err := database.NewPermissionDao(); err != nil {
+		return "", err
+	}
+	return addHome(username)
+}
+
+// addHome adds another user and returns their home directory.
+func addHome(username string) (string, error) {
+	if err := os.MkdirAll(fs.HomeDir, 0700); err != nil {
+		return "", err
+	}
+	if err := fs.AddUser(username, TestPasswordA); err != nil {
+		return "", err
+	}
+	return fs.GetHomeDir(username)
+}
+
+// createFile creates the file name in workingDir for username and writes
+// contents to it.
+func createFile(workingDir string, username string, name string, contents string) (string, error) {
+	message, err := fs.Touch(workingDir, username, name)
+	if err != nil || message != "Done." {
+		return message, err
+	}
+	return fs.Write(workingDir, username, "", name, strings.NewReader(contents), fs.Overwrite, 0, fs.Precondition{})
+}
+
+// readFile returns the contents of the file name in workingDir as username
+// reads them, or the message saying why they can't.
+func readFile(workingDir string, username string, name string) (string, string, error) {
+	file, message, err := fs.Cat(workingDir, username, name)
+	if err != nil || message != "" {
+		return "", message, err
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	return string(contents), "", err
+}
+
+// storedPath returns the path on disk of the entry name in dir.
+func storedPath(dir string, name string) string {
+	encryption.EncryptMany(&name)
+	return dir + "/" + name
+}
+
+func TestExportListsStoredChecksums(t *testing.T) {
+	home, err := setupHome(TestExportUser)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	_, err = fs.Mkdir(home, TestExportUser, "docs")
+	_, err = fs.Touch(home, TestExportUser, "docs/a.txt")
+	_, err = fs.Write(home, TestExportUser, "", "docs/a.txt", strings.NewReader("hello"), fs.Overwrite, 0, fs.Precondition{})
+	if err != nil {
+		t.Errorf("Failed to write file: %s", err)
+		return
+	}
+	path := "docs/a.txt"
+	err = encryption.EncryptMany(&path)
+	stored, err := database.Dao.GetCheckSum(home + "/" + path)
+	if err != nil {
+		t.Errorf("Failed to get stored checksum: %s", err)
+		return
+	}
+	expected := map[string]string{
+		"docs/":      "",
+		"docs/a.txt": "hello",
+		"SHA256SUMS": hex.EncodeToString([]byte(stored)) + "  docs/a.txt\n",
+	}
+	for _, format := range []fs.ExportFormat{fs.ExportTar, fs.ExportZip} {
+		export, message, err := fs.ExportDir(home, TestExportUser, "docs", format, true)
+		if err != nil || message != "" {
+			t.Errorf("Failed to export %s: %s %v", format, message, err)
+			return
+		}
+		var archive bytes.Buffer
+		if err := export.Stream(&archive); err != nil {
+			t.Errorf("Failed to stream %s export: %s", format, err)
+			return
+		}
+		entries, err := readArchive(format, archive.Bytes())
+		if err != nil {
+			t.Errorf("Failed to read %s export: %s", format, err)
+			return
+		}
+		if len(entries) != len(expected) {
+			t.Errorf("Expected %d entries in %s export, got %v", len(expected), format, entries)
+			return
+		}
+		for name, contents := range expected {
+			if got, ok := entries[name]; !ok || got != contents {
+				t.Errorf("Expected %s in %s export to hold %q, got %q", name, format, contents, got)
+				return
+			}
+		}
+	}
+}
+
+// readArchive returns the contents of every entry in an exported archive by
+// name.
+func readArchive(format fs.ExportFormat, data []byte) (map[string]string, error) {
+	entries := make(map[string]string)
+	if format == fs.ExportZip {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range archive.File {
+			src, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			contents, err := ioutil.ReadAll(src)
+			src.Close()
+			if err != nil {
+				return nil, err
+			}
+			entries[file.Name] = string(contents)
+		}
+		return entries, nil
+	}
+	archive := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		entries[header.Name] = string(contents)
+	}
+}
+
+func TestRevertAndVersionRetention(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	_, err = createFile(home, TestFsUserA, "a.txt", "one")
+	_, err = fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("two"), fs.Overwrite, 0, fs.Precondition{})
+	if err != nil {
+		t.Errorf("Failed to write file: %s", err)
+		return
+	}
+	// The empty file is kept as version 1, before the first write.
+	message, err := fs.Revert(home, TestFsUserA, TestSessionA, "a.txt", 2)
+	if err != nil || message != "Reverted to version 2." {
+		t.Errorf("Failed to revert: %s %v", message, err)
+		return
+	}
+	contents, _, err := readFile(home, TestFsUserA, "a.txt")
+	if err != nil || contents != "one" {
+		t.Errorf("Expected the reverted contents, got %q: %v", contents, err)
+		return
+	}
+	message, err = fs.CatVersion(home, TestFsUserA, "a.txt", 9)
+	if err != nil || message != "Version 9 does not exist." {
+		t.Errorf("Expected a missing version to be reported: %s %v", message, err)
+		return
+	}
+	versions, err := database.Dao.GetFileVersions(storedPath(home, "a.txt"))
+	if err != nil || len(versions) != 4 {
+		t.Errorf("Expected the revert to be kept as a version of its own, got %d: %v", len(versions), err)
+		return
+	}
+	count := config.VersionRetentionCount
+	defer func() { config.VersionRetentionCount = count }()
+	config.VersionRetentionCount = 2
+	fs.VersionGC()
+	versions, err = database.Dao.GetFileVersions(storedPath(home, "a.txt"))
+	if err != nil || len(versions) != 2 || versions[0].Version != 4 {
+		t.Errorf("Expected a lowered retention to prune the oldest versions, got %v: %v", versions, err)
+		return
+	}
+}
+
+func TestWriteModes(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	_, err = createFile(home, TestFsUserA, "a.txt", "hello")
+	steps := []struct {
+		mode     fs.WriteMode
+		position int64
+		data     string
+		expected string
+	}{
+		{fs.Append, 0, " world", "hello world"},
+		{fs.Pwrite, 6, "there", "hello there"},
+		{fs.Pwrite, 13, "!", "hello there\x00\x00!"},
+		{fs.Truncate, 5, "", "hello"},
+		{fs.Overwrite, 0, "bye", "bye"},
+	}
+	for _, step := range steps {
+		message, err := fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader(step.data), step.mode, step.position, fs.Precondition{})
+		if err != nil || !strings.HasPrefix(message, "Done.") {
+			t.Errorf("Failed to %s: %s %v", step.mode, message, err)
+			return
+		}
+		contents, _, err := readFile(home, TestFsUserA, "a.txt")
+		if err != nil || contents != step.expected {
+			t.Errorf("Expected %q after %s, got %q: %v", step.expected, step.mode, contents, err)
+			return
+		}
+		stored, err := database.Dao.GetCheckSum(storedPath(home, "a.txt"))
+		actual, err := encryption.CheckSum(storedPath(home, "a.txt"))
+		if err != nil || string(actual) != stored {
+			t.Errorf("Expected the checksum to be updated by %s: %v", step.mode, err)
+			return
+		}
+	}
+}
+
+func TestCatReadsRangesAndLegacyFiles(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	// Large enough to span several stored chunks.
+	data := make([]byte, 3<<19)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	_, err = createFile(home, TestFsUserA, "big.bin", string(data))
+	file, message, err := fs.Cat(home, TestFsUserA, "big.bin")
+	if err != nil || message != "" {
+		t.Errorf("Failed to open file: %s %v", message, err)
+		return
+	}
+	defer file.Close()
+	if file.Size() != int64(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), file.Size())
+		return
+	}
+	offset := int64(1<<20 - 5)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		t.Errorf("Failed to seek: %s", err)
+		return
+	}
+	part := make([]byte, 10)
+	if _, err := io.ReadFull(file, part); err != nil || !bytes.Equal(part, data[offset:offset+10]) {
+		t.Errorf("Expected the range across chunks to be read: %v", err)
+		return
+	}
+	_, err = fs.Touch(home, TestFsUserA, "old.txt")
+	err = ioutil.WriteFile(storedPath(home, "old.txt"), []byte("stored before encryption"), 0600)
+	contents, message, err := readFile(home, TestFsUserA, "old.txt")
+	if err != nil || contents != "stored before encryption" {
+		t.Errorf("Expected a file without a header to be read as it is, got %q: %s %v", contents, message, err)
+		return
+	}
+}
+
+func TestWriteSizeLimits(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	_, err = createFile(home, TestFsUserA, "a.txt", "kept")
+	maxWrite, maxUpload := config.MaxWriteBytes, config.MaxUserUploadBytes
+	defer func() { config.MaxWriteBytes, config.MaxUserUploadBytes = maxWrite, maxUpload }()
+	config.MaxWriteBytes = 8
+	body := http.MaxBytesReader(nil, ioutil.NopCloser(strings.NewReader("far more than eight bytes")), config.MaxWriteBytes)
+	data := fs.NewUpload(TestFsUserA, body)
+	_, err = fs.Write(home, TestFsUserA, TestSessionA, "a.txt", data, fs.Overwrite, 0, fs.Precondition{})
+	data.Close()
+	if !errors.Is(err, fs.ErrRequestTooLarge) {
+		t.Errorf("Expected a write over the request limit to be refused: %v", err)
+		return
+	}
+	config.MaxWriteBytes, config.MaxUserUploadBytes = maxWrite, 8
+	data = fs.NewUpload(TestFsUserA, strings.NewReader("far more than eight bytes"))
+	_, err = fs.Write(home, TestFsUserA, TestSessionA, "a.txt", data, fs.Overwrite, 0, fs.Precondition{})
+	data.Close()
+	if !errors.Is(err, fs.ErrUserUploadLimit) {
+		t.Errorf("Expected a write over the user limit to be refused: %v", err)
+		return
+	}
+	contents, _, err := readFile(home, TestFsUserA, "a.txt")
+	if err != nil || contents != "kept" {
+		t.Errorf("Expected refused writes to leave the file alone, got %q: %v", contents, err)
+		return
+	}
+}
+
+func TestResumedUploadCommitsOnLastChunk(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	id, message, err := fs.StartUpload(home, TestFsUserA, TestSessionA, "up.txt", 10)
+	if err != nil || message != "" {
+		t.Errorf("Failed to start upload: %s %v", message, err)
+		return
+	}
+	offset, _, err := fs.UploadChunk(TestFsUserA, id, 3, strings.NewReader("34567"))
+	if err != fs.ErrUploadOffset || offset != 0 {
+		t.Errorf("Expected a chunk at the wrong offset to be refused with the right one, got %d: %v", offset, err)
+		return
+	}
+	offset, message, err = fs.UploadChunk(TestFsUserA, id, 0, strings.NewReader("01234"))
+	if err != nil || offset != 5 || message != "" {
+		t.Errorf("Failed to upload first chunk, got %d: %s %v", offset, message, err)
+		return
+	}
+	if _, err := os.Stat(storedPath(home, "up.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to appear only once the upload is complete: %v", err)
+		return
+	}
+	offset, err = fs.UploadOffset(TestFsUserA, id)
+	if err != nil || offset != 5 {
+		t.Errorf("Expected the upload to resume at 5, got %d: %v", offset, err)
+		return
+	}
+	// Bytes past the announced length are not taken.
+	offset, message, err = fs.UploadChunk(TestFsUserA, id, 5, strings.NewReader("56789 and more"))
+	if err != nil || offset != 10 || !strings.HasPrefix(message, "Done.") {
+		t.Errorf("Failed to commit upload, got %d: %s %v", offset, message, err)
+		return
+	}
+	contents, _, err := readFile(home, TestFsUserA, "up.txt")
+	if err != nil || contents != "0123456789" {
+		t.Errorf("Expected the uploaded contents, got %q: %v", contents, err)
+		return
+	}
+	stored, err := database.Dao.GetCheckSum(storedPath(home, "up.txt"))
+	actual, err := encryption.CheckSum(storedPath(home, "up.txt"))
+	if err != nil || string(actual) != stored {
+		t.Errorf("Expected the checksum to be stored with the upload: %v", err)
+		return
+	}
+	if _, _, err := fs.UploadChunk(TestFsUserA, id, 10, strings.NewReader("x")); err != fs.ErrUnknownUpload {
+		t.Errorf("Expected the upload to be gone once committed: %v", err)
+		return
+	}
+}
+
+func TestTreeChecksumsForSync(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	otherHome, err := addHome(TestFsUserB)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(otherHome)
+	_, err = fs.Mkdir(home, TestFsUserA, "docs")
+	_, err = fs.Mkdir(home, TestFsUserA, "docs/sub")
+	_, err = createFile(home, TestFsUserA, "docs/sub/a.txt", "hello")
+	_, err = fs.Ln(home, TestFsUserA, "sub/a.txt", "docs/link")
+	entries, message, err := fs.Tree(home, TestFsUserA, "docs", true)
+	if err != nil || message != "" {
+		t.Errorf("Failed to list tree: %s %v", message, err)
+		return
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	expected := []fs.TreeEntry{
+		{Path: "sub", IsDir: true},
+		{Path: "sub/a.txt", Checksum: hex.EncodeToString(sum[:])},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected the tree to list plaintext checksums and leave out links, got %v", entries)
+		return
+	}
+	// Sync only removes local copies of files that are gone remotely, not of
+	// those that just can't be read.
+	_, message, err = fs.Stat(home, TestFsUserA, "docs/gone.txt")
+	if err != nil || message != "No such file or directory." {
+		t.Errorf("Expected a missing file to be reported as such: %s %v", message, err)
+		return
+	}
+	_, message, err = fs.Stat(home, TestFsUserB, "docs/sub/a.txt")
+	if err != nil || message == "No such file or directory." {
+		t.Errorf("Expected an unreadable file not to be reported as missing: %s %v", message, err)
+		return
+	}
+}
+
+func TestFindMatchesReadableEntries(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	_, err = createFile(home, TestFsUserA, "a.txt", "hello")
+	_, err = createFile(home, TestFsUserA, "b.log", "hello world")
+	_, err = fs.Mkdir(home, TestFsUserA, "sub")
+	_, err = createFile(home, TestFsUserA, "sub/c.txt", "hi")
+	// Entries without permissions for the user are left out.
+	err = ioutil.WriteFile(storedPath(home, "d.txt"), nil, 0600)
+	find := func(query fs.FindQuery) []string {
+		result, message, err := fs.Find(home, TestFsUserA, "", query)
+		if err != nil || message != "" {
+			t.Errorf("Failed to find: %s %v", message, err)
+			return nil
+		}
+		paths := make([]string, 0)
+		for _, entry := range result.Entries {
+			paths = append(paths, entry.Path)
+		}
+		// Entries are found in the order of their encrypted names.
+		sort.Strings(paths)
+		return paths
+	}
+	queries := []struct {
+		query    fs.FindQuery
+		expected []string
+	}{
+		{fs.FindQuery{Name: "*.txt", MinSize: -1, MaxSize: -1}, []string{"a.txt", "sub/c.txt"}},
+		{fs.FindQuery{Regex: "^sub/", MinSize: -1, MaxSize: -1}, []string{"sub/c.txt"}},
+		{fs.FindQuery{Type: "d", MinSize: -1, MaxSize: -1}, []string{"sub"}},
+		{fs.FindQuery{Type: "f", MinSize: 5, MaxSize: 5}, []string{"a.txt"}},
+	}
+	for _, q := range queries {
+		if paths := find(q.query); !reflect.DeepEqual(paths, q.expected) {
+			t.Errorf("Expected %v for %+v, got %v", q.expected, q.query, paths)
+			return
+		}
+	}
+	paged := make([]string, 0)
+	for offset := 0; offset < 3; offset++ {
+		result, _, err := fs.Find(home, TestFsUserA, "", fs.FindQuery{Type: "f", MinSize: -1, MaxSize: -1, Offset: offset, Limit: 1})
+		if err != nil || len(result.Entries) != 1 {
+			t.Errorf("Expected a page of one entry at %d: %v", offset, err)
+			return
+		}
+		if offset < 2 && result.Next != offset+1 {
+			t.Errorf("Expected a full page to point at the next one, got %d", result.Next)
+			return
+		}
+		paged = append(paged, result.Entries[0].Path)
+	}
+	sort.Strings(paged)
+	if expected := []string{"a.txt", "b.log", "sub/c.txt"}; !reflect.DeepEqual(paged, expected) {
+		t.Errorf("Expected the pages to hold %v, got %v", expected, paged)
+		return
+	}
+}
+
+func TestSearchFindsReadableFilesOnly(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	otherHome, err := addHome(TestFsUserB)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(otherHome)
+	_, err = createFile(home, TestFsUserA, "a.txt", "the quick brown fox")
+	_, err = createFile(home, TestFsUserA, "b.txt", "a slow brown dog")
+	output, err := fs.Search(TestFsUserA, "Brown fox")
+	if err != nil || output != "~/a.txt\n    the quick brown fox" {
+		t.Errorf("Expected only the file holding every term, with a snippet, got %q: %v", output, err)
+		return
+	}
+	output, err = fs.Search(TestFsUserB, "brown")
+	if err != nil || output != "No matches." {
+		t.Errorf("Expected files the user can't read to be left out, got %q: %v", output, err)
+		return
+	}
+	_, err = fs.Rm(home, TestFsUserA, TestSessionA, "a.txt", false, fs.Precondition{})
+	output, err = fs.Search(TestFsUserA, "fox")
+	if err != nil || output != "No matches." {
+		t.Errorf("Expected removed files to leave the index, got %q: %v", output, err)
+		return
+	}
+}
+
+func TestSnapshotsAreReadOnlyAndRestore(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	defer os.RemoveAll(storedPath(strings.TrimSuffix(fs.SnapshotDir, "/"), TestFsUserA))
+	_, err = createFile(home, TestFsUserA, "a.txt", "one")
+	message, err := fs.CreateSnapshot(TestFsUserA, "s1")
+	if err != nil || message != "Snapshot created." {
+		t.Errorf("Failed to create snapshot: %s %v", message, err)
+		return
+	}
+	_, err = fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("two"), fs.Overwrite, 0, fs.Precondition{})
+	snapshotDir, err := fs.Cd(home, TestFsUserA, "@s1")
+	if err != nil {
+		t.Errorf("Failed to enter snapshot: %s", err)
+		return
+	}
+	contents, _, err := readFile(snapshotDir, TestFsUserA, "a.txt")
+	if err != nil || contents != "one" {
+		t.Errorf("Expected the snapshot to keep the old contents, got %q: %v", contents, err)
+		return
+	}
+	message, err = fs.Write(snapshotDir, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("three"), fs.Overwrite, 0, fs.Precondition{})
+	if err != nil || message != "Snapshots are read-only." {
+		t.Errorf("Expected writes to the snapshot to be refused: %s %v", message, err)
+		return
+	}
+	message, err = fs.Rm(snapshotDir, TestFsUserA, TestSessionA, "a.txt", false, fs.Precondition{})
+	if err != nil || message != "Snapshots are read-only." {
+		t.Errorf("Expected removal from the snapshot to be refused: %s %v", message, err)
+		return
+	}
+	message, err = fs.RestoreSnapshot(TestFsUserA, TestSessionA, "s1", "~/a.txt")
+	if err != nil || !strings.HasPrefix(message, "Restored") {
+		t.Errorf("Failed to restore snapshot: %s %v", message, err)
+		return
+	}
+	contents, _, err = readFile(home, TestFsUserA, "a.txt")
+	if err != nil || contents != "one" {
+		t.Errorf("Expected the restored contents, got %q: %v", contents, err)
+		return
+	}
+	hard := config.UserQuotaHard
+	defer func() { config.UserQuotaHard = hard }()
+	config.UserQuotaHard = 1
+	message, err = fs.CreateSnapshot(TestFsUserA, "s2")
+	if err != nil || message != "Snapshot rejected, it would exceed your quota." {
+		t.Errorf("Expected a snapshot over the quota to be refused: %s %v", message, err)
+		return
+	}
+}
+
+func TestMandatoryLocksKeepOtherSessionsOut(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	defer fs.ReleaseLocks(TestSessionA)
+	_, err = createFile(home, TestFsUserA, "a.txt", "one")
+	_, err = fs.Mkdir(home, TestFsUserA, "dir")
+	_, err = createFile(home, TestFsUserA, "dir/b.txt", "two")
+	message, err := fs.Lock(home, TestFsUserA, TestSessionA, "a.txt", fs.ExclusiveLock, false, 0, false)
+	if err != nil || !strings.HasPrefix(message, "Locked until") {
+		t.Errorf("Failed to lock file: %s %v", message, err)
+		return
+	}
+	message, err = fs.Write(home, TestFsUserA, TestSessionB, "a.txt", strings.NewReader("!"), fs.Append, 0, fs.Precondition{})
+	if err != nil || !strings.HasPrefix(message, "Done.") {
+		t.Errorf("Expected advisory locks not to keep writes out: %s %v", message, err)
+		return
+	}
+	message, err = fs.Lock(home, TestFsUserA, TestSessionA, "a.txt", fs.ExclusiveLock, true, 0, false)
+	message, err = fs.Lock(home, TestFsUserA, TestSessionA, "dir/b.txt", fs.SharedLock, true, 0, false)
+	if err != nil || !strings.HasPrefix(message, "Locked until") {
+		t.Errorf("Failed to lock files: %s %v", message, err)
+		return
+	}
+	refused := map[string]func() (string, error){
+		"write": func() (string, error) {
+			return fs.Write(home, TestFsUserA, TestSessionB, "a.txt", strings.NewReader("!"), fs.Append, 0, fs.Precondition{})
+		},
+		"mv": func() (string, error) {
+			return fs.Mv(home, TestFsUserA, TestSessionB, "a.txt", "c.txt", fs.Precondition{})
+		},
+		"rm": func() (string, error) {
+			return fs.Rm(home, TestFsUserA, TestSessionB, "a.txt", false, fs.Precondition{})
+		},
+		"rm -r": func() (string, error) {
+			return fs.Rm(home, TestFsUserA, TestSessionB, "dir", true, fs.Precondition{})
+		},
+	}
+	for name, change := range refused {
+		message, err := change()
+		if err != nil || !strings.HasPrefix(message, "Locked by "+TestFsUserA) {
+			t.Errorf("Expected %s to be refused by the lock: %s %v", name, message, err)
+			return
+		}
+	}
+	message, err = fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("?"), fs.Append, 0, fs.Precondition{})
+	if err != nil || !strings.HasPrefix(message, "Done.") {
+		t.Errorf("Expected the session holding the lock to write: %s %v", message, err)
+		return
+	}
+	contents, _, err := readFile(home, TestFsUserA, "a.txt")
+	if err != nil || contents != "one!?" {
+		t.Errorf("Expected only the allowed writes, got %q: %v", contents, err)
+		return
+	}
+	_, err = fs.Mkdir(home, TestFsUserA, "empty")
+	message, err = fs.Lock(home, TestFsUserA, TestSessionA, "empty", fs.ExclusiveLock, true, 0, false)
+	message, err = fs.Rmdir(home, TestFsUserA, TestSessionB, "empty")
+	if err != nil || !strings.HasPrefix(message, "Locked by "+TestFsUserA) {
+		t.Errorf("Expected rmdir to be refused by the lock: %s %v", message, err)
+		return
+	}
+}
+
+func TestPreconditionsGuardChanges(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	_, err = createFile(home, TestFsUserA, "a.txt", "one")
+	fileInfo, message, err := fs.Stat(home, TestFsUserA, "a.txt")
+	if err != nil || message != "" || fileInfo.ETag == "" {
+		t.Errorf("Expected an ETag from stat: %s %v", message, err)
+		return
+	}
+	stale := fileInfo.ETag
+	_, err = fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("two"), fs.Overwrite, 0, fs.Precondition{IfMatch: stale})
+	if err != nil {
+		t.Errorf("Expected a write with a matching ETag to succeed: %v", err)
+		return
+	}
+	file, _, err := fs.Cat(home, TestFsUserA, "a.txt")
+	if err != nil || file == nil {
+		t.Errorf("Failed to cat file: %v", err)
+		return
+	}
+	file.Close()
+	if file.ETag == "" || file.ETag == stale {
+		t.Errorf("Expected the write to change the ETag, got %s", file.ETag)
+		return
+	}
+	failed := map[string]func() (string, error){
+		"write": func() (string, error) {
+			return fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("three"), fs.Overwrite, 0, fs.Precondition{IfMatch: stale})
+		},
+		"write if none match": func() (string, error) {
+			return fs.Write(home, TestFsUserA, TestSessionA, "a.txt", strings.NewReader("three"), fs.Overwrite, 0, fs.Precondition{IfNoneMatch: "*"})
+		},
+		"mv": func() (string, error) {
+			return fs.Mv(home, TestFsUserA, TestSessionA, "a.txt", "moved.txt", fs.Precondition{IfMatch: stale})
+		},
+		"rm": func() (string, error) {
+			return fs.Rm(home, TestFsUserA, TestSessionA, "a.txt", false, fs.Precondition{IfMatch: stale})
+		},
+	}
+	for name, change := range failed {
+		if _, err := change(); !errors.Is(err, fs.ErrPreconditionFailed) {
+			t.Errorf("Expected %s with a stale ETag to fail the precondition, got %v", name, err)
+			return
+		}
+	}
+	contents, _, err := readFile(home, TestFsUserA, "a.txt")
+	if err != nil || contents != "two" {
+		t.Errorf("Expected the file to be unchanged, got %q: %v", contents, err)
+		return
+	}
+	message, err = fs.Mv(home, TestFsUserA, TestSessionA, "a.txt", "moved.txt", fs.Precondition{IfMatch: "W/" + file.ETag})
+	if err != nil || message != "Done." {
+		t.Errorf("Expected a move with a matching weak ETag to succeed: %s %v", message, err)
+		return
+	}
+	message, err = fs.Rm(home, TestFsUserA, TestSessionA, "moved.txt", false, fs.Precondition{IfMatch: stale + ", " + file.ETag})
+	if err != nil || message != "Moved to trash." {
+		t.Errorf("Expected a removal matching one of the ETags to succeed: %s %v", message, err)
+		return
+	}
+}
+
+func TestLinksAreFollowedWithinTheJail(t *testing.T) {
+	home, err := setupHome(TestFsUserA)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(home)
+	otherHome, err := addHome(TestFsUserB)
+	if err != nil {
+		t.Errorf("Failed to create home directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(otherHome)
+	_, err = createFile(home, TestFsUserA, "target.txt", "linked")
+	message, err := fs.Ln(home, TestFsUserA, "target.txt", "link.txt")
+	if err != nil || message != "Done." {
+		t.Errorf("Failed to create link: %s %v", message, err)
+		return
+	}
+	contents, _, err := readFile(home, TestFsUserA, "link.txt")
+	if err != nil || contents != "linked" {
+		t.Errorf("Expected cat to follow the link, got %q: %v", contents, err)
+		return
+	}
+	fileInfo, message, err := fs.Stat(home, TestFsUserA, "link.txt")
+	if err != nil || message != "" || fileInfo.Link != "target.txt" {
+		t.Errorf("Expected stat to show the link's target: %s %v", message, err)
+		return
+	}
+	_, err = fs.Write(home, TestFsUserA, TestSessionA, "link.txt", strings.NewReader("!"), fs.Append, 0, fs.Precondition{})
+	contents, _, err = readFile(home, TestFsUserA, "target.txt")
+	if err != nil || contents != "linked!" {
+		t.Errorf("Expected writes to go through the link, got %q: %v", contents, err)
+		return
+	}
+	message, err = fs.Ln(home, TestFsUserA, "../../..", "escape")
+	if err != nil || message != "Links can't lead outside of SFS." {
+		t.Errorf("Expected links out of SFS to be refused: %s %v", message, err)
+		return
+	}
+	_, err = fs.Ln(home, TestFsUserA, "loop2", "loop1")
+	_, err = fs.Ln(home, TestFsUserA, "loop1", "loop2")
+	_, message, err = fs.Cat(home, TestFsUserA, "loop1")
+	if err != nil || message != "Too many levels of links." {
+		t.Errorf("Expected link loops to stop at the depth limit: %s %v", message, err)
+		return
+	}
+	_, message, err = fs.Cat(home, TestFsUserB, "link.txt")
+	if err != nil || message != "You are not authorized to follow this link." {
+		t.Errorf("Expected other users not to follow the link: %s %v", message, err)
+		return
+	}
+	_, err = fs.Ln(otherHome, TestFsUserB, "/"+TestFsUserA+"/target.txt", "peek")
+	_, message, err = fs.Cat(otherHome, TestFsUserB, "peek")
+	if err != nil || message != "You are not authorized to access this file." {
+		t.Errorf("Expected the link's target to be checked too: %s %v", message, err)
+		return
+	}
+}
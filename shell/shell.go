@@ -3,9 +3,14 @@ package main
 import (
 	"../sfs-client"
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func Signup(tokens []string, client *sfs_client.Client) string {
@@ -45,16 +50,368 @@ func Logout(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
+// lsPageSize is how many entries ls shows at once.
+const lsPageSize = 100
+
 func Ls(tokens []string, client *sfs_client.Client) string {
-	if len(tokens) != 1 {
-		return "Error: to many arguments.\nProper usage: ls"
-	} else {
-		output, err := client.Ls()
+	usage := "Error: wrong arguments.\nProper usage: ls [-l] [-a] [-R] [-S | -t] [-r] [-p <page>] [-tag <key>[=<value>]] [path]"
+	long, page, path := false, 1, ""
+	options := sfs_client.ListOptions{Limit: lsPageSize}
+	for i := 1; i < len(tokens); i++ {
+		switch {
+		case tokens[i] == "-p" && i+1 < len(tokens):
+			number, err := strconv.Atoi(tokens[i+1])
+			if err != nil || number < 1 {
+				return "Error: page must be a positive number."
+			}
+			page = number
+			i++
+		case tokens[i] == "-tag" && i+1 < len(tokens):
+			options.Tags = append(options.Tags, tokens[i+1])
+			i++
+		case strings.HasPrefix(tokens[i], "-") && len(tokens[i]) > 1:
+			for _, flag := range tokens[i][1:] {
+				switch flag {
+				case 'l':
+					long = true
+				case 'a':
+					options.All = true
+				case 'R':
+					options.Recursive = true
+				case 'S':
+					options.Sort = "size"
+				case 't':
+					options.Sort = "modified"
+				case 'r':
+					options.Reverse = true
+				default:
+					return usage
+				}
+			}
+		case path == "":
+			path = tokens[i]
+		default:
+			return usage
+		}
+	}
+	options.Offset = (page - 1) * lsPageSize
+	listing, output, err := client.List(path, options)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	if listing == nil {
+		return output
+	}
+	lines := new(bytes.Buffer)
+	table := tabwriter.NewWriter(lines, 0, 0, 1, ' ', 0)
+	for _, entry := range listing.Entries {
+		name := entry.Name
+		if options.Recursive {
+			name = entry.Path
+		}
+		if entry.Link != "" {
+			name += " -> " + entry.Link
+		}
+		if !long {
+			fmt.Fprintln(lines, name)
+			continue
+		}
+		kind := "-"
+		if entry.IsDir {
+			kind = "d"
+		} else if entry.Link != "" {
+			kind = "l"
+		}
+		owner, group := entry.Owner, entry.Group
+		if entry.Encrypted {
+			owner, group = "?", "?"
+		}
+		modified := time.Unix(entry.Modified, 0).Format("Jan _2 15:04")
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\n", kind, orDash(owner), orDash(group), entry.Size, modified, name)
+	}
+	table.Flush()
+	if pages := (listing.Total + lsPageSize - 1) / lsPageSize; pages > 1 {
+		fmt.Fprintf(lines, "Page %d of %d, use ls -p <page> for the others.\n", page, pages)
+	}
+	return strings.TrimSuffix(lines.String(), "\n")
+}
+
+func Stat(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) != 2 {
+		return "Error: wrong number of arguments.\nProper usage: stat <path>"
+	}
+	info, output, err := client.Stat(tokens[1])
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	if info == nil {
+		return output
+	}
+	kind := "file"
+	if info.IsDir {
+		kind = "directory"
+	} else if info.Link != "" {
+		kind = "link to " + info.Link
+	}
+	created := "-"
+	if info.Created != 0 {
+		created = time.Unix(info.Created, 0).Format("2006-01-02 15:04:05")
+	}
+	lines := new(bytes.Buffer)
+	table := tabwriter.NewWriter(lines, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(table, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(table, "Type:\t%s\n", kind)
+	fmt.Fprintf(table, "Size:\t%d bytes\n", info.Size)
+	fmt.Fprintf(table, "Owner:\t%s\n", orDash(info.Owner))
+	fmt.Fprintf(table, "Group:\t%s\n", orDash(info.Group))
+	fmt.Fprintf(table, "ACL:\t%s\n", orDash(strings.Join(info.Acl, ", ")))
+	fmt.Fprintf(table, "Created:\t%s\n", created)
+	fmt.Fprintf(table, "Modified:\t%s\n", time.Unix(info.Modified, 0).Format("2006-01-02 15:04:05"))
+	if !info.IsDir {
+		fmt.Fprintf(table, "Checksum:\t%s\n", info.Checksum)
+		fmt.Fprintf(table, "Compression:\t%s\n", info.Compression)
+		fmt.Fprintf(table, "ETag:\t%s\n", orDash(info.ETag))
+	}
+	table.Flush()
+	return strings.TrimSuffix(lines.String(), "\n")
+}
+
+func Find(tokens []string, client *sfs_client.Client) string {
+	usage := "Error: wrong arguments.\nProper usage: find [path] [-name <glob>] [-regex <regex>] [-type f|d] [-size [+|-]<bytes>[k|M|G]] [-mtime [+|-]<days>] [-tag <key>[=<value>]]"
+	path := ""
+	query := sfs_client.FindQuery{MinSize: -1, MaxSize: -1}
+	for i := 1; i < len(tokens); i++ {
+		if !strings.HasPrefix(tokens[i], "-") {
+			if path != "" {
+				return usage
+			}
+			path = tokens[i]
+			continue
+		}
+		if i+1 == len(tokens) {
+			return usage
+		}
+		value := tokens[i+1]
+		switch tokens[i] {
+		case "-name":
+			query.Name = value
+		case "-regex":
+			query.Regex = value
+		case "-tag":
+			query.Tags = append(query.Tags, value)
+		case "-type":
+			if value != "f" && value != "d" {
+				return usage
+			}
+			query.Type = value
+		case "-size":
+			sign, size, ok := parseFindNumber(value, true)
+			if !ok {
+				return usage
+			}
+			switch sign {
+			case '+':
+				query.MinSize = size + 1
+			case '-':
+				query.MaxSize = size - 1
+			default:
+				query.MinSize, query.MaxSize = size, size
+			}
+		case "-mtime":
+			sign, days, ok := parseFindNumber(value, false)
+			if !ok {
+				return usage
+			}
+			since := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+			switch sign {
+			case '+':
+				query.ModifiedBefore = since
+			case '-':
+				query.ModifiedAfter = since
+			default:
+				query.ModifiedAfter, query.ModifiedBefore = since-24*60*60, since
+			}
+		default:
+			return usage
+		}
+		i++
+	}
+	// Pages are shown as they come in, so large searches show results early.
+	found := 0
+	for {
+		result, output, err := client.Find(path, query)
+		if err != nil {
+			return "Error: something went wrong."
+		}
+		if result == nil {
+			return output
+		}
+		for _, entry := range result.Entries {
+			if entry.IsDir {
+				fmt.Println(entry.Path + "/")
+			} else {
+				fmt.Println(entry.Path)
+			}
+		}
+		found += len(result.Entries)
+		if result.Next == 0 {
+			break
+		}
+		query.Offset = result.Next
+	}
+	if found == 1 {
+		return "1 match."
+	}
+	return strconv.Itoa(found) + " matches."
+}
+
+// parseFindNumber parses a find number like +10, -3 or 5, returning its sign
+// separately. Sizes may end in k, M or G.
+func parseFindNumber(value string, size bool) (byte, int64, bool) {
+	sign := byte(0)
+	if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+		sign, value = value[0], value[1:]
+	}
+	unit := int64(1)
+	if size && value != "" {
+		switch value[len(value)-1] {
+		case 'k':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, 0, false
+	}
+	return sign, number * unit, true
+}
+
+func Search(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) < 2 {
+		return "Error: wrong number of arguments.\nProper usage: search <terms>"
+	}
+	output, err := client.Search(strings.Join(tokens[1:], " "))
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Quota(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) == 1 {
+		output, err := client.Quota()
 		if err != nil {
 			return "Error: something went wrong."
 		}
 		return output
 	}
+	usage := "Error: wrong arguments.\nProper usage: quota, or quota set [-g] <name> <soft>[k|M|G] <hard>[k|M|G]"
+	args, isGroup := tokens[1:], false
+	if len(args) == 0 || args[0] != "set" {
+		return usage
+	}
+	args = args[1:]
+	if len(args) > 0 && args[0] == "-g" {
+		args, isGroup = args[1:], true
+	}
+	if len(args) != 3 {
+		return usage
+	}
+	sign, soft, ok := parseFindNumber(args[1], true)
+	if !ok || sign != 0 {
+		return usage
+	}
+	sign, hard, ok := parseFindNumber(args[2], true)
+	if !ok || sign != 0 {
+		return usage
+	}
+	output, err := client.SetQuota(args[0], isGroup, soft, hard)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Compress(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) > 3 {
+		return "Error: wrong number of arguments.\nProper usage: compress [on|off|default] [directory]"
+	}
+	setting, path := "", ""
+	if len(tokens) > 1 {
+		setting = tokens[1]
+	}
+	if len(tokens) > 2 {
+		path = tokens[2]
+	}
+	output, err := client.Compression(setting, path)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Lock(tokens []string, client *sfs_client.Client) string {
+	usage := "Proper usage: lock [-s] [-m] [-f] [-t <ttl>] <path>"
+	shared, mandatory, force := false, false, false
+	var ttl time.Duration
+	args := tokens[1:]
+	for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-s":
+			shared = true
+		case "-m":
+			mandatory = true
+		case "-f":
+			force = true
+		case "-t":
+			duration, err := time.ParseDuration(args[1])
+			if err != nil || duration <= 0 {
+				return "Error: invalid lock time.\n" + usage
+			}
+			ttl = duration
+			args = args[1:]
+		default:
+			return "Error: unknown option " + args[0] + ".\n" + usage
+		}
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return "Error: wrong number of arguments.\n" + usage
+	}
+	output, err := client.Lock(args[0], shared, mandatory, ttl, force)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Unlock(tokens []string, client *sfs_client.Client) string {
+	force, args := false, tokens[1:]
+	if len(args) > 1 && args[0] == "-f" {
+		force, args = true, args[1:]
+	}
+	if len(args) != 1 {
+		return "Error: wrong number of arguments.\nProper usage: unlock [-f] <path>"
+	}
+	output, err := client.Unlock(args[0], force)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
 }
 
 func Pwd(tokens []string, client *sfs_client.Client) string {
@@ -70,8 +427,28 @@ func Pwd(tokens []string, client *sfs_client.Client) string {
 }
 
 func Cat(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) == 4 && tokens[1] == "-c" {
+		bounds := strings.SplitN(tokens[2], "-", 2)
+		start, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil || len(bounds) != 2 {
+			return "Error: byte range must look like <start>-<end>."
+		}
+		length := int64(-1)
+		if bounds[1] != "" {
+			end, err := strconv.ParseInt(bounds[1], 10, 64)
+			if err != nil || end < start {
+				return "Error: byte range must look like <start>-<end>."
+			}
+			length = end - start + 1
+		}
+		output, err := client.CatRange(tokens[3], start, length)
+		if err != nil {
+			return "Error: something went wrong."
+		}
+		return output
+	}
 	if len(tokens) != 2 {
-		return "Error: wrong number of arguments.\nProper usage: cat <filename>"
+		return "Error: wrong number of arguments.\nProper usage: cat [-c <start>-<end>] <filename>"
 	} else {
 		output, err := client.Cat(tokens[1])
 		if err != nil {
@@ -81,6 +458,43 @@ func Cat(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
+func Head(tokens []string, client *sfs_client.Client) string {
+	lines, filename, ok := parseLineCount(tokens)
+	if !ok {
+		return "Error: wrong arguments.\nProper usage: head [-n <lines>] <filename>"
+	}
+	output, err := client.Head(filename, lines)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Tail(tokens []string, client *sfs_client.Client) string {
+	lines, filename, ok := parseLineCount(tokens)
+	if !ok {
+		return "Error: wrong arguments.\nProper usage: tail [-n <lines>] <filename>"
+	}
+	output, err := client.Tail(filename, lines)
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+// parseLineCount reads the "[-n <lines>] <filename>" arguments of head and
+// tail, defaulting to 10 lines.
+func parseLineCount(tokens []string) (int, string, bool) {
+	if len(tokens) == 2 {
+		return 10, tokens[1], true
+	}
+	if len(tokens) == 4 && tokens[1] == "-n" {
+		lines, err := strconv.Atoi(tokens[2])
+		return lines, tokens[3], err == nil && lines >= 0
+	}
+	return 0, "", false
+}
+
 func Touch(tokens []string, client *sfs_client.Client) string {
 	if len(tokens) != 2 {
 		return "Error: wrong number of arguments.\nProper usage: touch <filename>"
@@ -93,6 +507,17 @@ func Touch(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
+func Ln(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) != 4 || tokens[1] != "-s" {
+		return "Error: only symbolic links are supported.\nProper usage: ln -s <target> <link_name>"
+	}
+	output, err := client.Ln(tokens[2], tokens[3])
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
 func Mkdir(tokens []string, client *sfs_client.Client) string {
 	if len(tokens) != 2 {
 		return "Error: wrong number of arguments.\nProper usage: mkdir <filename>"
@@ -129,11 +554,37 @@ func Mv(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
+func Cp(tokens []string, client *sfs_client.Client) string {
+	recursive := len(tokens) == 4 && tokens[1] == "-r"
+	if len(tokens) != 3 && !recursive {
+		return "Error: wrong number of arguments.\nProper usage: cp [-r] <source> <destination>"
+	} else {
+		output, err := client.Cp(tokens[len(tokens)-2], tokens[len(tokens)-1], recursive)
+		if err != nil {
+			return "Error: something went wrong."
+		}
+		return output
+	}
+}
+
 func Rm(tokens []string, client *sfs_client.Client) string {
+	recursive := len(tokens) == 3 && tokens[1] == "-r"
+	if len(tokens) != 2 && !recursive {
+		return "Error: wrong number of arguments.\nProper usage: rm [-r] <filename>"
+	} else {
+		output, err := client.Rm(tokens[len(tokens)-1], recursive)
+		if err != nil {
+			return "Error: something went wrong."
+		}
+		return output
+	}
+}
+
+func Rmdir(tokens []string, client *sfs_client.Client) string {
 	if len(tokens) != 2 {
-		return "Error: wrong number of arguments.\nProper usage: mkdir <filename>"
+		return "Error: wrong number of arguments.\nProper usage: rmdir <directory_name>"
 	} else {
-		output, err := client.Rm(tokens[1])
+		output, err := client.Rmdir(tokens[1])
 		if err != nil {
 			return "Error: something went wrong."
 		}
@@ -141,12 +592,127 @@ func Rm(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
-func Write(tokens []string, client *sfs_client.Client) string {
+func Trash(tokens []string, client *sfs_client.Client) string {
+	usage := "Proper usage: trash ls | trash restore <path> | trash empty"
+	if len(tokens) < 2 {
+		return "Error: wrong number of arguments.\n" + usage
+	}
+	var output string
+	var err error
+	switch {
+	case tokens[1] == "ls" && len(tokens) == 2:
+		output, err = client.TrashLs()
+	case tokens[1] == "restore" && len(tokens) == 3:
+		output, err = client.TrashRestore(tokens[2])
+	case tokens[1] == "empty" && len(tokens) == 2:
+		output, err = client.TrashEmpty()
+	default:
+		return "Error: wrong arguments.\n" + usage
+	}
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Snapshot(tokens []string, client *sfs_client.Client) string {
+	usage := "Proper usage: snapshot create <name> | snapshot ls | snapshot rm <name> | snapshot restore <name> [path]"
+	if len(tokens) < 2 {
+		return "Error: wrong number of arguments.\n" + usage
+	}
+	var output string
+	var err error
+	switch {
+	case tokens[1] == "create" && len(tokens) == 3:
+		output, err = client.CreateSnapshot(tokens[2])
+	case tokens[1] == "ls" && len(tokens) == 2:
+		output, err = client.ListSnapshots()
+	case tokens[1] == "rm" && len(tokens) == 3:
+		output, err = client.RemoveSnapshot(tokens[2])
+	case tokens[1] == "restore" && len(tokens) == 3:
+		output, err = client.RestoreSnapshot(tokens[2], "")
+	case tokens[1] == "restore" && len(tokens) == 4:
+		output, err = client.RestoreSnapshot(tokens[2], tokens[3])
+	default:
+		return "Error: wrong arguments.\n" + usage
+	}
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Tag(tokens []string, client *sfs_client.Client) string {
+	usage := "Proper usage: tag set <path> <key> <value> | tag get <path> <key> | tag rm <path> <key> | tag list <path>"
 	if len(tokens) < 3 {
-		return "Error: wrong number of arguments.\nProper usage: example.txt < 'data to write to file'"
+		return "Error: wrong number of arguments.\n" + usage
+	}
+	var output string
+	var err error
+	switch {
+	case tokens[1] == "set" && len(tokens) >= 5:
+		output, err = client.SetTag(tokens[2], tokens[3], strings.Join(tokens[4:], " "))
+	case tokens[1] == "get" && len(tokens) == 4:
+		output, err = client.GetTag(tokens[2], tokens[3])
+	case tokens[1] == "rm" && len(tokens) == 4:
+		output, err = client.RemoveTag(tokens[2], tokens[3])
+	case tokens[1] == "list" && len(tokens) == 3:
+		output, err = client.ListTags(tokens[2])
+	default:
+		return "Error: wrong arguments.\n" + usage
+	}
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Versions(tokens []string, client *sfs_client.Client) string {
+	var output string
+	var err error
+	if len(tokens) == 2 {
+		output, err = client.Versions(tokens[1])
+	} else if len(tokens) == 4 && tokens[1] == "cat" {
+		version, convErr := strconv.Atoi(tokens[3])
+		if convErr != nil {
+			return "Error: version must be a number."
+		}
+		output, err = client.CatVersion(tokens[2], version)
 	} else {
-		data := strings.Join(tokens[2:], " ")
-		output, err := client.Write(tokens[1], data)
+		return "Error: wrong number of arguments.\nProper usage: versions <filename> | versions cat <filename> <version>"
+	}
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Diff(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) != 4 {
+		return "Error: wrong number of arguments.\nProper usage: diff <filename> <version> <version>"
+	} else {
+		version, err := strconv.Atoi(tokens[2])
+		otherVersion, otherErr := strconv.Atoi(tokens[3])
+		if err != nil || otherErr != nil {
+			return "Error: versions must be numbers."
+		}
+		output, err := client.Diff(tokens[1], version, otherVersion)
+		if err != nil {
+			return "Error: something went wrong."
+		}
+		return output
+	}
+}
+
+func Revert(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) != 3 {
+		return "Error: wrong number of arguments.\nProper usage: revert <filename> <version>"
+	} else {
+		version, err := strconv.Atoi(tokens[2])
+		if err != nil {
+			return "Error: version must be a number."
+		}
+		output, err := client.Revert(tokens[1], version)
 		if err != nil {
 			return "Error: something went wrong."
 		}
@@ -154,6 +720,207 @@ func Write(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
+func Write(tokens []string, client *sfs_client.Client) string {
+	usage := "Proper usage: write [-o] <filename> <data> | write -p <offset> <filename> <data> | write -t <length> <filename>"
+	if len(tokens) < 3 {
+		return "Error: wrong number of arguments.\n" + usage
+	}
+	var output string
+	var err error
+	switch tokens[1] {
+	case "-o":
+		if len(tokens) < 4 {
+			return "Error: wrong number of arguments.\n" + usage
+		}
+		output, err = client.Overwrite(tokens[2], strings.Join(tokens[3:], " "))
+	case "-p":
+		if len(tokens) < 5 {
+			return "Error: wrong number of arguments.\n" + usage
+		}
+		offset, convErr := strconv.ParseInt(tokens[2], 10, 64)
+		if convErr != nil {
+			return "Error: offset must be a number."
+		}
+		output, err = client.Pwrite(tokens[3], strings.Join(tokens[4:], " "), offset)
+	case "-t":
+		if len(tokens) != 4 {
+			return "Error: wrong number of arguments.\n" + usage
+		}
+		length, convErr := strconv.ParseInt(tokens[2], 10, 64)
+		if convErr != nil {
+			return "Error: length must be a number."
+		}
+		output, err = client.Truncate(tokens[3], length)
+	default:
+		output, err = client.Write(tokens[1], strings.Join(tokens[2:], " "))
+	}
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
+func Upload(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) != 2 && len(tokens) != 3 {
+		return "Error: wrong number of arguments.\nProper usage: upload <local_path> [remote_path]"
+	}
+	remotePath := filepath.Base(tokens[1])
+	if len(tokens) == 3 {
+		remotePath = tokens[2]
+	}
+	output, err := client.Upload(tokens[1], remotePath)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return output
+}
+
+func Put(tokens []string, client *sfs_client.Client) string {
+	recursive, args := parseRecursive(tokens)
+	if len(args) != 1 && len(args) != 2 {
+		return "Error: wrong number of arguments.\nProper usage: put [-r] <local_path> [remote_path]"
+	}
+	remotePath := filepath.Base(args[0])
+	if len(args) == 2 {
+		remotePath = args[1]
+	}
+	output, err := client.Put(args[0], remotePath, recursive, showProgress())
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return output
+}
+
+func Get(tokens []string, client *sfs_client.Client) string {
+	recursive, args := parseRecursive(tokens)
+	if len(args) != 1 && len(args) != 2 {
+		return "Error: wrong number of arguments.\nProper usage: get [-r] <remote_path> [local_path]"
+	}
+	localPath := "."
+	if len(args) == 2 {
+		localPath = args[1]
+	}
+	output, err := client.Get(args[0], localPath, recursive, showProgress())
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return output
+}
+
+func Export(tokens []string, client *sfs_client.Client) string {
+	zip, checksums := false, false
+	args := tokens[1:]
+	for len(args) > 0 && (args[0] == "-z" || args[0] == "-c") {
+		zip = zip || args[0] == "-z"
+		checksums = checksums || args[0] == "-c"
+		args = args[1:]
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return "Error: wrong number of arguments.\nProper usage: export [-z] [-c] <remote_dir> [local_path]"
+	}
+	localPath := "."
+	if len(args) == 2 {
+		localPath = args[1]
+		zip = zip || strings.HasSuffix(localPath, ".zip")
+	}
+	output, err := client.Export(args[0], localPath, zip, checksums, showProgress())
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return output
+}
+
+func Import(tokens []string, client *sfs_client.Client) string {
+	mapping := ""
+	args := tokens[1:]
+	if len(args) > 1 && args[0] == "-m" {
+		mapping = args[1]
+		args = args[2:]
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return "Error: wrong number of arguments.\nProper usage: import [-m uid:<uid>=<user>,gid:<gid>=<group>] <local_tar> [remote_dir]"
+	}
+	remotePath := "."
+	if len(args) == 2 {
+		remotePath = args[1]
+	}
+	output, err := client.Import(args[0], remotePath, mapping, showProgress())
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return output
+}
+
+// parseRecursive splits the arguments of a command from its -r flag.
+func parseRecursive(tokens []string) (bool, []string) {
+	if len(tokens) > 1 && tokens[1] == "-r" {
+		return true, tokens[2:]
+	}
+	return false, tokens[1:]
+}
+
+// showProgress prints the progress of a transfer on one line per file,
+// whenever another percent, or MiB while the size isn't known, is done.
+func showProgress() sfs_client.Progress {
+	// lastShown is the last percent printed, or bytes without a size.
+	lastPath, lastShown, lineOpen := "", int64(-1), false
+	return func(path string, done int64, total int64) {
+		percent := int64(100)
+		if total > 0 {
+			percent = done * 100 / total
+		}
+		if path == lastPath && (total >= 0 && percent == lastShown || total < 0 && done-lastShown < 1<<20) {
+			return
+		}
+		if path != lastPath && lineOpen {
+			fmt.Println()
+		}
+		if total < 0 {
+			lastPath, lastShown, lineOpen = path, done, true
+			fmt.Printf("\r%s %d bytes", path, done)
+			return
+		}
+		lastPath, lastShown, lineOpen = path, percent, done != total
+		fmt.Printf("\r%s %3d%% (%d/%d bytes)", path, percent, done, total)
+		if !lineOpen {
+			fmt.Println()
+		}
+	}
+}
+
+func Sync(tokens []string, client *sfs_client.Client) string {
+	dryRun, watch := false, false
+	args := tokens[1:]
+	for len(args) > 0 && (args[0] == "-n" || args[0] == "-w") {
+		dryRun = dryRun || args[0] == "-n"
+		watch = watch || args[0] == "-w"
+		args = args[1:]
+	}
+	if len(args) != 2 || dryRun && watch {
+		return "Error: wrong number of arguments.\nProper usage: sync [-n | -w] <local_dir> <remote_dir>"
+	}
+	if !watch {
+		output, err := client.Sync(args[0], args[1], dryRun)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return output
+	}
+	watcher, err := client.Watch(args[0], args[1], func(output string, err error) {
+		if err != nil {
+			output = "Error: " + err.Error()
+		}
+		fmt.Println(output)
+	})
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	fmt.Println("Watching " + args[0] + ", press Enter to stop.")
+	stdin.ReadString('\n')
+	watcher.Stop()
+	return "Stopped watching " + args[0] + "."
+}
+
 func AddGroup(tokens []string, client *sfs_client.Client) string {
 	if len(tokens) != 2 {
 		return "Error: wrong number of arguments.\nProper usage: mkdir <filename>"
@@ -178,19 +945,68 @@ func AddUserToGroup(tokens []string, client *sfs_client.Client) string {
 	}
 }
 
+func DeleteUser(tokens []string, client *sfs_client.Client) string {
+	if len(tokens) != 2 {
+		return "Error: wrong number of arguments.\nProper usage: deluser <username>"
+	}
+	output, err := client.DeleteUser(tokens[1])
+	if err != nil {
+		return "Error: something went wrong."
+	}
+	return output
+}
+
 func help() string {
 	return "Here are all the commands you'll need:\n\n" +
 		"signup <username> <password> \t\t Create a new account\n" +
 		"login <username> <password> \t\t Log in to a user account\n" +
-		"ls \t\t\t\t\t\t\t\t\t List the contents of the current directory\n" +
+		"ls [-l] [-a] [-R] [-S | -t] [-r] [-p <page>] [-tag <key>[=<value>]] [path] \t List a directory, -l with details, -a with hidden entries, -R recursively, sorted by size or time, only tagged entries with -tag\n" +
+		"stat <path> \t\t\t\t\t\t show the details of a file or directory\n" +
+		"find [path] [-name <glob>] [-regex <regex>] [-type f|d] [-size [+|-]<n>] [-mtime [+|-]<days>] [-tag <key>[=<value>]] \t search a directory for matching entries\n" +
+		"search <terms> \t\t\t\t\t\t find the files you can read that contain all the terms\n" +
+		"quota \t\t\t\t\t\t\t\t show your disk usage and limits\n" +
+		"quota set [-g] <name> <soft> <hard> \t change the limits of a user or group, admins only\n" +
+		"compress [on|off|default] [dir] \t\t show or change whether your files, or a directory's, are compressed\n" +
 		"pwd \t\t\t\t\t\t\t\t show the current directory path\n" +
 		"mkdir <directory_name> \t\t\t\t Create a new directory in current directory\n" +
 		"cd \t\t\t\t\t\t\t\t\t Change the current directory\n" +
+		"cd @<snapshot> \t\t\t\t\t\t browse a snapshot of your home directory\n" +
 		"cat <file_name> \t\t\t\t\t Show contents of file, line by line.\n" +
+		"cat -c <start>-<end> <file_name> \t Show a byte range of a file\n" +
+		"head [-n <lines>] <file_name> \t\t Show the first lines of a file\n" +
+		"tail [-n <lines>] <file_name> \t\t Show the last lines of a file\n" +
 		"touch <file_name> \t\t\t\t\t create a new file with provided name in current directory\n" +
+		"ln -s <target> <link_name> \t\t\t create a link to a file or directory\n" +
 		"mv <old_path> <new_path> \t\t\t move a file from one location to another\n" +
+		"cp [-r] <source> <destination> \t\t copy a file, or a directory with -r\n" +
+		"rm [-r] <path> \t\t\t\t\t\t move a file, or a directory with -r, to the trash\n" +
+		"rmdir <directory_name> \t\t\t\t move an empty directory to the trash\n" +
+		"trash ls \t\t\t\t\t\t\t list the contents of the trash\n" +
+		"trash restore <path> \t\t\t\t restore a removed path from the trash\n" +
+		"trash empty \t\t\t\t\t\t permanently delete everything in the trash\n" +
+		"snapshot create <name> | ls | rm <name> \t take, list or delete snapshots of your home directory\n" +
+		"snapshot restore <name> [path] \t\t restore a path, or your whole home directory, from a snapshot\n" +
+		"tag set|get|rm|list <path> [<key> [<value>]] \t set, show, remove or list the tags of a file or directory\n" +
+		"lock [-s] [-m] [-f] [-t <ttl>] <path> \t lock a path exclusively or with -s shared, -m keeps others from changing it, -f steals it (admins)\n" +
+		"unlock [-f] <path> \t\t\t\t release your lock, or with -f every lock (admins)\n" +
+		"versions <file_name> \t\t\t\t list the kept versions of a file\n" +
+		"versions cat <file_name> <version> \t show the contents of a file version\n" +
+		"diff <file_name> <version> <version> \t compare two versions of a file\n" +
+		"revert <file_name> <version> \t\t restore a file to an earlier version\n" +
+		"write <file_name> <data> \t\t\t append data to a file\n" +
+		"write -o <file_name> <data> \t\t replace the contents of a file\n" +
+		"write -p <offset> <file_name> <data>  write data at an offset in a file\n" +
+		"write -t <length> <file_name> \t\t truncate a file to a length\n" +
+		"upload <local_path> [remote_path] \t upload a local file, resuming if interrupted\n" +
+		"put [-r] <local_path> [remote_path] \t upload a local file, or a directory with -r\n" +
+		"get [-r] <remote_path> [local_path] \t download a file, or a directory with -r\n" +
+		"export [-z] [-c] <remote_dir> [local_path]  download a directory as a tar, or zip with -z, archive, -c with a checksum manifest\n" +
+		"import [-m <mappings>] <local_tar> [remote_dir]  unpack a tar archive, -m gives uids and gids to users and groups\n" +
+		"sync [-n] <local_dir> <remote_dir> \t sync a local and a remote directory both ways, -n only shows what would change\n" +
+		"sync -w <local_dir> <remote_dir> \t keep syncing on every change until Enter is pressed\n" +
 		"addgroup <groupname> \t\t\t\t Create a new group with given name\n" +
-		"addtogroup <username> <groupname> \t Add a new user to group with provided name\n"
+		"addtogroup <username> <groupname> \t Add a new user to group with provided name\n" +
+		"deluser <username> \t\t\t\t delete an account and shred everything it owns, your own or any as an admin\n"
 }
 
 func handleInput(tokens []string, client *sfs_client.Client) string {
@@ -203,26 +1019,76 @@ func handleInput(tokens []string, client *sfs_client.Client) string {
 		return Logout(tokens, client)
 	case "ls":
 		return Ls(tokens, client)
+	case "stat":
+		return Stat(tokens, client)
+	case "find":
+		return Find(tokens, client)
+	case "search":
+		return Search(tokens, client)
+	case "quota":
+		return Quota(tokens, client)
+	case "compress":
+		return Compress(tokens, client)
 	case "pwd":
 		return Pwd(tokens, client)
 	case "cat":
 		return Cat(tokens, client)
+	case "head":
+		return Head(tokens, client)
+	case "tail":
+		return Tail(tokens, client)
 	case "mkdir":
 		return Mkdir(tokens, client)
 	case "touch":
 		return Touch(tokens, client)
 	case "cd":
 		return Cd(tokens, client)
+	case "ln":
+		return Ln(tokens, client)
+	case "tag":
+		return Tag(tokens, client)
 	case "mv":
 		return Mv(tokens, client)
+	case "cp":
+		return Cp(tokens, client)
 	case "rm":
 		return Rm(tokens, client)
+	case "rmdir":
+		return Rmdir(tokens, client)
+	case "trash":
+		return Trash(tokens, client)
+	case "snapshot":
+		return Snapshot(tokens, client)
+	case "lock":
+		return Lock(tokens, client)
+	case "unlock":
+		return Unlock(tokens, client)
+	case "versions":
+		return Versions(tokens, client)
+	case "diff":
+		return Diff(tokens, client)
+	case "revert":
+		return Revert(tokens, client)
 	case "write":
 		return Write(tokens, client)
+	case "upload":
+		return Upload(tokens, client)
+	case "put":
+		return Put(tokens, client)
+	case "get":
+		return Get(tokens, client)
+	case "export":
+		return Export(tokens, client)
+	case "import":
+		return Import(tokens, client)
+	case "sync":
+		return Sync(tokens, client)
 	case "addgroup":
 		return AddGroup(tokens, client)
 	case "addtogroup":
 		return AddUserToGroup(tokens, client)
+	case "deluser":
+		return DeleteUser(tokens, client)
 	case "help":
 		return help()
 	default:
@@ -243,12 +1109,14 @@ func errorMessage() string {
 	return "Command not recognized\n"
 }
 
+// stdin is shared by the prompt and commands that wait for input.
+var stdin = bufio.NewReader(os.Stdin)
+
 func main() {
 	client := sfs_client.NewClient()
-	reader := bufio.NewReader(os.Stdin)
 	fmt.Println(introMessage())
 	for {
-		input, err := reader.ReadString('\n')
+		input, err := stdin.ReadString('\n')
 		if err != nil {
 			continue
 		}